@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"dropeer/node"
+)
+
+// ControlClient talks to a running daemon's control API.
+type ControlClient struct {
+	baseURL string
+	token   string
+	client  *http.Client
+}
+
+// NewControlClient creates a client for the daemon at DROPEER_CONTROL, or at
+// the default control address, authenticated with the token the daemon saved
+// for this user.
+func NewControlClient() *ControlClient {
+	addr := os.Getenv("DROPEER_CONTROL")
+	if addr == "" {
+		addr = defaultControlAddr
+	}
+	c := &ControlClient{
+		baseURL: "http://" + addr,
+		client:  &http.Client{Timeout: 10 * time.Second},
+	}
+	if path, err := controlTokenPath(); err == nil {
+		if token, err := os.ReadFile(path); err == nil {
+			c.token = strings.TrimSpace(string(token))
+		}
+	}
+	return c
+}
+
+// Available reports whether a daemon is listening and accepts our token.
+func (c *ControlClient) Available() bool {
+	if c.token == "" {
+		return false
+	}
+	req, err := c.request("GET", "/downloads", nil)
+	if err != nil {
+		return false
+	}
+	client := &http.Client{Timeout: time.Second}
+	resp, err := client.Do(req)
+	if err != nil {
+		return false
+	}
+	resp.Body.Close()
+	return resp.StatusCode == http.StatusOK
+}
+
+func (c *ControlClient) request(method, path string, body io.Reader) (*http.Request, error) {
+	req, err := http.NewRequest(method, c.baseURL+path, body)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+c.token)
+	req.Header.Set("Content-Type", "application/json")
+	return req, nil
+}
+
+// do sends a request to the daemon and decodes its JSON response into out.
+func (c *ControlClient) do(method, path string, body, out any) error {
+	var reqBody io.Reader
+	if body != nil {
+		jsonData, _ := json.Marshal(body)
+		reqBody = bytes.NewBuffer(jsonData)
+	}
+	req, err := c.request(method, path, reqBody)
+	if err != nil {
+		return err
+	}
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(resp.Body)
+		return fmt.Errorf("daemon returned %s: %s", resp.Status, strings.TrimSpace(string(msg)))
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// checkDaemonFlags exits if any of the named flags were set, since they
+// configure the node and cannot be applied to a daemon that is already
+// running.
+func checkDaemonFlags(fs *flag.FlagSet, names ...string) {
+	var set []string
+	fs.Visit(func(f *flag.Flag) {
+		if slices.Contains(names, f.Name) {
+			set = append(set, "-"+f.Name)
+		}
+	})
+	if len(set) > 0 {
+		log.Fatalf("A daemon is running and %s cannot be applied to it; set them on the daemon or stop it first", strings.Join(set, ", "))
+	}
+}
+
+// shareViaDaemon hands a file to the daemon to seed.
+func shareViaDaemon(c *ControlClient, filePath string, encrypt bool) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		log.Fatalf("Invalid file path: %v", err)
+	}
+	var share Share
+	if err := c.do("POST", "/shares", AddShareRequest{Path: absPath, Encrypt: encrypt}, &share); err != nil {
+		log.Fatalf("Could not share file: %v", err)
+	}
+	log.Printf("Daemon is sharing '%s' with hash: %s", absPath, share.FileHash)
+	log.Printf("Link: %s", share.Link)
+}
+
+// getViaDaemon queues a download on the daemon and waits for it to finish.
+// The per-download options in req are applied by the daemon.
+func getViaDaemon(c *ControlClient, link node.Link, outputPath string, req AddDownloadRequest) {
+	absPath, err := filepath.Abs(outputPath)
+	if err != nil {
+		log.Fatalf("Invalid output path: %v", err)
+	}
+	req.FileHash, req.Key, req.Output = link.FileHash, link.Key, absPath
+	if err := c.do("POST", "/downloads", req, nil); err != nil {
+		log.Fatalf("Could not queue download: %v", err)
+	}
+	log.Printf("Download queued on daemon, waiting for it to finish...")
+
+	bar := &progressBar{}
+	for {
+		time.Sleep(time.Second)
+		var dl Download
+		if err := c.do("GET", "/downloads/"+link.FileHash, nil, &dl); err != nil {
+			log.Fatalf("Lost track of download: %v", err)
+		}
+		if dl.State == stateActive || dl.State == stateDone {
+			bar.draw(dl.BytesDone, dl.BytesTotal, dl.Rate, dl.ETA)
+		}
+		switch dl.State {
+		case stateDone:
+			fmt.Fprintln(os.Stderr)
+			log.Printf("Download complete. Saved to %s, daemon is now seeding it.", dl.Output)
+			return
+		case stateFailed:
+			log.Fatalf("Download failed: %s", dl.Error)
+		case stateCancelled:
+			log.Fatal("Download was cancelled")
+		}
+	}
+}
+
+// handleCtl implements `client ctl`, a command line front end for the control API.
+func handleCtl(args []string) {
+	c := NewControlClient()
+	if len(args) == 0 {
+		fmt.Println("Usage: client ctl <downloads|shares|pause|resume|cancel|priority|unshare> [args]")
+		return
+	}
+
+	var err error
+	switch args[0] {
+	case "downloads":
+		var list []Download
+		if err = c.do("GET", "/downloads", nil, &list); err == nil {
+			for _, dl := range list {
+				fmt.Printf("%s  %-9s  prio=%d  %s\n", dl.FileHash, dl.State, dl.Priority, dl.Output)
+			}
+		}
+	case "shares":
+		var list []Share
+		if err = c.do("GET", "/shares", nil, &list); err == nil {
+			for _, s := range list {
+				fmt.Printf("%s  %s\n", s.FileHash, s.Path)
+			}
+		}
+	case "pause", "resume", "cancel":
+		if len(args) < 2 {
+			log.Fatalf("%s requires a file hash", args[0])
+		}
+		err = c.do("POST", "/downloads/"+args[1]+"/"+args[0], nil, nil)
+	case "priority":
+		if len(args) < 3 {
+			log.Fatal("priority requires a file hash and a priority")
+		}
+		priority, perr := strconv.Atoi(args[2])
+		if perr != nil {
+			log.Fatalf("Invalid priority: %v", perr)
+		}
+		err = c.do("POST", "/downloads/"+args[1]+"/priority", PriorityRequest{Priority: priority}, nil)
+	case "unshare":
+		if len(args) < 2 {
+			log.Fatal("unshare requires a file hash")
+		}
+		err = c.do("DELETE", "/shares/"+args[1], nil, nil)
+	default:
+		log.Fatalf("Unknown ctl command %q", args[0])
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+}
@@ -0,0 +1,449 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+
+	"dropeer/node"
+)
+
+// defaultControlAddr is where the daemon serves its control API. Thin
+// clients use DROPEER_CONTROL instead when it is set.
+const defaultControlAddr = "127.0.0.1:4050"
+
+// controlTokenPath returns where the daemon keeps the secret that control
+// API requests must carry. Only the user running the daemon can read it, so
+// other local users and web pages cannot drive the daemon.
+func controlTokenPath() (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dropeer", "control.token"), nil
+}
+
+// newControlToken generates a control API secret and saves it for clients.
+func newControlToken() (string, error) {
+	path, err := controlTokenPath()
+	if err != nil {
+		return "", err
+	}
+	buf := make([]byte, 32)
+	if _, err := rand.Read(buf); err != nil {
+		return "", err
+	}
+	token := hex.EncodeToString(buf)
+	if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+		return "", err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, []byte(token), 0o600); err != nil {
+		return "", err
+	}
+	return token, os.Rename(tmp, path)
+}
+
+// requireToken rejects control requests without the daemon's secret, and
+// requests with a body that is not JSON.
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !ok || subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			http.Error(w, "missing or invalid control token", http.StatusUnauthorized)
+			return
+		}
+		if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+			if ct, _, _ := strings.Cut(r.Header.Get("Content-Type"), ";"); strings.TrimSpace(ct) != "application/json" {
+				http.Error(w, "requests must be application/json", http.StatusUnsupportedMediaType)
+				return
+			}
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// Download states reported by the control API.
+const (
+	stateQueued    = "queued"
+	stateActive    = "active"
+	statePaused    = "paused"
+	stateDone      = "done"
+	stateFailed    = "failed"
+	stateCancelled = "cancelled"
+)
+
+// Download is a download managed by the daemon.
+type Download struct {
+	FileHash string    `json:"file_hash"`
+	Output   string    `json:"output"`
+	Priority int       `json:"priority"`
+	State    string    `json:"state"`
+	Error    string    `json:"error,omitempty"`
+	Added    time.Time `json:"added"`
+
+	BytesDone  int64         `json:"bytes_done"`
+	BytesTotal int64         `json:"bytes_total"`
+	Rate       float64       `json:"rate"`
+	ETA        time.Duration `json:"eta"`
+	Retries    int           `json:"retries"`
+
+	key    []byte // decrypts the file if it is encrypted
+	opts   node.DownloadOptions
+	cancel context.CancelFunc
+}
+
+func (dl *Download) link() node.Link {
+	return node.Link{FileHash: dl.FileHash, Key: dl.key}
+}
+
+// Share is a file seeded by the daemon.
+type Share struct {
+	FileHash string `json:"file_hash"`
+	Path     string `json:"path"`
+	Link     string `json:"link,omitempty"`
+}
+
+// AddDownloadRequest asks the daemon to queue a download.
+type AddDownloadRequest struct {
+	FileHash string `json:"file_hash"`
+	Key      []byte `json:"key,omitempty"` // from the link of an encrypted file
+	Output   string `json:"output"`
+	Priority int    `json:"priority"`
+
+	Preallocate bool   `json:"preallocate,omitempty"`
+	Temp        string `json:"temp,omitempty"` // resume, keep or remove
+	HardLink    bool   `json:"hardlink,omitempty"`
+}
+
+// AddShareRequest asks the daemon to share a file.
+type AddShareRequest struct {
+	Path    string `json:"path"`
+	Encrypt bool   `json:"encrypt,omitempty"`
+}
+
+// PriorityRequest changes the priority of a download.
+type PriorityRequest struct {
+	Priority int `json:"priority"`
+}
+
+// daemon owns the node of a long-running client and runs queued downloads
+// in priority order.
+type daemon struct {
+	mu        sync.Mutex
+	ctx       context.Context
+	node      *node.Node
+	maxActive int
+	downloads map[string]*Download // fileHash -> Download
+}
+
+func handleDaemon(cfg node.Config, controlAddr string, maxActive int) {
+	ctx, stop := signalContext()
+	defer stop()
+	d := &daemon{
+		ctx:       ctx,
+		node:      newNode(ctx, cfg),
+		maxActive: maxActive,
+		downloads: make(map[string]*Download),
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("GET /downloads", d.listDownloadsHandler)
+	mux.HandleFunc("POST /downloads", d.addDownloadHandler)
+	mux.HandleFunc("GET /downloads/{hash}", d.getDownloadHandler)
+	mux.HandleFunc("POST /downloads/{hash}/pause", d.pauseHandler)
+	mux.HandleFunc("POST /downloads/{hash}/resume", d.resumeHandler)
+	mux.HandleFunc("POST /downloads/{hash}/cancel", d.cancelHandler)
+	mux.HandleFunc("POST /downloads/{hash}/priority", d.priorityHandler)
+	mux.HandleFunc("GET /shares", d.listSharesHandler)
+	mux.HandleFunc("POST /shares", d.addShareHandler)
+	mux.HandleFunc("DELETE /shares/{hash}", d.removeShareHandler)
+
+	token, err := newControlToken()
+	if err != nil {
+		log.Fatalf("Could not create control token: %v", err)
+	}
+	go func() {
+		log.Printf("Control API listening on %s", controlAddr)
+		if err := http.ListenAndServe(controlAddr, requireToken(token, mux)); err != nil {
+			log.Fatalf("Control API failed: %v", err)
+		}
+	}()
+
+	log.Println("Daemon is running. Press Ctrl+C to exit.")
+	serve(ctx, d.node)
+}
+
+// schedule starts queued downloads, highest priority first, until maxActive
+// downloads are running. The caller must hold d.mu.
+func (d *daemon) schedule() {
+	active := 0
+	var queued []*Download
+	for _, dl := range d.downloads {
+		switch dl.State {
+		case stateActive:
+			active++
+		case stateQueued:
+			queued = append(queued, dl)
+		}
+	}
+	sort.Slice(queued, func(i, j int) bool {
+		if queued[i].Priority != queued[j].Priority {
+			return queued[i].Priority > queued[j].Priority
+		}
+		return queued[i].Added.Before(queued[j].Added)
+	})
+
+	for _, dl := range queued {
+		if active >= d.maxActive {
+			return
+		}
+		ctx, cancel := context.WithCancel(d.ctx)
+		dl.State = stateActive
+		dl.Error = ""
+		dl.cancel = cancel
+		active++
+		go d.run(ctx, dl)
+	}
+}
+
+func (d *daemon) run(ctx context.Context, dl *Download) {
+	progress := func(ev node.ProgressEvent) {
+		d.mu.Lock()
+		defer d.mu.Unlock()
+		dl.BytesDone, dl.BytesTotal = ev.BytesDone, ev.BytesTotal
+		dl.Rate, dl.ETA = ev.Rate, ev.ETA
+		if ev.Kind == node.EventRetry {
+			dl.Retries++
+		}
+	}
+	opts := dl.opts
+	opts.Progress = progress
+	err := d.node.GetLink(ctx, dl.link(), dl.Output, opts)
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dl.cancel = nil
+	switch {
+	case dl.State == stateCancelled:
+		d.removeTemp(dl)
+	case dl.State == statePaused:
+		// Partial data stays in the temp file until the download is resumed.
+	case err != nil:
+		dl.State = stateFailed
+		dl.Error = err.Error()
+		log.Printf("Download of %s failed: %v", dl.FileHash[:10], err)
+	default:
+		dl.State = stateDone
+	}
+	d.schedule()
+}
+
+func (d *daemon) listDownloadsHandler(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	list := make([]Download, 0, len(d.downloads))
+	for _, dl := range d.downloads {
+		list = append(list, *dl)
+	}
+	d.mu.Unlock()
+
+	sort.Slice(list, func(i, j int) bool { return list[i].Added.Before(list[j].Added) })
+	writeJSON(w, list)
+}
+
+func (d *daemon) addDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	var req AddDownloadRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !node.ValidHash(req.FileHash) || !filepath.IsAbs(req.Output) {
+		http.Error(w, "a valid file_hash and an absolute output path are required", http.StatusBadRequest)
+		return
+	}
+	tempPolicy := node.TempResume
+	if req.Temp != "" {
+		var err error
+		if tempPolicy, err = parseTempPolicy(req.Temp); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	if dl, ok := d.downloads[req.FileHash]; ok && (dl.cancel != nil || (dl.State != stateCancelled && dl.State != stateFailed)) {
+		http.Error(w, "file is already being downloaded", http.StatusConflict)
+		return
+	}
+	dl := &Download{
+		FileHash: req.FileHash,
+		Output:   req.Output,
+		Priority: req.Priority,
+		State:    stateQueued,
+		Added:    time.Now(),
+		key:      req.Key,
+		opts:     node.DownloadOptions{Preallocate: req.Preallocate, TempPolicy: tempPolicy, HardLink: req.HardLink},
+	}
+	d.downloads[req.FileHash] = dl
+	log.Printf("Queued download of %s to %s", req.FileHash[:10], req.Output)
+	d.schedule()
+	writeJSON(w, dl)
+}
+
+func (d *daemon) getDownloadHandler(w http.ResponseWriter, r *http.Request) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dl, ok := d.downloads[r.PathValue("hash")]
+	if !ok {
+		http.Error(w, "download not found", http.StatusNotFound)
+		return
+	}
+	writeJSON(w, dl)
+}
+
+func (d *daemon) pauseHandler(w http.ResponseWriter, r *http.Request) {
+	d.update(w, r.PathValue("hash"), func(dl *Download) error {
+		switch dl.State {
+		case stateQueued:
+		case stateActive:
+			dl.cancel()
+		default:
+			return fmt.Errorf("cannot pause a %s download", dl.State)
+		}
+		dl.State = statePaused
+		return nil
+	})
+}
+
+func (d *daemon) resumeHandler(w http.ResponseWriter, r *http.Request) {
+	d.update(w, r.PathValue("hash"), func(dl *Download) error {
+		if dl.State != statePaused && dl.State != stateFailed {
+			return fmt.Errorf("cannot resume a %s download", dl.State)
+		}
+		if dl.cancel != nil {
+			return errors.New("download is still stopping, try again")
+		}
+		dl.State = stateQueued
+		return nil
+	})
+}
+
+func (d *daemon) cancelHandler(w http.ResponseWriter, r *http.Request) {
+	d.update(w, r.PathValue("hash"), func(dl *Download) error {
+		if dl.State == stateDone || dl.State == stateCancelled {
+			return fmt.Errorf("cannot cancel a %s download", dl.State)
+		}
+		if dl.cancel != nil {
+			dl.cancel() // run removes the temp file once the download stops
+		} else {
+			d.removeTemp(dl)
+		}
+		dl.State = stateCancelled
+		return nil
+	})
+}
+
+// removeTemp deletes the partial data of a download.
+func (d *daemon) removeTemp(dl *Download) {
+	if path, err := d.node.DownloadPath(dl.link(), dl.Output); err == nil {
+		os.Remove(node.TempPath(path))
+	}
+}
+
+func (d *daemon) priorityHandler(w http.ResponseWriter, r *http.Request) {
+	var req PriorityRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d.update(w, r.PathValue("hash"), func(dl *Download) error {
+		dl.Priority = req.Priority
+		return nil
+	})
+}
+
+// update applies fn to a download and reschedules. Errors from fn are
+// reported to the caller as conflicts.
+func (d *daemon) update(w http.ResponseWriter, hash string, fn func(dl *Download) error) {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	dl, ok := d.downloads[hash]
+	if !ok {
+		http.Error(w, "download not found", http.StatusNotFound)
+		return
+	}
+	if err := fn(dl); err != nil {
+		http.Error(w, err.Error(), http.StatusConflict)
+		return
+	}
+	d.schedule()
+	writeJSON(w, dl)
+}
+
+func (d *daemon) listSharesHandler(w http.ResponseWriter, r *http.Request) {
+	shares := []Share{}
+	for _, share := range d.node.Shares() {
+		shares = append(shares, Share{FileHash: share.FileHash, Path: share.Path})
+	}
+	writeJSON(w, shares)
+}
+
+func (d *daemon) addShareHandler(w http.ResponseWriter, r *http.Request) {
+	var req AddShareRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !filepath.IsAbs(req.Path) {
+		http.Error(w, "path must be absolute", http.StatusBadRequest)
+		return
+	}
+
+	share := d.node.Share
+	if req.Encrypt {
+		share = d.node.ShareEncrypted
+	}
+	link, err := share(r.Context(), req.Path)
+	var trackerErr *node.TrackerError
+	switch {
+	case errors.As(err, &trackerErr):
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	case err != nil:
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	log.Printf("Sharing '%s' with hash: %s", req.Path, link.FileHash)
+	writeJSON(w, Share{FileHash: link.FileHash, Path: req.Path, Link: link.String()})
+}
+
+func (d *daemon) removeShareHandler(w http.ResponseWriter, r *http.Request) {
+	err := d.node.Unshare(r.Context(), r.PathValue("hash"))
+	switch {
+	case errors.Is(err, node.ErrNotShared):
+		http.Error(w, "share not found", http.StatusNotFound)
+		return
+	case err != nil:
+		log.Printf("Could not withdraw share: %v", err)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+func writeJSON(w http.ResponseWriter, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
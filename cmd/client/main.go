@@ -1,134 +1,79 @@
 package main
 
 import (
-	"bytes"
-	"encoding/json"
+	"context"
 	"flag"
 	"fmt"
 	"log"
-	"net"
-	"net/http"
 	"os"
 	"os/signal"
+	"strings"
 	"syscall"
 	"time"
 
-	"dropeer/internal/common"
-	"dropeer/internal/discovery"
-	"dropeer/internal/p2p"
-
-	"github.com/google/uuid"
+	"dropeer/node"
 )
 
-// TrackerClient communicates with the tracker server.
-type TrackerClient struct {
-	baseURL  string
-	client   *http.Client
-	peerInfo common.PeerInfo
-}
-
-func getLocalIP() (string, error) {
-
-	conn, err := net.Dial("udp", "8.8.8.8:80")
-	if err != nil {
-		return "", err
-	}
-	defer conn.Close()
-	localAddr, ok := conn.LocalAddr().(*net.UDPAddr)
-	if !ok {
-		return "", fmt.Errorf("unexpected local address type")
-	}
-	return localAddr.IP.String(), nil
-}
-
-// Initialize a new TrackerClient.
-func NewTrackerClient(trackerURL string, peerPort int) *TrackerClient {
-
-	localIP, err := getLocalIP()
-	if err != nil {
-		log.Fatalf("Could not determine local IP address: %v", err)
-	}
-	log.Printf("Using local IP address: %s", localIP)
-
-	return &TrackerClient{
-		baseURL: trackerURL,
-		client:  &http.Client{Timeout: 10 * time.Second},
-		peerInfo: common.PeerInfo{
-			ID:   uuid.New().String(),
-			IP:   localIP,
-			Port: peerPort,
-		},
-	}
-}
-
-func (c *TrackerClient) Announce(fileHash string) error {
-	reqBody := common.AnnounceRequest{
-		FileHash: fileHash,
-		PeerInfo: c.peerInfo,
-	}
-	jsonData, _ := json.Marshal(reqBody)
-	resp, err := c.client.Post(c.baseURL+"/announce", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return err
-	}
-	defer resp.Body.Close()
-	if resp.StatusCode != http.StatusOK {
-		return fmt.Errorf("announce failed with status: %s", resp.Status)
-	}
-	log.Printf("Announced file %s to tracker", fileHash[:10])
-	return nil
-}
-
-func (c *TrackerClient) Want(fileHash string) ([]common.PeerInfo, error) {
-	reqBody := common.WantRequest{FileHash: fileHash}
-	jsonData, _ := json.Marshal(reqBody)
-	resp, err := c.client.Post(c.baseURL+"/want", "application/json", bytes.NewBuffer(jsonData))
-	if err != nil {
-		return nil, err
-	}
-	defer resp.Body.Close()
-
-	var wantResp common.WantResponse
-	if err := json.NewDecoder(resp.Body).Decode(&wantResp); err != nil {
-		return nil, err
-	}
-	return wantResp.Peers, nil
-}
-
-func (c *TrackerClient) StartHeartbeat(fileHashes []string) {
-	ticker := time.NewTicker(2 * time.Minute)
-	go func() {
-		for range ticker.C {
-			for _, hash := range fileHashes {
-				c.Announce(hash) // Re-announcing acts as a heartbeat
-			}
-		}
-	}()
-}
-
 func main() {
 	// Sub-commands
 	shareCmd := flag.NewFlagSet("share", flag.ExitOnError)
 	sharePort := shareCmd.Int("p", 4040, "Port for P2P communication")
+	shareMetrics := shareCmd.String("metrics", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9100)")
+	shareCDC := shareCmd.Bool("cdc", false, "Split files into content-defined chunks so new versions only transfer what changed")
+	shareIface := shareCmd.String("iface", "", "Only announce the addresses of this network interface")
+	shareAdvertise := shareCmd.String("advertise-addr", "", "Comma-separated addresses to announce instead of the detected ones")
+	shareEncrypt := shareCmd.Bool("encrypt", false, "Encrypt the file; only holders of the link can decrypt it")
 
 	getCmd := flag.NewFlagSet("get", flag.ExitOnError)
 	getPort := getCmd.Int("p", 4041, "Port for P2P communication")
 	getOutput := getCmd.String("o", "", "Output file name (required)")
+	getMetrics := getCmd.String("metrics", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9100)")
+	getScores := getCmd.String("scores", "", "Keep peer scores in this file between runs")
+	getCDC := getCmd.Bool("cdc", false, "Split files into content-defined chunks so new versions only transfer what changed")
+	getIface := getCmd.String("iface", "", "Only announce the addresses of this network interface")
+	getAdvertise := getCmd.String("advertise-addr", "", "Comma-separated addresses to announce instead of the detected ones")
+	getPriority := getCmd.Int("priority", 0, "Download priority when queued on a daemon (higher runs first)")
+	getPreallocate := getCmd.Bool("preallocate", false, "Reserve disk space for the whole file before downloading")
+	getTemp := getCmd.String("temp", "resume", "What to do with the temp file if the download fails: resume, keep or remove")
+	getLocal := getCmd.String("local", "", "Comma-separated directories to reuse files and chunks from")
+	getHardLink := getCmd.Bool("hardlink", false, "Hard-link files found locally or in the store instead of copying them; editing a hard-linked file then changes the original")
+	getStore := getCmd.String("store", "", "Keep downloads in this store directory and seed them from there")
+	getStoreQuota := getCmd.Int64("store-quota", 0, "Bytes the store may hold before the least recently used files are removed (0 for no limit)")
+	getStoreRetention := getCmd.Duration("store-retention", 0, "Remove files unused for this long from the store (0 to keep them)")
+
+	watchCmd := flag.NewFlagSet("watch", flag.ExitOnError)
+	watchPort := watchCmd.Int("p", 4040, "Port for P2P communication")
+	watchMetrics := watchCmd.String("metrics", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9100)")
+	watchCDC := watchCmd.Bool("cdc", false, "Split files into content-defined chunks so new versions only transfer what changed")
+	watchIface := watchCmd.String("iface", "", "Only announce the addresses of this network interface")
+	watchAdvertise := watchCmd.String("advertise-addr", "", "Comma-separated addresses to announce instead of the detected ones")
+	watchInterval := watchCmd.Duration("interval", 5*time.Second, "How often to rescan the directory")
+	watchSettle := watchCmd.Duration("settle", 5*time.Second, "Only publish files unmodified for this long")
+	watchHook := watchCmd.String("exec", "", "Command to run for each newly published file (gets DROPEER_PATH, DROPEER_HASH, DROPEER_LINK)")
+
+	daemonCmd := flag.NewFlagSet("daemon", flag.ExitOnError)
+	daemonPort := daemonCmd.Int("p", 4040, "Port for P2P communication")
+	daemonMetrics := daemonCmd.String("metrics", "", "Serve Prometheus metrics on this address (e.g. 127.0.0.1:9100)")
+	daemonScores := daemonCmd.String("scores", "", "Keep peer scores in this file between runs")
+	daemonCDC := daemonCmd.Bool("cdc", false, "Split files into content-defined chunks so new versions only transfer what changed")
+	daemonIface := daemonCmd.String("iface", "", "Only announce the addresses of this network interface")
+	daemonAdvertise := daemonCmd.String("advertise-addr", "", "Comma-separated addresses to announce instead of the detected ones")
+	daemonStore := daemonCmd.String("store", "", "Keep downloads in this store directory and seed them from there")
+	daemonStoreQuota := daemonCmd.Int64("store-quota", 0, "Bytes the store may hold before the least recently used files are removed (0 for no limit)")
+	daemonStoreRetention := daemonCmd.Duration("store-retention", 0, "Remove files unused for this long from the store (0 to keep them)")
+	daemonLocal := daemonCmd.String("local", "", "Comma-separated directories to reuse files and chunks from")
+	daemonControl := daemonCmd.String("control", defaultControlAddr, "Address for the local control API")
+	daemonMaxActive := daemonCmd.Int("max-active", 2, "Maximum number of concurrent downloads")
 
 	flag.Parse()
 
 	if len(os.Args) < 2 {
-		fmt.Println("Usage: client <share|get> [options]")
+		fmt.Println("Usage: client <share|get|watch|daemon|ctl> [options]")
 		return
 	}
 
-	// Discover tracker first
-	log.Println("Discovering tracker on the network...")
-	trackerURL, err := discovery.DiscoverTracker()
-	if err != nil {
-		log.Fatalf("Could not find tracker: %v", err)
-	}
-	log.Printf("Tracker found at: %s", trackerURL)
+	// share and get hand their work to a running daemon when there is one.
+	control := NewControlClient()
 
 	switch flag.Arg(0) {
 	case "share":
@@ -138,86 +83,142 @@ func main() {
 			log.Fatal("share command requires a file path")
 		}
 
-		handleShare(trackerURL, filePath, *sharePort)
+		if control.Available() {
+			checkDaemonFlags(shareCmd, "p", "metrics", "cdc", "iface", "advertise-addr")
+			shareViaDaemon(control, filePath, *shareEncrypt)
+			return
+		}
+		handleShare(filePath, *shareEncrypt, node.Config{Port: *sharePort, MetricsAddr: *shareMetrics, Interface: *shareIface, ContentDefinedChunking: *shareCDC, AdvertiseAddrs: splitList(*shareAdvertise)})
 
 	case "get":
 		getCmd.Parse(flag.Args()[2:])
-		fileHash := os.Args[2]
+		link, err := node.ParseLink(os.Args[2])
+		if err != nil {
+			log.Fatal(err)
+		}
 
-		if fileHash == "" {
-			log.Fatal("get command requires a file hash")
+		if link.FileHash == "" {
+			log.Fatal("get command requires a file hash or link")
 		}
 		if *getOutput == "" {
 			log.Fatal("-o (output file name) is required")
 		}
 
-		handleGet(trackerURL, fileHash, *getOutput, *getPort)
+		tempPolicy, err := parseTempPolicy(*getTemp)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		if control.Available() {
+			checkDaemonFlags(getCmd, "p", "metrics", "scores", "cdc", "iface", "advertise-addr", "local", "store", "store-quota", "store-retention")
+			getViaDaemon(control, link, *getOutput, AddDownloadRequest{Priority: *getPriority, Preallocate: *getPreallocate, Temp: *getTemp, HardLink: *getHardLink})
+			return
+		}
+		opts := node.DownloadOptions{Preallocate: *getPreallocate, TempPolicy: tempPolicy, HardLink: *getHardLink}
+		handleGet(link, *getOutput, opts, node.Config{Port: *getPort, MetricsAddr: *getMetrics, Interface: *getIface, ContentDefinedChunking: *getCDC, AdvertiseAddrs: splitList(*getAdvertise), ScoresPath: *getScores, LocalDirs: splitList(*getLocal), StoreDir: *getStore, StoreQuota: *getStoreQuota, StoreRetention: *getStoreRetention})
+
+	case "watch":
+		watchCmd.Parse(os.Args[2:])
+		dir := watchCmd.Arg(0)
+		if dir == "" {
+			log.Fatal("watch command requires a directory")
+		}
+
+		handleWatch(dir, node.Config{Port: *watchPort, MetricsAddr: *watchMetrics, Interface: *watchIface, ContentDefinedChunking: *watchCDC, AdvertiseAddrs: splitList(*watchAdvertise)}, *watchInterval, *watchSettle, *watchHook)
+
+	case "daemon":
+		daemonCmd.Parse(os.Args[2:])
+		handleDaemon(node.Config{Port: *daemonPort, MetricsAddr: *daemonMetrics, Interface: *daemonIface, ContentDefinedChunking: *daemonCDC, AdvertiseAddrs: splitList(*daemonAdvertise), ScoresPath: *daemonScores, LocalDirs: splitList(*daemonLocal), StoreDir: *daemonStore, StoreQuota: *daemonStoreQuota, StoreRetention: *daemonStoreRetention}, *daemonControl, *daemonMaxActive)
+
+	case "ctl":
+		handleCtl(os.Args[2:])
 
 	default:
-		fmt.Println("Unknown command. Use 'share' or 'get'.")
+		fmt.Println("Unknown command. Use 'share', 'get', 'watch', 'daemon' or 'ctl'.")
 	}
 }
 
-func handleShare(trackerURL, filePath string, peerPort int) {
-	fileManager := p2p.NewFileManager()
-	hash, err := fileManager.AddFile(filePath)
-	if err != nil {
-		log.Fatalf("Could not process file: %v", err)
-	}
-
-	trackerClient := NewTrackerClient(trackerURL, peerPort)
-	if err := trackerClient.Announce(hash); err != nil {
-		log.Fatalf("Could not announce file to tracker: %v", err)
+// splitList splits a comma-separated flag value, dropping empty items.
+func splitList(s string) []string {
+	var items []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			items = append(items, item)
+		}
 	}
+	return items
+}
 
-	// Start P2P server to seed the file
-	p2pServer := p2p.NewP2PServer(fileManager, fmt.Sprintf(":%d", peerPort))
-	go func() {
-		if err := p2pServer.Start(); err != nil {
-			log.Fatalf("P2P server failed: %v", err)
-		}
-	}()
+// parseTempPolicy parses the -temp flag of get.
+func parseTempPolicy(s string) (node.TempPolicy, error) {
+	switch s {
+	case "resume":
+		return node.TempResume, nil
+	case "keep":
+		return node.TempKeep, nil
+	case "remove":
+		return node.TempRemove, nil
+	}
+	return 0, fmt.Errorf("unknown -temp policy %q (want resume, keep or remove)", s)
+}
 
-	trackerClient.StartHeartbeat([]string{hash})
+// signalContext returns a context cancelled on Ctrl+C or SIGTERM.
+func signalContext() (context.Context, context.CancelFunc) {
+	return signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+}
 
-	log.Printf("Sharing '%s' with hash: %s", filePath, hash)
-	log.Println("Client is running. Press Ctrl+C to exit.")
+// newNode creates a node from cfg, exiting on failure. The tracker token is
+// taken from $DROPEER_TOKEN.
+func newNode(ctx context.Context, cfg node.Config) *node.Node {
+	if cfg.Token == "" {
+		cfg.Token = os.Getenv("DROPEER_TOKEN")
+	}
+	n, err := node.New(ctx, cfg)
+	if err != nil {
+		log.Fatalf("Could not start client: %v", err)
+	}
+	return n
+}
 
-	// Wait for shutdown signal
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
+// serve runs n until ctx is done.
+func serve(ctx context.Context, n *node.Node) {
+	if err := n.Run(ctx); err != nil {
+		log.Fatalf("P2P server failed: %v", err)
+	}
 	log.Println("Shutting down...")
 }
 
-func handleGet(trackerURL, fileHash, outputPath string, peerPort int) {
-	trackerClient := NewTrackerClient(trackerURL, peerPort)
+func handleShare(filePath string, encrypt bool, cfg node.Config) {
+	ctx, stop := signalContext()
+	defer stop()
+	n := newNode(ctx, cfg)
 
-	peers, err := trackerClient.Want(fileHash)
-	if err != nil {
-		log.Fatalf("Could not get peer list from tracker: %v", err)
+	share := n.Share
+	if encrypt {
+		share = n.ShareEncrypted
 	}
-	log.Printf("Found %d peers for the file.", len(peers))
-
-	fileManager := p2p.NewFileManager()
-	err = p2p.DownloadFile(fileHash, outputPath, peers, fileManager)
+	link, err := share(ctx, filePath)
 	if err != nil {
-		log.Fatalf("Download failed: %v", err)
+		log.Fatalf("Could not share file: %v", err)
 	}
+	log.Printf("Sharing '%s' with hash: %s", filePath, link.FileHash)
+	log.Printf("Link: %s", link)
+	log.Println("Client is running. Press Ctrl+C to exit.")
 
-	// Once downloaded, start seeding it
-	log.Println("Download successful. Now announcing and seeding the file...")
-	if err := trackerClient.Announce(fileHash); err != nil {
-		log.Printf("Could not announce newly downloaded file: %v", err)
-	}
+	serve(ctx, n)
+}
 
-	p2pServer := p2p.NewP2PServer(fileManager, fmt.Sprintf(":%d", peerPort))
-	go p2pServer.Start()
-	trackerClient.StartHeartbeat([]string{fileHash})
+func handleGet(link node.Link, outputPath string, opts node.DownloadOptions, cfg node.Config) {
+	ctx, stop := signalContext()
+	defer stop()
+	n := newNode(ctx, cfg)
 
-	log.Println("Client is now seeding. Press Ctrl+C to exit.")
-	c := make(chan os.Signal, 1)
-	signal.Notify(c, os.Interrupt, syscall.SIGTERM)
-	<-c
-	log.Println("Shutting down...")
+	bar := &progressBar{}
+	opts.Progress = bar.Update
+	if err := n.GetLink(ctx, link, outputPath, opts); err != nil {
+		log.Fatalf("Download failed: %v", err)
+	}
+
+	log.Println("Download successful. Client is now seeding. Press Ctrl+C to exit.")
+	serve(ctx, n)
 }
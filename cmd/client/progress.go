@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"strings"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+	"dropeer/internal/p2p"
+)
+
+const progressBarWidth = 30
+
+// progressBar renders download progress on a single terminal line.
+type progressBar struct {
+	mu       sync.Mutex
+	lastDraw time.Time
+}
+
+// Update renders ev. Chunk events are throttled so that fast downloads
+// don't flood the terminal.
+func (b *progressBar) Update(ev p2p.ProgressEvent) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+
+	switch ev.Kind {
+	case p2p.EventRetry:
+		return
+	case p2p.EventChunkDone:
+		if time.Since(b.lastDraw) < 100*time.Millisecond && ev.ChunksDone < ev.ChunksTotal {
+			return
+		}
+	}
+	b.lastDraw = time.Now()
+	b.draw(ev.BytesDone, ev.BytesTotal, ev.Rate, ev.ETA)
+	if ev.Kind == p2p.EventVerified {
+		fmt.Fprintln(os.Stderr)
+	}
+}
+
+func (b *progressBar) draw(done, total int64, rate float64, eta time.Duration) {
+	fraction := 1.0
+	if total > 0 {
+		fraction = float64(done) / float64(total)
+	}
+	filled := int(fraction * progressBarWidth)
+	bar := strings.Repeat("#", filled) + strings.Repeat(".", progressBarWidth-filled)
+
+	line := fmt.Sprintf("\r[%s] %5.1f%%  %s / %s  %s/s", bar, fraction*100, common.FormatBytes(done), common.FormatBytes(total), common.FormatBytes(int64(rate)))
+	if eta > 0 {
+		line += fmt.Sprintf("  ETA %s", eta.Round(time.Second))
+	}
+	fmt.Fprintf(os.Stderr, "%-100s", line)
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"io/fs"
+	"log"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"time"
+
+	"dropeer/node"
+)
+
+// folderWatcher keeps a node's shares in sync with the contents of a directory.
+type folderWatcher struct {
+	dir    string
+	node   *node.Node
+	settle time.Duration // files modified more recently than this are skipped
+	hook   string        // shell command run for each newly published file
+
+	// published maps the paths published so far to their hashes. The node
+	// shares a hash from one path only, so identical files are tracked here.
+	published map[string]string
+}
+
+func handleWatch(dir string, cfg node.Config, interval, settle time.Duration, hook string) {
+	absDir, err := filepath.Abs(dir)
+	if err != nil {
+		log.Fatalf("Invalid directory: %v", err)
+	}
+	if info, err := os.Stat(absDir); err != nil || !info.IsDir() {
+		log.Fatalf("%s is not a directory", dir)
+	}
+
+	ctx, stop := signalContext()
+	defer stop()
+	w := &folderWatcher{
+		dir:       absDir,
+		node:      newNode(ctx, cfg),
+		settle:    settle,
+		hook:      hook,
+		published: make(map[string]string),
+	}
+	w.scan(ctx)
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ctx.Done():
+				return
+			case <-ticker.C:
+				w.scan(ctx)
+			}
+		}
+	}()
+
+	log.Printf("Watching '%s' for files to share. Press Ctrl+C to exit.", absDir)
+	serve(ctx, w.node)
+}
+
+// scan publishes new files in the directory and withdraws deleted ones.
+func (w *folderWatcher) scan(ctx context.Context) {
+	sharedFrom := make(map[string]string) // hash -> path
+	for _, share := range w.node.Shares() {
+		sharedFrom[share.FileHash] = share.Path
+		if _, ok := w.published[share.Path]; ok {
+			w.published[share.Path] = share.FileHash // rehashed after a change
+		}
+	}
+	for path, hash := range w.published {
+		if _, ok := sharedFrom[hash]; !ok {
+			delete(w.published, path) // withdrawn by the node, publish it again
+		}
+	}
+	present := make(map[string]bool)
+
+	err := filepath.WalkDir(w.dir, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			log.Printf("Could not read %s: %v", path, err)
+			return nil
+		}
+		name := d.Name()
+		if path != w.dir && strings.HasPrefix(name, ".") {
+			if d.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if !d.Type().IsRegular() || strings.HasSuffix(name, ".tmp") {
+			return nil
+		}
+		present[path] = true
+		if _, ok := w.published[path]; ok {
+			return nil
+		}
+
+		info, err := d.Info()
+		if err != nil || time.Since(info.ModTime()) < w.settle {
+			return nil // still being written, pick it up on the next scan
+		}
+		w.publish(ctx, path)
+		return nil
+	})
+	if err != nil {
+		log.Printf("Could not scan %s: %v", w.dir, err)
+	}
+
+	for path, hash := range w.published {
+		if present[path] {
+			continue
+		}
+		delete(w.published, path)
+		if other, ok := w.copyOf(hash, present); ok {
+			if sharedFrom[hash] == path {
+				log.Printf("'%s' was removed, sharing its copy '%s' instead", path, other)
+				if _, err := w.node.Share(ctx, other); err != nil {
+					log.Printf("Could not share '%s': %v", other, err)
+				}
+			}
+			continue
+		}
+		log.Printf("'%s' was removed, withdrawing it", path)
+		if err := w.node.Unshare(ctx, hash); err != nil {
+			log.Printf("Could not withdraw %s: %v", hash[:10], err)
+		}
+	}
+}
+
+// copyOf returns a published path with the given hash that is still present.
+func (w *folderWatcher) copyOf(hash string, present map[string]bool) (string, bool) {
+	for path, h := range w.published {
+		if h == hash && present[path] {
+			return path, true
+		}
+	}
+	return "", false
+}
+
+func (w *folderWatcher) publish(ctx context.Context, path string) {
+	link, err := w.node.Share(ctx, path)
+	if err != nil {
+		log.Printf("Could not share '%s', will retry: %v", path, err)
+		return
+	}
+	w.published[path] = link.FileHash
+	log.Printf("Sharing '%s': %s", path, link)
+	if w.hook != "" {
+		w.runHook(path, link.FileHash, link.String())
+	}
+}
+
+// runHook runs the user's hook command with details of the published file in
+// its environment.
+func (w *folderWatcher) runHook(path, hash, link string) {
+	var cmd *exec.Cmd
+	if runtime.GOOS == "windows" {
+		cmd = exec.Command("cmd", "/C", w.hook)
+	} else {
+		cmd = exec.Command("sh", "-c", w.hook)
+	}
+	cmd.Env = append(os.Environ(),
+		"DROPEER_PATH="+path,
+		"DROPEER_HASH="+hash,
+		"DROPEER_LINK="+link,
+	)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		log.Printf("Hook failed for '%s': %v", path, err)
+	}
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"slices"
+	"strings"
+	"time"
+)
+
+// signedTokenPrefix marks tokens signed with the tracker's secret.
+const signedTokenPrefix = "dpt1."
+
+var (
+	errMissingToken = errors.New("missing bearer token")
+	errInvalidToken = errors.New("invalid token")
+	errExpiredToken = errors.New("token has expired")
+)
+
+// Scope is what a token grants access to. Swarms are partitioned by
+// namespace, so holders of different namespaces never see each other's
+// files. A non-empty Files list further restricts access to those hashes.
+type Scope struct {
+	Namespace string   `json:"ns"`
+	Files     []string `json:"files,omitempty"`
+}
+
+// allows reports whether the scope grants access to fileHash.
+func (s Scope) allows(fileHash string) bool {
+	return len(s.Files) == 0 || slices.Contains(s.Files, fileHash)
+}
+
+// staticToken is an entry of the tokens file.
+type staticToken struct {
+	Token string `json:"token"`
+	Scope
+}
+
+// tokenClaims is the payload of a signed token.
+type tokenClaims struct {
+	Scope
+	Expires int64 `json:"exp,omitempty"` // unix seconds, 0 for never
+}
+
+// Auth checks bearer tokens on tracker requests. A nil *Auth allows every
+// request into the default namespace.
+type Auth struct {
+	static map[string]Scope // sha256 of token -> scope
+	secret []byte           // key for signed tokens, nil if disabled
+}
+
+// NewAuth creates an authenticator from a JSON tokens file and a secret for
+// signed tokens. It returns nil if neither is configured.
+func NewAuth(tokensFile, secret string) (*Auth, error) {
+	if tokensFile == "" && secret == "" {
+		return nil, nil
+	}
+	a := &Auth{static: make(map[string]Scope)}
+	if secret != "" {
+		a.secret = []byte(secret)
+	}
+	if tokensFile != "" {
+		data, err := os.ReadFile(tokensFile)
+		if err != nil {
+			return nil, err
+		}
+		var tokens []staticToken
+		if err := json.Unmarshal(data, &tokens); err != nil {
+			return nil, fmt.Errorf("invalid tokens file %s: %w", tokensFile, err)
+		}
+		for _, t := range tokens {
+			if t.Token == "" {
+				return nil, fmt.Errorf("invalid tokens file %s: empty token", tokensFile)
+			}
+			a.static[tokenKey(t.Token)] = t.Scope
+		}
+	}
+	return a, nil
+}
+
+func tokenKey(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+// Authenticate returns the scope of the request's bearer token.
+func (a *Auth) Authenticate(r *http.Request) (Scope, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = ""
+	}
+	return a.check(token)
+}
+
+// AuthenticatePage is Authenticate for pages opened in a browser, which may
+// pass the token as a "token" query parameter instead. Query parameters end
+// up in logs and browser history, so API endpoints do not accept them.
+func (a *Auth) AuthenticatePage(r *http.Request) (Scope, error) {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	if !ok {
+		token = r.URL.Query().Get("token")
+	}
+	return a.check(token)
+}
+
+// check returns the scope of token.
+func (a *Auth) check(token string) (Scope, error) {
+	if a == nil {
+		return Scope{}, nil
+	}
+	if token == "" {
+		return Scope{}, errMissingToken
+	}
+
+	if strings.HasPrefix(token, signedTokenPrefix) && a.secret != nil {
+		return a.verify(token)
+	}
+	if scope, ok := a.static[tokenKey(token)]; ok {
+		return scope, nil
+	}
+	return Scope{}, errInvalidToken
+}
+
+// Mint creates a signed token for scope that expires after ttl, or never if
+// ttl is zero.
+func (a *Auth) Mint(scope Scope, ttl time.Duration) (string, error) {
+	if a == nil || a.secret == nil {
+		return "", errors.New("minting tokens requires a token secret")
+	}
+	claims := tokenClaims{Scope: scope}
+	if ttl > 0 {
+		claims.Expires = time.Now().Add(ttl).Unix()
+	}
+	payload, err := json.Marshal(claims)
+	if err != nil {
+		return "", err
+	}
+	body := base64.RawURLEncoding.EncodeToString(payload)
+	return signedTokenPrefix + body + "." + a.sign(body), nil
+}
+
+func (a *Auth) verify(token string) (Scope, error) {
+	body, sig, ok := strings.Cut(strings.TrimPrefix(token, signedTokenPrefix), ".")
+	if !ok || !hmac.Equal([]byte(sig), []byte(a.sign(body))) {
+		return Scope{}, errInvalidToken
+	}
+	payload, err := base64.RawURLEncoding.DecodeString(body)
+	if err != nil {
+		return Scope{}, errInvalidToken
+	}
+	var claims tokenClaims
+	if err := json.Unmarshal(payload, &claims); err != nil {
+		return Scope{}, errInvalidToken
+	}
+	if claims.Expires != 0 && time.Now().Unix() > claims.Expires {
+		return Scope{}, errExpiredToken
+	}
+	return claims.Scope, nil
+}
+
+func (a *Auth) sign(body string) string {
+	mac := hmac.New(sha256.New, a.secret)
+	mac.Write([]byte(body))
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"testing"
+	"time"
+)
+
+func newTestAuth(t *testing.T, secret string) *Auth {
+	t.Helper()
+	tokens := filepath.Join(t.TempDir(), "tokens.json")
+	data := `[{"token": "alpha-token", "ns": "alpha"}, {"token": "beta-token", "ns": "beta", "files": ["f1"]}]`
+	if err := os.WriteFile(tokens, []byte(data), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	a, err := NewAuth(tokens, secret)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return a
+}
+
+func TestAuthenticate(t *testing.T) {
+	a := newTestAuth(t, "secret")
+	other := newTestAuth(t, "other secret")
+	mint := func(a *Auth, scope Scope, ttl time.Duration) string {
+		token, err := a.Mint(scope, ttl)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return token
+	}
+	expired := func() string {
+		payload, _ := json.Marshal(tokenClaims{Scope: Scope{Namespace: "gamma"}, Expires: time.Now().Add(-time.Minute).Unix()})
+		body := base64.RawURLEncoding.EncodeToString(payload)
+		return signedTokenPrefix + body + "." + a.sign(body)
+	}
+	signed := mint(a, Scope{Namespace: "gamma", Files: []string{"f2"}}, time.Hour)
+	body, sig, _ := strings.Cut(strings.TrimPrefix(signed, signedTokenPrefix), ".")
+
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		want    Scope
+		wantErr error
+	}{
+		{name: "static token", header: "Bearer alpha-token", want: Scope{Namespace: "alpha"}},
+		{name: "static token with files", header: "Bearer beta-token", want: Scope{Namespace: "beta", Files: []string{"f1"}}},
+		{name: "query parameter", query: "alpha-token", wantErr: errMissingToken},
+		{name: "missing", wantErr: errMissingToken},
+		{name: "not a bearer token", header: "Basic alpha-token", wantErr: errMissingToken},
+		{name: "unknown static token", header: "Bearer gamma-token", wantErr: errInvalidToken},
+		{name: "signed token", header: "Bearer " + signed, want: Scope{Namespace: "gamma", Files: []string{"f2"}}},
+		{name: "signed token without expiry", header: "Bearer " + mint(a, Scope{Namespace: "delta"}, 0), want: Scope{Namespace: "delta"}},
+		{name: "expired signed token", header: "Bearer " + expired(), wantErr: errExpiredToken},
+		{name: "signed by another secret", header: "Bearer " + mint(other, Scope{Namespace: "gamma"}, time.Hour), wantErr: errInvalidToken},
+		{name: "tampered payload", header: "Bearer " + signedTokenPrefix + body + "x." + sig, wantErr: errInvalidToken},
+		{name: "tampered signature", header: "Bearer " + signedTokenPrefix + body + "." + sig[1:], wantErr: errInvalidToken},
+		{name: "missing signature", header: "Bearer " + signedTokenPrefix + body, wantErr: errInvalidToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/want", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.query != "" {
+				r.URL.RawQuery = "token=" + tt.query
+			}
+			scope, err := a.Authenticate(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("Authenticate() error = %v, want %v", err, tt.wantErr)
+			}
+			if scope.Namespace != tt.want.Namespace || !slices.Equal(scope.Files, tt.want.Files) {
+				t.Errorf("Authenticate() = %+v, want %+v", scope, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthenticatePage(t *testing.T) {
+	a := newTestAuth(t, "secret")
+	tests := []struct {
+		name    string
+		header  string
+		query   string
+		want    string
+		wantErr error
+	}{
+		{name: "header", header: "Bearer alpha-token", want: "alpha"},
+		{name: "query parameter", query: "alpha-token", want: "alpha"},
+		{name: "header wins", header: "Bearer beta-token", query: "alpha-token", want: "beta"},
+		{name: "unknown query parameter", query: "gamma-token", wantErr: errInvalidToken},
+		{name: "missing", wantErr: errMissingToken},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest("GET", "/", nil)
+			if tt.header != "" {
+				r.Header.Set("Authorization", tt.header)
+			}
+			if tt.query != "" {
+				r.URL.RawQuery = "token=" + tt.query
+			}
+			scope, err := a.AuthenticatePage(r)
+			if !errors.Is(err, tt.wantErr) {
+				t.Fatalf("AuthenticatePage() error = %v, want %v", err, tt.wantErr)
+			}
+			if scope.Namespace != tt.want {
+				t.Errorf("AuthenticatePage() namespace = %q, want %q", scope.Namespace, tt.want)
+			}
+		})
+	}
+}
+
+func TestAuthDisabled(t *testing.T) {
+	a, err := NewAuth("", "")
+	if err != nil || a != nil {
+		t.Fatalf("NewAuth() = %v, %v, want nil", a, err)
+	}
+	scope, err := a.Authenticate(httptest.NewRequest("GET", "/want", nil))
+	if err != nil || scope.Namespace != "" {
+		t.Errorf("Authenticate() = %+v, %v, want the default namespace", scope, err)
+	}
+	if _, err := a.Mint(Scope{}, 0); err == nil {
+		t.Error("Mint() succeeded without a secret")
+	}
+}
+
+func TestScopeAllows(t *testing.T) {
+	tests := []struct {
+		name  string
+		scope Scope
+		hash  string
+		want  bool
+	}{
+		{"any file", Scope{Namespace: "alpha"}, "f1", true},
+		{"listed file", Scope{Files: []string{"f1", "f2"}}, "f2", true},
+		{"unlisted file", Scope{Files: []string{"f1"}}, "f2", false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.scope.allows(tt.hash); got != tt.want {
+				t.Errorf("allows(%q) = %v, want %v", tt.hash, got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"html/template"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+var dashboardTemplate = template.Must(template.New("dashboard").Funcs(template.FuncMap{
+	"bytes": common.FormatBytes,
+	"ago":   func(t time.Time) string { return time.Since(t).Round(time.Second).String() + " ago" },
+	"short": func(s string) string { return s[:min(len(s), 12)] },
+	"join":  strings.Join,
+	"percent": func(left, size int64) string {
+		if size <= 0 {
+			return "?"
+		}
+		return fmt.Sprintf("%.0f%%", 100*float64(size-left)/float64(size))
+	},
+}).Parse(`<!DOCTYPE html>
+<html>
+<head>
+<meta charset="utf-8">
+<meta http-equiv="refresh" content="10">
+<title>Dropeer Tracker</title>
+<style>
+body { font-family: sans-serif; margin: 2em; color: #222; }
+table { border-collapse: collapse; margin-bottom: 2em; }
+th, td { text-align: left; padding: 4px 12px; border-bottom: 1px solid #ddd; vertical-align: top; }
+th { background: #f4f4f4; }
+code { font-size: 0.9em; }
+.muted { color: #888; }
+.warn { color: #b00; font-weight: bold; }
+</style>
+</head>
+<body>
+<h1>Dropeer Tracker</h1>
+<p class="muted">{{len .Files}} files, {{.PeerCount}} peers. Updated {{.Now.Format "15:04:05"}}.</p>
+
+<h2>Files</h2>
+{{if .Files}}
+<table>
+<tr><th>Name</th><th>Size</th><th>Hash</th><th>Seeders</th><th>Leechers</th><th>Completed</th><th>Peers</th></tr>
+{{range $f := .Files}}
+<tr>
+<td>{{if .Name}}{{.Name}}{{else}}<span class="muted">unknown</span>{{end}}</td>
+<td>{{if .Size}}{{bytes .Size}}{{end}}</td>
+<td><code title="{{.Hash}}">{{short .Hash}}</code></td>
+<td{{if not .Seeders}} class="warn"{{end}}>{{.Seeders}}</td>
+<td>{{.Leechers}}</td>
+<td>{{.Completed}}</td>
+<td>{{range .Peers}}<div><code title="{{join .Addrs ", "}}">{{.IP}}:{{.Port}}</code> {{if .Left}}{{percent .Left $f.Size}}{{else}}seeding{{end}} <span class="muted">{{short .ID}}, up {{bytes .Uploaded}}, down {{bytes .Downloaded}}, seen {{ago .LastSeen}}</span></div>{{end}}</td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No files are being shared.</p>
+{{end}}
+
+<h2>Announces in the last hour</h2>
+{{if .History}}
+<table>
+<tr><th>Time</th><th>Event</th><th>File</th><th>Peer</th></tr>
+{{range .History}}
+<tr>
+<td>{{.Time.Format "15:04:05"}}</td>
+<td>{{if .Event}}{{.Event}}{{else}}<span class="muted">update</span>{{end}}</td>
+<td><code title="{{.FileHash}}">{{short .FileHash}}</code></td>
+<td><code>{{.Peer.IP}}:{{.Peer.Port}}</code> <span class="muted">{{short .Peer.ID}}</span></td>
+</tr>
+{{end}}
+</table>
+{{else}}
+<p class="muted">No announces.</p>
+{{end}}
+</body>
+</html>
+`))
+
+// dashboardFile is a file as shown on the dashboard.
+type dashboardFile struct {
+	Hash      string
+	Name      string
+	Size      int64
+	Seeders   int
+	Leechers  int
+	Completed int
+	Peers     []peerState
+}
+
+type dashboardData struct {
+	Now       time.Time
+	PeerCount int
+	Files     []dashboardFile
+	History   []announceRecord // newest first
+}
+
+// dashboardHandler serves an HTML overview of the swarms visible to the
+// request's token.
+func (t *Tracker) dashboardHandler(w http.ResponseWriter, r *http.Request) {
+	scope, err := t.auth.AuthenticatePage(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dropeer"`)
+		http.Error(w, err.Error()+" (pass ?token=...)", http.StatusUnauthorized)
+		return
+	}
+	visible := func(key swarmKey) bool {
+		return key.Namespace == scope.Namespace && scope.allows(key.FileHash)
+	}
+	data := dashboardData{Now: time.Now()}
+
+	t.mu.RLock()
+	peers := make(map[string]bool)
+	for key, swarm := range t.files {
+		if !visible(key) {
+			continue
+		}
+		info := t.fileInfo[key]
+		file := dashboardFile{Hash: key.FileHash, Name: info.Name, Size: info.Size, Completed: t.complete[key].count}
+		for _, p := range swarm {
+			file.Peers = append(file.Peers, p)
+			peers[p.ID] = true
+			if p.seeder() {
+				file.Seeders++
+			} else {
+				file.Leechers++
+			}
+		}
+		sort.Slice(file.Peers, func(i, j int) bool { return file.Peers[i].LastSeen.After(file.Peers[j].LastSeen) })
+		data.Files = append(data.Files, file)
+	}
+	for i := len(t.history) - 1; i >= 0; i-- {
+		if data.Now.Sub(t.history[i].Time) > historyWindow {
+			break
+		}
+		if !visible(t.history[i].swarmKey) {
+			continue
+		}
+		data.History = append(data.History, t.history[i])
+	}
+	t.mu.RUnlock()
+
+	data.PeerCount = len(peers)
+	sort.Slice(data.Files, func(i, j int) bool {
+		if data.Files[i].Name != data.Files[j].Name {
+			return data.Files[i].Name < data.Files[j].Name
+		}
+		return data.Files[i].Hash < data.Files[j].Hash
+	})
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	if err := dashboardTemplate.Execute(w, data); err != nil {
+		log.Printf("Dashboard: %v", err)
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+const (
+	// strikeLimit is how many failed checks an address may have before it is
+	// blocked. Each further failure doubles the block, up to maxBlock.
+	strikeLimit = 3
+	minBlock    = time.Minute
+	maxBlock    = time.Hour
+	// strikeDecay is how long an address must behave for its strikes to be
+	// forgotten.
+	strikeDecay = 10 * time.Minute
+)
+
+// guard checks where requests come from, rate-limits each address and
+// blocks addresses that keep sending announces that fail verification.
+type guard struct {
+	mu        sync.Mutex
+	offenders map[netip.Addr]*offender
+	buckets   map[netip.Addr]*bucket
+
+	// rate is how many requests per second an address may make on average,
+	// with bursts of up to burst requests. A zero rate disables the limit.
+	rate  float64
+	burst float64
+
+	// trustedProxies may set X-Forwarded-For to the real client address.
+	trustedProxies []netip.Prefix
+	// natNetworks are networks whose peers may announce an address other
+	// than the one they connect from, such as clients behind a NAT.
+	natNetworks []netip.Prefix
+}
+
+type offender struct {
+	strikes      int
+	lastStrike   time.Time
+	blockedUntil time.Time
+}
+
+// bucket is a token bucket refilled at the guard's rate.
+type bucket struct {
+	tokens float64
+	last   time.Time
+}
+
+func newGuard(rate float64, burst int, trustedProxies, natNetworks []netip.Prefix) *guard {
+	return &guard{
+		offenders:      make(map[netip.Addr]*offender),
+		buckets:        make(map[netip.Addr]*bucket),
+		rate:           rate,
+		burst:          float64(max(burst, 1)),
+		trustedProxies: trustedProxies,
+		natNetworks:    natNetworks,
+	}
+}
+
+// parsePrefixes parses a comma-separated list of CIDR prefixes or addresses.
+func parsePrefixes(s string) ([]netip.Prefix, error) {
+	var prefixes []netip.Prefix
+	for _, field := range strings.Split(s, ",") {
+		field = strings.TrimSpace(field)
+		if field == "" {
+			continue
+		}
+		if addr, err := netip.ParseAddr(field); err == nil {
+			prefixes = append(prefixes, netip.PrefixFrom(addr, addr.BitLen()))
+			continue
+		}
+		prefix, err := netip.ParsePrefix(field)
+		if err != nil {
+			return nil, fmt.Errorf("invalid network %q", field)
+		}
+		prefixes = append(prefixes, prefix.Masked())
+	}
+	return prefixes, nil
+}
+
+func contains(prefixes []netip.Prefix, addr netip.Addr) bool {
+	for _, p := range prefixes {
+		if p.Contains(addr) {
+			return true
+		}
+	}
+	return false
+}
+
+// clientAddr returns the address a request comes from. Requests relayed by a
+// trusted proxy are attributed to the last address the proxy forwarded for.
+func (g *guard) clientAddr(r *http.Request) netip.Addr {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	addr, _ := netip.ParseAddr(host)
+	addr = addr.Unmap()
+	if !contains(g.trustedProxies, addr) {
+		return addr
+	}
+	forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+	if fwd, err := netip.ParseAddr(strings.TrimSpace(forwarded[len(forwarded)-1])); err == nil {
+		return fwd.Unmap()
+	}
+	return addr
+}
+
+// checkAddress verifies that the primary address of peer is the one the
+// request comes from, so that a peer cannot direct downloaders at another
+// host. A dual-stack peer may connect over the family it did not pick as
+// primary; if it also announced the address it connects from, that address
+// becomes the primary and the other is kept as an unverified one. Addresses
+// other than the primary cannot be checked, and downloaders only try them
+// after it.
+func (g *guard) checkAddress(r *http.Request, peer *common.PeerInfo) error {
+	if _, err := netip.ParseAddr(peer.IP); err != nil {
+		return fmt.Errorf("invalid peer address %q", peer.IP)
+	}
+	observed := g.clientAddr(r)
+	if contains(g.natNetworks, observed) || sameAddr(peer.IP, observed) {
+		return nil
+	}
+	for i, a := range peer.Addrs {
+		if sameAddr(a, observed) {
+			peer.Addrs[i] = peer.IP
+			peer.IP = a
+			return nil
+		}
+	}
+	return fmt.Errorf("announced address %s does not match connecting address %s", peer.IP, observed)
+}
+
+// sameAddr reports whether the address s, ignoring any zone, is addr.
+func sameAddr(s string, addr netip.Addr) bool {
+	a, err := netip.ParseAddr(s)
+	return err == nil && a.WithZone("").Unmap() == addr
+}
+
+// strike records a failed check by addr and blocks it once it has too many.
+func (g *guard) strike(addr netip.Addr, reason string) {
+	rejectedTotal.WithLabelValues(reason).Inc()
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	o, ok := g.offenders[addr]
+	if !ok || now.Sub(o.lastStrike) > strikeDecay {
+		o = &offender{}
+		g.offenders[addr] = o
+	}
+	o.strikes++
+	o.lastStrike = now
+	if o.strikes >= strikeLimit {
+		block := min(minBlock<<(o.strikes-strikeLimit), maxBlock)
+		o.blockedUntil = now.Add(block)
+		log.Printf("Guard: Blocking %s for %v after %d failed %s checks", addr, block, o.strikes, reason)
+	}
+}
+
+// blocked returns how long addr remains blocked, or 0.
+func (g *guard) blocked(addr netip.Addr) time.Duration {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	if o, ok := g.offenders[addr]; ok {
+		return max(time.Until(o.blockedUntil), 0)
+	}
+	return 0
+}
+
+// allow takes a token from addr's bucket. If the bucket is empty it returns
+// false and how long until a token is available.
+func (g *guard) allow(addr netip.Addr) (bool, time.Duration) {
+	if g.rate <= 0 {
+		return true, 0
+	}
+	g.mu.Lock()
+	defer g.mu.Unlock()
+
+	now := time.Now()
+	b, ok := g.buckets[addr]
+	if !ok {
+		b = &bucket{tokens: g.burst, last: now}
+		g.buckets[addr] = b
+	}
+	b.tokens = min(b.tokens+now.Sub(b.last).Seconds()*g.rate, g.burst)
+	b.last = now
+	if b.tokens < 1 {
+		return false, time.Duration((1 - b.tokens) / g.rate * float64(time.Second))
+	}
+	b.tokens--
+	return true, 0
+}
+
+// prune forgets addresses that are neither blocked nor recently failed, and
+// the buckets of addresses that have been idle long enough to refill.
+func (g *guard) prune() {
+	g.mu.Lock()
+	defer g.mu.Unlock()
+	now := time.Now()
+	for addr, o := range g.offenders {
+		if now.After(o.blockedUntil) && now.Sub(o.lastStrike) > strikeDecay {
+			delete(g.offenders, addr)
+		}
+	}
+	for addr, b := range g.buckets {
+		if now.Sub(b.last).Seconds()*g.rate >= g.burst {
+			delete(g.buckets, addr)
+		}
+	}
+}
+
+// wrap rejects requests from blocked or rate-limited addresses before they
+// reach h.
+func (g *guard) wrap(h http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		addr := g.clientAddr(r)
+		if d := g.blocked(addr); d > 0 {
+			rejectedTotal.WithLabelValues("blocked").Inc()
+			tooManyRequests(w, d, "too many failed requests, try again later")
+			return
+		}
+		if ok, d := g.allow(addr); !ok {
+			rejectedTotal.WithLabelValues("rate").Inc()
+			tooManyRequests(w, d, "rate limit exceeded")
+			return
+		}
+		h(w, r)
+	}
+}
+
+func tooManyRequests(w http.ResponseWriter, retryAfter time.Duration, msg string) {
+	w.Header().Set("Retry-After", strconv.Itoa(int(retryAfter.Seconds())+1))
+	http.Error(w, msg, http.StatusTooManyRequests)
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"net/http/httptest"
+	"net/netip"
+	"slices"
+	"testing"
+
+	"dropeer/internal/common"
+)
+
+func mustPrefixes(t *testing.T, s string) []netip.Prefix {
+	t.Helper()
+	prefixes, err := parsePrefixes(s)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return prefixes
+}
+
+func TestCheckAddress(t *testing.T) {
+	tests := []struct {
+		name      string
+		remote    string
+		forwarded string
+		proxies   string
+		nat       string
+		ip        string
+		addrs     []string
+		wantErr   bool
+		wantIP    string
+		wantAddrs []string
+	}{
+		{
+			name:   "matching IPv4",
+			remote: "192.0.2.1:5000", ip: "192.0.2.1",
+			wantIP: "192.0.2.1",
+		},
+		{
+			name:   "matching IPv6 with zone",
+			remote: "[2001:db8::1]:5000", ip: "2001:db8::1%eth0",
+			wantIP: "2001:db8::1%eth0",
+		},
+		{
+			name:   "IPv4-mapped connection",
+			remote: "[::ffff:192.0.2.1]:5000", ip: "192.0.2.1",
+			wantIP: "192.0.2.1",
+		},
+		{
+			name:   "other host",
+			remote: "192.0.2.1:5000", ip: "198.51.100.7",
+			wantErr: true,
+		},
+		{
+			name:   "invalid address",
+			remote: "192.0.2.1:5000", ip: "not-an-ip",
+			wantErr: true,
+		},
+		{
+			name:   "other family announced as primary",
+			remote: "[2001:db8::1]:5000", ip: "192.0.2.1", addrs: []string{"2001:db8::1"},
+			wantIP: "2001:db8::1", wantAddrs: []string{"192.0.2.1"},
+		},
+		{
+			name:   "connecting address not announced at all",
+			remote: "[2001:db8::1]:5000", ip: "192.0.2.1", addrs: []string{"2001:db8::2"},
+			wantErr: true,
+		},
+		{
+			name:   "only secondary addresses of another host",
+			remote: "192.0.2.1:5000", ip: "198.51.100.7", addrs: []string{"198.51.100.8"},
+			wantErr: true,
+		},
+		{
+			name:   "NAT network",
+			remote: "10.0.0.5:5000", nat: "10.0.0.0/8", ip: "192.168.1.10",
+			wantIP: "192.168.1.10",
+		},
+		{
+			name:   "outside NAT network",
+			remote: "10.1.0.5:5000", nat: "10.0.0.0/16", ip: "192.168.1.10",
+			wantErr: true,
+		},
+		{
+			name:   "trusted proxy",
+			remote: "127.0.0.1:5000", proxies: "127.0.0.1", forwarded: "203.0.113.9, 192.0.2.1",
+			ip:     "192.0.2.1",
+			wantIP: "192.0.2.1",
+		},
+		{
+			name:   "trusted proxy forwarding for another host",
+			remote: "127.0.0.1:5000", proxies: "127.0.0.1", forwarded: "192.0.2.1, 203.0.113.9",
+			ip:      "192.0.2.1",
+			wantErr: true,
+		},
+		{
+			name:   "untrusted proxy",
+			remote: "198.51.100.1:5000", forwarded: "192.0.2.1",
+			ip:      "192.0.2.1",
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			g := newGuard(0, 1, mustPrefixes(t, tt.proxies), mustPrefixes(t, tt.nat))
+			r := httptest.NewRequest("POST", "/announce", nil)
+			r.RemoteAddr = tt.remote
+			if tt.forwarded != "" {
+				r.Header.Set("X-Forwarded-For", tt.forwarded)
+			}
+			peer := &common.PeerInfo{IP: tt.ip, Addrs: slices.Clone(tt.addrs)}
+
+			err := g.checkAddress(r, peer)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("checkAddress() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if peer.IP != tt.wantIP {
+				t.Errorf("IP = %q, want %q", peer.IP, tt.wantIP)
+			}
+			wantAddrs := tt.wantAddrs
+			if wantAddrs == nil {
+				wantAddrs = tt.addrs
+			}
+			if !slices.Equal(peer.Addrs, wantAddrs) {
+				t.Errorf("Addrs = %q, want %q", peer.Addrs, wantAddrs)
+			}
+		})
+	}
+}
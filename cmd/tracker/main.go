@@ -5,100 +5,456 @@ import (
 	"flag"
 	"fmt"
 	"log"
+	"math/rand/v2"
 	"net/http"
+	"os"
+	"strings"
 	"sync"
 	"time"
 
 	"dropeer/internal/common"
 	"dropeer/internal/discovery"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// historyWindow is how long announces are kept for the dashboard.
+const historyWindow = time.Hour
+
+// defaultNumWant and maxNumWant bound how many peers a want returns.
+const (
+	defaultNumWant = 50
+	maxNumWant     = 200
 )
 
+// completeRetention is how long the completed count of a file without
+// peers is kept after its last completed download.
+const completeRetention = 7 * 24 * time.Hour
+
+// completions counts the completed downloads of a file.
+type completions struct {
+	count int
+	last  time.Time // when the last download completed
+}
+
 // Tracker holds the state of the tracker.
 type Tracker struct {
-	mu    sync.RWMutex
-	files map[string]map[string]common.PeerInfo // fileHash -> peerID -> PeerInfo
+	mu       sync.RWMutex
+	auth     *Auth // nil if authentication is disabled
+	guard    *guard
+	files    map[swarmKey]map[string]peerState // swarm -> peerID -> state
+	fileInfo map[swarmKey]fileInfo             // swarm -> name and size, when announced
+	complete map[swarmKey]completions          // swarm -> downloads completed, kept for a while after the swarm empties
+	history  []announceRecord                  // announces in the last historyWindow, oldest first
+
+	// maxPeersPerFile and maxFilesPerPeer limit the size of swarms and how
+	// many swarms one peer can join. Zero means no limit.
+	maxPeersPerFile int
+	maxFilesPerPeer int
+	peerFiles       map[string]int // peerID -> number of swarms it is in
+	// rendezvous, if not nil, supplies the public endpoints of peers.
+	rendezvous *rendezvous
+	// relay, if not nil, forwards requests to peers polling it.
+	relay *relay
+}
+
+// swarmKey identifies a swarm. The same file shared in two namespaces has
+// two independent swarms.
+type swarmKey struct {
+	Namespace string
+	FileHash  string
+}
+
+// peerState is what the tracker knows about a peer in a swarm.
+type peerState struct {
+	common.PeerInfo
+	Uploaded   int64
+	Downloaded int64
+}
+
+// seeder reports whether the peer has the whole file.
+func (p peerState) seeder() bool {
+	return p.Left == 0
+}
+
+// fileInfo is the descriptive information peers announce for a file.
+type fileInfo struct {
+	Name string
+	Size int64
 }
 
-// NewTracker creates a new tracker instance.
-func NewTracker() *Tracker {
+// announceRecord is an entry in the announce history.
+type announceRecord struct {
+	Time time.Time
+	swarmKey
+	Peer  common.PeerInfo
+	Event string
+}
+
+// NewTracker creates a new tracker instance. If auth is nil, every request
+// is accepted into the default namespace.
+func NewTracker(auth *Auth, guard *guard) *Tracker {
 	return &Tracker{
-		files: make(map[string]map[string]common.PeerInfo),
+		auth:      auth,
+		guard:     guard,
+		files:     make(map[swarmKey]map[string]peerState),
+		peerFiles: make(map[string]int),
+		fileInfo:  make(map[swarmKey]fileInfo),
+		complete:  make(map[swarmKey]completions),
+	}
+}
+
+// authorize authenticates a request for fileHash and returns its swarm. It
+// writes an error response and returns false if the request is not allowed.
+func (t *Tracker) authorize(w http.ResponseWriter, r *http.Request, fileHash string) (swarmKey, bool) {
+	scope, err := t.auth.Authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dropeer"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return swarmKey{}, false
 	}
+	if !scope.allows(fileHash) {
+		http.Error(w, "token does not grant access to this file", http.StatusForbidden)
+		return swarmKey{}, false
+	}
+	return swarmKey{Namespace: scope.Namespace, FileHash: fileHash}, true
+}
+
+// removePeer removes a peer from a swarm, dropping the swarm once it is
+// empty. The caller must hold t.mu.
+func (t *Tracker) removePeer(key swarmKey, peerID string) {
+	peers, ok := t.files[key]
+	if !ok {
+		return
+	}
+	if _, ok := peers[peerID]; !ok {
+		return
+	}
+	delete(peers, peerID)
+	if t.peerFiles[peerID]--; t.peerFiles[peerID] <= 0 {
+		delete(t.peerFiles, peerID)
+	}
+	if len(peers) == 0 {
+		delete(t.files, key)
+		delete(t.fileInfo, key)
+	}
+}
+
+// checkLimits returns an error if adding peerID to the swarm at key would
+// exceed the limits on peers per file or files per peer. Peers already in the
+// swarm may always re-announce. The caller must hold t.mu.
+func (t *Tracker) checkLimits(key swarmKey, peerID string) error {
+	peers := t.files[key]
+	if _, ok := peers[peerID]; ok {
+		return nil
+	}
+	if t.maxPeersPerFile > 0 && len(peers) >= t.maxPeersPerFile {
+		return fmt.Errorf("file already has the maximum of %d peers", t.maxPeersPerFile)
+	}
+	if t.maxFilesPerPeer > 0 && t.peerFiles[peerID] >= t.maxFilesPerPeer {
+		return fmt.Errorf("peer already shares the maximum of %d files", t.maxFilesPerPeer)
+	}
+	return nil
+}
+
+// recordAnnounce appends to the announce history and drops entries older
+// than historyWindow. The caller must hold t.mu.
+func (t *Tracker) recordAnnounce(key swarmKey, peer common.PeerInfo, event string) {
+	now := time.Now()
+	t.history = append(t.history, announceRecord{Time: now, swarmKey: key, Peer: peer, Event: event})
+	i := 0
+	for i < len(t.history) && now.Sub(t.history[i].Time) > historyWindow {
+		i++
+	}
+	t.history = t.history[i:]
 }
 
 func (t *Tracker) announceHandler(w http.ResponseWriter, r *http.Request) {
 	var req common.AnnounceRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := validateAnnounce(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	key, ok := t.authorize(w, r, req.FileHash)
+	if !ok {
+		return
+	}
+	if err := common.VerifyAnnounce(&req); err != nil {
+		t.guard.strike(t.guard.clientAddr(r), "signature")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	// A peer that cannot tell its own address is recorded at the one it
+	// connects from.
+	if req.PeerInfo.IP == "" {
+		req.PeerInfo.IP = t.guard.clientAddr(r).String()
+	}
+	if err := t.guard.checkAddress(r, &req.PeerInfo); err != nil {
+		t.guard.strike(t.guard.clientAddr(r), "address")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
 
 	t.mu.Lock()
 	defer t.mu.Unlock()
 
-	if _, ok := t.files[req.FileHash]; !ok {
-		t.files[req.FileHash] = make(map[string]common.PeerInfo)
+	announcesTotal.WithLabelValues(eventLabel(req.Event)).Inc()
+	t.recordAnnounce(key, req.PeerInfo, req.Event)
+	if req.Event == common.AnnounceStopped {
+		t.removePeer(key, req.PeerInfo.ID)
+		log.Printf("Announce: Peer %s stopped sharing file %s", req.PeerInfo.ID, shortHash(req.FileHash))
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+
+	if err := t.checkLimits(key, req.PeerInfo.ID); err != nil {
+		rejectedTotal.WithLabelValues("limit").Inc()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	if _, ok := t.files[key]; !ok {
+		t.files[key] = make(map[string]peerState)
+	}
+	prev, known := t.files[key][req.PeerInfo.ID]
+	if !known {
+		t.peerFiles[req.PeerInfo.ID]++
+	}
+	if req.Event == common.AnnounceCompleted && req.PeerInfo.Left == 0 && !(known && prev.seeder()) {
+		t.complete[key] = completions{count: t.complete[key].count + 1, last: time.Now()}
+		completedTotal.Inc()
 	}
 	req.PeerInfo.LastSeen = time.Now()
-	t.files[req.FileHash][req.PeerInfo.ID] = req.PeerInfo
+	t.files[key][req.PeerInfo.ID] = peerState{
+		PeerInfo:   req.PeerInfo,
+		Uploaded:   req.Uploaded,
+		Downloaded: req.Downloaded,
+	}
+	if req.FileName != "" {
+		t.fileInfo[key] = fileInfo{Name: req.FileName, Size: req.FileSize}
+	}
+
+	if req.PeerInfo.Left == 0 {
+		log.Printf("Announce: Peer %s has file %s", req.PeerInfo.ID, shortHash(req.FileHash))
+	} else {
+		log.Printf("Announce: Peer %s is downloading file %s, %d bytes left", req.PeerInfo.ID, shortHash(req.FileHash), req.PeerInfo.Left)
+	}
+	w.WriteHeader(http.StatusOK)
+}
+
+// eventLabel returns the metrics label of an announce event.
+func eventLabel(event string) string {
+	if event == "" {
+		return "update"
+	}
+	return event
+}
+
+func (t *Tracker) withdrawHandler(w http.ResponseWriter, r *http.Request) {
+	var req common.WithdrawRequest
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := validateWithdraw(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	key, ok := t.authorize(w, r, req.FileHash)
+	if !ok {
+		return
+	}
 
-	log.Printf("Announce: Peer %s has file %s", req.PeerInfo.ID, req.FileHash[:10])
+	t.mu.Lock()
+	defer t.mu.Unlock()
+
+	withdrawsTotal.Inc()
+	peer, ok := t.files[key][req.PeerID]
+	if !ok {
+		w.WriteHeader(http.StatusOK)
+		return
+	}
+	if err := common.VerifyWithdraw(&req, peer.PublicKey); err != nil {
+		t.guard.strike(t.guard.clientAddr(r), "signature")
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+	t.removePeer(key, req.PeerID)
+
+	log.Printf("Withdraw: Peer %s no longer has file %s", req.PeerID, shortHash(req.FileHash))
 	w.WriteHeader(http.StatusOK)
 }
 
 func (t *Tracker) wantHandler(w http.ResponseWriter, r *http.Request) {
 	var req common.WantRequest
-	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+	if !decodeRequest(w, r, &req) {
+		return
+	}
+	if err := validateWant(&req); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	key, ok := t.authorize(w, r, req.FileHash)
+	if !ok {
+		return
+	}
 
+	wantsTotal.Inc()
 	t.mu.RLock()
 	defer t.mu.RUnlock()
 
-	peersMap, ok := t.files[req.FileHash]
+	peersMap, ok := t.files[key]
 	if !ok {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
 
-	var peers []common.PeerInfo
+	numWant := req.NumWant
+	if numWant <= 0 {
+		numWant = defaultNumWant
+	}
+	numWant = min(numWant, maxNumWant)
+
+	resp := common.WantResponse{Completed: t.complete[key].count}
+	var seeders, leechers []common.PeerInfo
 	for _, peer := range peersMap {
-		peers = append(peers, peer)
+		if peer.seeder() {
+			resp.Seeders++
+		} else {
+			resp.Leechers++
+		}
+		if peer.ID == req.PeerID {
+			continue
+		}
+		info := peer.PeerInfo
+		info.Endpoint = t.rendezvous.endpoint(peer.ID)
+		info.Relayed = t.relay.online(peer.ID)
+		if peer.seeder() {
+			seeders = append(seeders, info)
+		} else {
+			leechers = append(leechers, info)
+		}
 	}
+	rand.Shuffle(len(seeders), func(i, j int) { seeders[i], seeders[j] = seeders[j], seeders[i] })
+	rand.Shuffle(len(leechers), func(i, j int) { leechers[i], leechers[j] = leechers[j], leechers[i] })
+	resp.Peers = append(seeders, leechers...)
+	resp.Peers = resp.Peers[:min(len(resp.Peers), numWant)]
 
-	resp := common.WantResponse{Peers: peers}
 	json.NewEncoder(w).Encode(resp)
-	log.Printf("Want: Sent %d peers for file %s", len(peers), req.FileHash[:10])
+	log.Printf("Want: Sent %d of %d peers for file %s", len(resp.Peers), len(peersMap), shortHash(req.FileHash))
 }
 
 func (t *Tracker) cleanupStalePeers() {
 	for {
 		time.Sleep(1 * time.Minute)
 		t.mu.Lock()
-		for fileHash, peers := range t.files {
+		for key, peers := range t.files {
 			for peerID, peerInfo := range peers {
 				if time.Since(peerInfo.LastSeen) > 5*time.Minute {
-					log.Printf("Cleanup: Removing stale peer %s for file %s", peerID, fileHash[:10])
-					delete(peers, peerID)
+					log.Printf("Cleanup: Removing stale peer %s for file %s", peerID, shortHash(key.FileHash))
+					t.removePeer(key, peerID)
+					evictionsTotal.Inc()
 				}
 			}
-			if len(peers) == 0 {
-				delete(t.files, fileHash)
+		}
+		for key, c := range t.complete {
+			if _, active := t.files[key]; !active && time.Since(c.last) > completeRetention {
+				delete(t.complete, key)
 			}
 		}
 		t.mu.Unlock()
+		t.guard.prune()
+		t.rendezvous.prune()
+		t.relay.prune()
 	}
 }
 
 func main() {
 	port := flag.Int("port", 8080, "Port for the tracker to listen on")
+	tokensFile := flag.String("tokens", "", "JSON file of accepted tokens and their scopes")
+	secret := flag.String("token-secret", "", "Secret for verifying signed tokens (default $DROPEER_TOKEN_SECRET)")
+	mint := flag.Bool("mint-token", false, "Print a token signed with the token secret and exit")
+	namespace := flag.String("namespace", "", "Namespace of the minted token")
+	files := flag.String("files", "", "Comma-separated file hashes the minted token is limited to")
+	ttl := flag.Duration("ttl", 0, "Lifetime of the minted token, 0 for no expiry")
+	trustedProxies := flag.String("trusted-proxies", "", "Comma-separated proxy networks whose X-Forwarded-For header is trusted")
+	rate := flag.Float64("rate", 50, "Requests per second allowed from each address, 0 for no limit")
+	burst := flag.Int("burst", 200, "Requests allowed in a burst from each address")
+	maxPeers := flag.Int("max-peers-per-file", 500, "Maximum peers in the swarm of a file, 0 for no limit")
+	maxFiles := flag.Int("max-files-per-peer", 10000, "Maximum files a peer may announce, 0 for no limit")
+	natNetworks := flag.String("nat-networks", "", "Comma-separated networks whose peers may announce an address other than the one they connect from")
+	certFile := flag.String("cert", "", "TLS certificate file (default: created in the user config directory)")
+	keyFile := flag.String("key", "", "TLS key file (default: created in the user config directory)")
+	useHTTP3 := flag.Bool("http3", false, "Also serve HTTP/3 on the UDP port")
+	useRelay := flag.Bool("relay", false, "Relay requests to peers that cannot be reached directly")
+	relayQuota := flag.Int64("relay-quota", 1<<30, "Bytes an address may receive through the relay per hour, 0 for no limit")
+	relayRate := flag.Float64("relay-rate", 0, "Bytes per second the relay sends in total, 0 for no limit")
+	metricsAddr := flag.String("metrics", "127.0.0.1:9101", "Serve Prometheus metrics over plain HTTP on this address, empty to disable")
+	fileMetrics := flag.Int("file-metrics", 0, "Report the peers of this many of the largest swarms per file, which exposes their hashes")
+	rendezvousPort := flag.Int("rendezvous-port", 8081, "UDP port of the rendezvous service for NAT traversal, 0 to disable")
 	flag.Parse()
 
-	tracker := NewTracker()
+	if *secret == "" {
+		*secret = os.Getenv("DROPEER_TOKEN_SECRET")
+	}
+	auth, err := NewAuth(*tokensFile, *secret)
+	if err != nil {
+		log.Fatalf("Failed to load tokens: %v", err)
+	}
+
+	if *mint {
+		scope := Scope{Namespace: *namespace}
+		if *files != "" {
+			scope.Files = strings.Split(*files, ",")
+		}
+		token, err := auth.Mint(scope, *ttl)
+		if err != nil {
+			log.Fatalf("Failed to mint token: %v", err)
+		}
+		fmt.Println(token)
+		return
+	}
+
+	proxies, err := parsePrefixes(*trustedProxies)
+	if err != nil {
+		log.Fatalf("Invalid -trusted-proxies: %v", err)
+	}
+	nat, err := parsePrefixes(*natNetworks)
+	if err != nil {
+		log.Fatalf("Invalid -nat-networks: %v", err)
+	}
+
+	tracker := NewTracker(auth, newGuard(*rate, *burst, proxies, nat))
+	tracker.maxPeersPerFile = *maxPeers
+	tracker.maxFilesPerPeer = *maxFiles
+	if auth != nil {
+		log.Printf("Token authentication enabled")
+	}
+
+	cert, err := loadCertificate(*certFile, *keyFile)
+	if err != nil {
+		log.Fatalf("Failed to load TLS certificate: %v", err)
+	}
+	fingerprint := common.CertFingerprint(cert)
+	log.Printf("TLS certificate fingerprint: %s", fingerprint)
+
+	if *rendezvousPort != 0 {
+		tracker.rendezvous, err = newRendezvous(fmt.Sprintf(":%d", *rendezvousPort), tracker.guard)
+		if err != nil {
+			log.Fatalf("Failed to start rendezvous service: %v", err)
+		}
+		go func() {
+			if err := tracker.rendezvous.serve(); err != nil {
+				log.Fatalf("Rendezvous service failed: %v", err)
+			}
+		}()
+		log.Printf("Rendezvous service listening on UDP port %d", *rendezvousPort)
+	}
 
 	// Start mDNS service publisher
-	server, err := discovery.PublishService(*port)
+	server, err := discovery.PublishService(*port, fingerprint, *useHTTP3, *rendezvousPort, *useRelay)
 	if err != nil {
 		log.Fatalf("Failed to publish mDNS service: %v", err)
 	}
@@ -106,16 +462,40 @@ func main() {
 	log.Printf("Published mDNS service '%s' on port %d", common.ServiceName, *port)
 
 	go tracker.cleanupStalePeers()
+	prometheus.MustRegister(newSwarmCollector(tracker, *fileMetrics))
 
-	http.HandleFunc("/announce", tracker.announceHandler)
-	http.HandleFunc("/want", tracker.wantHandler)
+	http.HandleFunc("/announce", tracker.guard.wrap(tracker.announceHandler))
+	http.HandleFunc("/want", tracker.guard.wrap(tracker.wantHandler))
+	http.HandleFunc("/withdraw", tracker.guard.wrap(tracker.withdrawHandler))
+	if *useRelay {
+		tracker.relay = newRelay(*relayQuota, *relayRate)
+		http.HandleFunc("POST /relay/poll", tracker.guard.wrap(tracker.relayPollHandler))
+		http.HandleFunc("POST /relay/respond/{id}", tracker.guard.wrap(tracker.relayRespondHandler))
+		http.HandleFunc("GET /relay/peer/{id}/{path...}", tracker.guard.wrap(tracker.relayPeerHandler))
+		log.Printf("Relay enabled")
+	}
+	if *metricsAddr != "" {
+		// Metrics are kept off the public listener, which has no admin
+		// authentication.
+		go func() {
+			mux := http.NewServeMux()
+			mux.Handle("/metrics", promhttp.Handler())
+			log.Printf("Metrics listening on %s", *metricsAddr)
+			if err := http.ListenAndServe(*metricsAddr, mux); err != nil {
+				log.Fatalf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+	http.HandleFunc("/{$}", tracker.guard.wrap(tracker.dashboardHandler))
 	// Heartbeat is handled by re-announcing, simplifying the logic.
 
 	addr := fmt.Sprintf(":%d", *port)
-	log.Printf("Tracker listening on %s", addr)
-
-	// Use a standard HTTP server for the tracker API. Simpler than QUIC for this part.
-	if err := http.ListenAndServe(addr, nil); err != nil {
+	if *useHTTP3 {
+		log.Printf("Tracker listening on %s (HTTPS and HTTP/3)", addr)
+	} else {
+		log.Printf("Tracker listening on %s (HTTPS)", addr)
+	}
+	if err := serveTLS(addr, cert, *useHTTP3, http.DefaultServeMux); err != nil {
 		log.Fatalf("Failed to start server: %v", err)
 	}
 }
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// addSwarm fills the swarm of testHash with seeders and leechers, whose IDs
+// start with "s" and "l".
+func addSwarm(tr *Tracker, seeders, leechers int) {
+	key := swarmKey{FileHash: testHash}
+	tr.files[key] = make(map[string]peerState)
+	add := func(id string, left int64) {
+		tr.files[key][id] = peerState{PeerInfo: common.PeerInfo{ID: id, IP: "192.0.2.1", Port: 4040, Left: left, LastSeen: time.Now()}}
+	}
+	for i := range seeders {
+		add(fmt.Sprintf("s%d", i), 0)
+	}
+	for i := range leechers {
+		add(fmt.Sprintf("l%d", i), 100)
+	}
+}
+
+func TestWantHandler(t *testing.T) {
+	tests := []struct {
+		name        string
+		seeders     int
+		leechers    int
+		numWant     int
+		peerID      string
+		wantPeers   int
+		wantSeeders int // at the front of the response
+	}{
+		{name: "whole small swarm", seeders: 2, leechers: 3, wantPeers: 5, wantSeeders: 2},
+		{name: "default numwant", seeders: 10, leechers: defaultNumWant, wantPeers: defaultNumWant, wantSeeders: 10},
+		{name: "numwant", seeders: 5, leechers: 5, numWant: 3, wantPeers: 3, wantSeeders: 3},
+		{name: "numwant above the maximum", seeders: 10, leechers: maxNumWant, numWant: maxNumWant + 50, wantPeers: maxNumWant, wantSeeders: 10},
+		{name: "seeders first", seeders: 3, leechers: 10, numWant: 7, wantPeers: 7, wantSeeders: 3},
+		{name: "requester left out", seeders: 3, leechers: 2, peerID: "s1", wantPeers: 4, wantSeeders: 2},
+		{name: "requester left out before numwant", seeders: 3, leechers: 2, numWant: 4, peerID: "l0", wantPeers: 4, wantSeeders: 3},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker(nil, newGuard(0, 1, nil, nil))
+			addSwarm(tr, tt.seeders, tt.leechers)
+			tr.complete[swarmKey{FileHash: testHash}] = completions{count: 7, last: time.Now()}
+
+			w := post(tr, "/want", jsonBody(t, common.WantRequest{FileHash: testHash, NumWant: tt.numWant, PeerID: tt.peerID}))
+			if w.Code != http.StatusOK {
+				t.Fatalf("status %d (%s)", w.Code, strings.TrimSpace(w.Body.String()))
+			}
+			var resp common.WantResponse
+			if err := json.NewDecoder(w.Body).Decode(&resp); err != nil {
+				t.Fatal(err)
+			}
+
+			if resp.Seeders != tt.seeders || resp.Leechers != tt.leechers || resp.Completed != 7 {
+				t.Errorf("stats %d seeders, %d leechers, %d completed, want %d, %d, 7", resp.Seeders, resp.Leechers, resp.Completed, tt.seeders, tt.leechers)
+			}
+			if len(resp.Peers) != tt.wantPeers {
+				t.Fatalf("got %d peers, want %d", len(resp.Peers), tt.wantPeers)
+			}
+			seen := make(map[string]bool)
+			for i, p := range resp.Peers {
+				if p.ID == tt.peerID {
+					t.Errorf("requester %s returned", p.ID)
+				}
+				if seen[p.ID] {
+					t.Errorf("%s returned twice", p.ID)
+				}
+				seen[p.ID] = true
+				if seeder := strings.HasPrefix(p.ID, "s"); seeder != (i < tt.wantSeeders) {
+					t.Errorf("peer %d is %s, want seeders first", i, p.ID)
+				}
+			}
+		})
+	}
+}
+
+func TestWantUnknownFile(t *testing.T) {
+	tr := NewTracker(nil, newGuard(0, 1, nil, nil))
+	addSwarm(tr, 1, 0)
+	if w := post(tr, "/want", jsonBody(t, common.WantRequest{FileHash: otherHash})); w.Code != http.StatusNotFound {
+		t.Errorf("status %d, want %d", w.Code, http.StatusNotFound)
+	}
+}
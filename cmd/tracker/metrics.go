@@ -0,0 +1,137 @@
+package main
+
+import (
+	"cmp"
+	"slices"
+	"strings"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+)
+
+var (
+	announcesTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dropeer_tracker_announces_total",
+		Help: "Announce requests handled, by event. Heartbeats are counted as updates.",
+	}, []string{"event"})
+	completedTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dropeer_tracker_completed_downloads_total",
+		Help: "Downloads peers reported as completed.",
+	})
+	wantsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dropeer_tracker_wants_total",
+		Help: "Want requests handled.",
+	})
+	withdrawsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dropeer_tracker_withdraws_total",
+		Help: "Withdraw requests handled.",
+	})
+	evictionsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dropeer_tracker_stale_peer_evictions_total",
+		Help: "Peers removed from a swarm for missing heartbeats.",
+	})
+	rendezvousTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dropeer_tracker_rendezvous_messages_total",
+		Help: "Verified rendezvous messages handled, by type: register or connect.",
+	}, []string{"type"})
+	relayRequestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dropeer_tracker_relay_requests_total",
+		Help: "Requests relayed to peers, by outcome: ok, offline, timeout or quota.",
+	}, []string{"outcome"})
+	relayBytesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dropeer_tracker_relay_bytes_total",
+		Help: "Response bytes sent through the relay.",
+	})
+	rejectedTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dropeer_tracker_rejected_requests_total",
+		Help: "Requests rejected, by reason: signature, address, blocked, rate or limit.",
+	}, []string{"reason"})
+)
+
+// swarmCollector reports the tracker's swarms at scrape time. Swarms are
+// summed per namespace rather than reported per file, which would expose the
+// hashes being shared and give the metrics unbounded cardinality. Only the
+// peers of the topFiles largest swarms are reported per file, if any.
+type swarmCollector struct {
+	tracker   *Tracker
+	topFiles  int
+	swarms    *prometheus.Desc
+	peers     *prometheus.Desc
+	seeders   *prometheus.Desc
+	completed *prometheus.Desc
+	filePeers *prometheus.Desc
+}
+
+func newSwarmCollector(t *Tracker, topFiles int) *swarmCollector {
+	return &swarmCollector{
+		tracker:   t,
+		topFiles:  topFiles,
+		swarms:    prometheus.NewDesc("dropeer_tracker_swarms", "Files with at least one peer, by namespace.", []string{"namespace"}, nil),
+		peers:     prometheus.NewDesc("dropeer_tracker_peers", "Distinct peers across the swarms of each namespace.", []string{"namespace"}, nil),
+		seeders:   prometheus.NewDesc("dropeer_tracker_seeders", "Peers with a whole file, summed over the swarms of each namespace.", []string{"namespace"}, nil),
+		completed: prometheus.NewDesc("dropeer_tracker_completed", "Completed downloads of files with an active swarm, by namespace.", []string{"namespace"}, nil),
+		filePeers: prometheus.NewDesc("dropeer_tracker_file_peers", "Peers in the swarm of each of the largest swarms.", []string{"namespace", "file"}, nil),
+	}
+}
+
+func (c *swarmCollector) Describe(ch chan<- *prometheus.Desc) {
+	ch <- c.swarms
+	ch <- c.peers
+	ch <- c.seeders
+	ch <- c.completed
+	if c.topFiles > 0 {
+		ch <- c.filePeers
+	}
+}
+
+type swarmSize struct {
+	key   swarmKey
+	peers int
+}
+
+type namespaceStats struct {
+	swarms, seeders, completed int
+	peers                      map[string]bool
+}
+
+func (c *swarmCollector) Collect(ch chan<- prometheus.Metric) {
+	c.tracker.mu.RLock()
+	stats := make(map[string]*namespaceStats)
+	var sizes []swarmSize
+	for key, swarm := range c.tracker.files {
+		if c.topFiles > 0 {
+			sizes = append(sizes, swarmSize{key, len(swarm)})
+		}
+		st, ok := stats[key.Namespace]
+		if !ok {
+			st = &namespaceStats{peers: make(map[string]bool)}
+			stats[key.Namespace] = st
+		}
+		st.swarms++
+		st.completed += c.tracker.complete[key].count
+		for peerID, peer := range swarm {
+			st.peers[peerID] = true
+			if peer.seeder() {
+				st.seeders++
+			}
+		}
+	}
+	c.tracker.mu.RUnlock()
+
+	for ns, st := range stats {
+		ch <- prometheus.MustNewConstMetric(c.swarms, prometheus.GaugeValue, float64(st.swarms), ns)
+		ch <- prometheus.MustNewConstMetric(c.peers, prometheus.GaugeValue, float64(len(st.peers)), ns)
+		ch <- prometheus.MustNewConstMetric(c.seeders, prometheus.GaugeValue, float64(st.seeders), ns)
+		ch <- prometheus.MustNewConstMetric(c.completed, prometheus.GaugeValue, float64(st.completed), ns)
+	}
+
+	slices.SortFunc(sizes, func(a, b swarmSize) int {
+		if a.peers != b.peers {
+			return b.peers - a.peers
+		}
+		return cmp.Or(strings.Compare(a.key.Namespace, b.key.Namespace), strings.Compare(a.key.FileHash, b.key.FileHash))
+	})
+	for _, size := range sizes[:min(len(sizes), c.topFiles)] {
+		ch <- prometheus.MustNewConstMetric(c.filePeers, prometheus.GaugeValue, float64(size.peers), size.key.Namespace, size.key.FileHash)
+	}
+}
@@ -0,0 +1,97 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/prometheus/client_golang/prometheus"
+)
+
+func TestSwarmCollectorAggregatesNamespaces(t *testing.T) {
+	tr := NewTracker(nil, newGuard(0, 1, nil, nil))
+	seeder := peerState{}
+	seeder.Left = 0
+	leecher := peerState{}
+	leecher.Left = 10
+	tr.files[swarmKey{Namespace: "alpha", FileHash: "f1"}] = map[string]peerState{"p1": seeder, "p2": leecher}
+	tr.files[swarmKey{Namespace: "alpha", FileHash: "f2"}] = map[string]peerState{"p1": seeder}
+	tr.files[swarmKey{Namespace: "beta", FileHash: "f1"}] = map[string]peerState{"p3": leecher}
+	tr.complete[swarmKey{Namespace: "alpha", FileHash: "f1"}] = completions{count: 4}
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newSwarmCollector(tr, 0))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		for _, m := range f.GetMetric() {
+			if len(m.GetLabel()) != 1 || m.GetLabel()[0].GetName() != "namespace" {
+				t.Errorf("%s has labels %v, want only namespace", f.GetName(), m.GetLabel())
+				continue
+			}
+			got[f.GetName()+"/"+m.GetLabel()[0].GetValue()] = m.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{
+		"dropeer_tracker_swarms/alpha":    2,
+		"dropeer_tracker_peers/alpha":     2,
+		"dropeer_tracker_seeders/alpha":   2,
+		"dropeer_tracker_completed/alpha": 4,
+		"dropeer_tracker_swarms/beta":     1,
+		"dropeer_tracker_peers/beta":      1,
+		"dropeer_tracker_seeders/beta":    0,
+		"dropeer_tracker_completed/beta":  0,
+	}
+	if len(got) != len(want) {
+		t.Errorf("got %d series, want %d: %v", len(got), len(want), got)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
+
+func TestSwarmCollectorTopFiles(t *testing.T) {
+	tr := NewTracker(nil, newGuard(0, 1, nil, nil))
+	swarm := func(n int) map[string]peerState {
+		peers := make(map[string]peerState)
+		for i := range n {
+			peers[string(rune('a'+i))] = peerState{}
+		}
+		return peers
+	}
+	tr.files[swarmKey{Namespace: "alpha", FileHash: "f1"}] = swarm(3)
+	tr.files[swarmKey{Namespace: "alpha", FileHash: "f2"}] = swarm(1)
+	tr.files[swarmKey{Namespace: "beta", FileHash: "f3"}] = swarm(2)
+
+	reg := prometheus.NewPedanticRegistry()
+	reg.MustRegister(newSwarmCollector(tr, 2))
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make(map[string]float64)
+	for _, f := range families {
+		if f.GetName() != "dropeer_tracker_file_peers" {
+			continue
+		}
+		for _, m := range f.GetMetric() {
+			labels := make(map[string]string)
+			for _, l := range m.GetLabel() {
+				labels[l.GetName()] = l.GetValue()
+			}
+			got[labels["namespace"]+"/"+labels["file"]] = m.GetGauge().GetValue()
+		}
+	}
+	want := map[string]float64{"alpha/f1": 3, "beta/f3": 2}
+	if len(got) != len(want) {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	for k, v := range want {
+		if got[k] != v {
+			t.Errorf("%s = %v, want %v", k, got[k], v)
+		}
+	}
+}
@@ -0,0 +1,389 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/netip"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+const (
+	// relayPollTimeout is how long a poll waits for a request before the
+	// peer is told to poll again.
+	relayPollTimeout = 25 * time.Second
+	// relayResponseTimeout bounds the wait for a peer to answer a relayed
+	// request.
+	relayResponseTimeout = 30 * time.Second
+	// relayOnline is how long after its last poll a peer counts as
+	// reachable through the relay.
+	relayOnline = time.Minute
+	// relayMaxBody bounds a relayed response; chunks are well below it.
+	relayMaxBody = 8 << 20
+	// relayQuotaWindow is the period relay quotas apply to.
+	relayQuotaWindow = time.Hour
+	// relayRepollGrace is how soon a peer that picked up a request must
+	// poll again. Peers poll again at once, so one that does not has
+	// most likely gone away with the request.
+	relayRepollGrace = 5 * time.Second
+)
+
+// relay forwards requests to peers that cannot be reached directly. Such
+// peers keep a poll open to the relay, which hands them the requests for
+// them; they post their responses back, and the relay passes them on.
+type relay struct {
+	// quota is how many bytes an address may receive through the relay
+	// per relayQuotaWindow. Zero means no limit.
+	quota   int64
+	limiter *byteLimiter
+
+	mu      sync.Mutex
+	peers   map[string]*relayPeer
+	pending map[string]chan relayResponse // request ID -> waiting requester
+	usage   map[netip.Addr]*relayUsage
+}
+
+type relayPeer struct {
+	namespace string
+	requests  chan common.RelayRequest
+	lastPoll  time.Time
+}
+
+type relayResponse struct {
+	status      int
+	contentType string
+	body        []byte
+}
+
+type relayUsage struct {
+	bytes int64
+	since time.Time
+}
+
+func newRelay(quota int64, rate float64) *relay {
+	return &relay{
+		quota:   quota,
+		limiter: newByteLimiter(rate),
+		peers:   make(map[string]*relayPeer),
+		pending: make(map[string]chan relayResponse),
+		usage:   make(map[netip.Addr]*relayUsage),
+	}
+}
+
+// online reports whether peerID is polling the relay. r may be nil.
+func (r *relay) online(peerID string) bool {
+	if r == nil {
+		return false
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[peerID]
+	return ok && time.Since(p.lastPoll) < relayOnline
+}
+
+// charge counts n bytes sent to addr against its quota. It returns false,
+// counting nothing, if that would exceed the quota. A negative n gives
+// back bytes charged before.
+func (r *relay) charge(addr netip.Addr, n int64) bool {
+	if r.quota <= 0 {
+		return true
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	u, ok := r.usage[addr]
+	if !ok || time.Since(u.since) > relayQuotaWindow {
+		u = &relayUsage{since: time.Now()}
+		r.usage[addr] = u
+	}
+	if n > 0 && u.bytes+n > r.quota {
+		return false
+	}
+	u.bytes = max(u.bytes+n, 0)
+	return true
+}
+
+// reservation is how much of addr's quota is held for a relayed response
+// before it is forwarded, so that requests over quota never reach peers.
+func (r *relay) reservation() int64 {
+	if r.quota <= 0 {
+		return 0
+	}
+	return min(relayMaxBody, r.quota)
+}
+
+// fail answers the requester waiting for the request id with an error, if
+// it is still waiting.
+func (r *relay) fail(id string) {
+	r.mu.Lock()
+	waiting, ok := r.pending[id]
+	delete(r.pending, id)
+	r.mu.Unlock()
+	if ok {
+		waiting <- relayResponse{status: http.StatusBadGateway}
+	}
+}
+
+// polledSince reports whether peerID has polled the relay since t.
+func (r *relay) polledSince(peerID string, t time.Time) bool {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	p, ok := r.peers[peerID]
+	return ok && p.lastPoll.After(t)
+}
+
+// prune forgets peers that stopped polling and expired quota windows.
+func (r *relay) prune() {
+	if r == nil {
+		return
+	}
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	for id, p := range r.peers {
+		if time.Since(p.lastPoll) > relayOnline {
+			delete(r.peers, id)
+		}
+	}
+	for addr, u := range r.usage {
+		if time.Since(u.since) > relayQuotaWindow {
+			delete(r.usage, addr)
+		}
+	}
+}
+
+// relayPollHandler hands a polling peer the next request relayed to it, or
+// answers 204 No Content if none arrives in time.
+func (t *Tracker) relayPollHandler(w http.ResponseWriter, r *http.Request) {
+	var poll common.RelayPoll
+	if !decodeRequest(w, r, &poll) {
+		return
+	}
+	scope, err := t.auth.Authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dropeer"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if err := common.VerifyRelayPoll(&poll); err != nil {
+		t.guard.strike(t.guard.clientAddr(r), "signature")
+		rejectedTotal.WithLabelValues("signature").Inc()
+		http.Error(w, err.Error(), http.StatusForbidden)
+		return
+	}
+
+	t.relay.mu.Lock()
+	p, ok := t.relay.peers[poll.PeerID]
+	if !ok || p.namespace != scope.Namespace {
+		p = &relayPeer{namespace: scope.Namespace, requests: make(chan common.RelayRequest)}
+		t.relay.peers[poll.PeerID] = p
+		log.Printf("Relay: Peer %s connected", poll.PeerID)
+	}
+	p.lastPoll = time.Now()
+	t.relay.mu.Unlock()
+
+	timer := time.NewTimer(relayPollTimeout)
+	defer timer.Stop()
+	select {
+	case req := <-p.requests:
+		if err := json.NewEncoder(w).Encode(req); err != nil {
+			t.relay.fail(req.ID)
+		}
+	case <-timer.C:
+		w.WriteHeader(http.StatusNoContent)
+	case <-r.Context().Done():
+	}
+}
+
+// relayRespondHandler receives a peer's response to a relayed request. The
+// request ID, handed out only to the peer, authorizes it.
+func (t *Tracker) relayRespondHandler(w http.ResponseWriter, r *http.Request) {
+	id := r.PathValue("id")
+	t.relay.mu.Lock()
+	waiting, ok := t.relay.pending[id]
+	delete(t.relay.pending, id)
+	t.relay.mu.Unlock()
+	if !ok {
+		http.Error(w, "unknown or expired request", http.StatusNotFound)
+		return
+	}
+
+	status, err := strconv.Atoi(r.Header.Get(common.RelayStatusHeader))
+	if err != nil || status < 100 || status > 599 {
+		status = http.StatusBadGateway
+	}
+	body, err := io.ReadAll(http.MaxBytesReader(w, r.Body, relayMaxBody))
+	if err != nil {
+		http.Error(w, "response too large", http.StatusRequestEntityTooLarge)
+		waiting <- relayResponse{status: http.StatusBadGateway}
+		return
+	}
+	waiting <- relayResponse{status: status, contentType: r.Header.Get("Content-Type"), body: body}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// relayPeerHandler forwards a GET request to a peer polling the relay and
+// sends back its response, within the requester's quota.
+func (t *Tracker) relayPeerHandler(w http.ResponseWriter, r *http.Request) {
+	peerID, path := r.PathValue("id"), "/"+r.PathValue("path")
+	scope, err := t.auth.Authenticate(r)
+	if err != nil {
+		w.Header().Set("WWW-Authenticate", `Bearer realm="dropeer"`)
+		http.Error(w, err.Error(), http.StatusUnauthorized)
+		return
+	}
+	if hash := relayedFileHash(path); hash != "" && !scope.allows(hash) {
+		http.Error(w, "token does not grant access to this file", http.StatusForbidden)
+		return
+	}
+
+	t.relay.mu.Lock()
+	p, ok := t.relay.peers[peerID]
+	online := ok && p.namespace == scope.Namespace && time.Since(p.lastPoll) < relayOnline
+	t.relay.mu.Unlock()
+	if !online {
+		relayRequestsTotal.WithLabelValues("offline").Inc()
+		http.Error(w, "peer is not connected to the relay", http.StatusNotFound)
+		return
+	}
+
+	addr := t.guard.clientAddr(r)
+	reserved := t.relay.reservation()
+	if !t.relay.charge(addr, reserved) {
+		relayRequestsTotal.WithLabelValues("quota").Inc()
+		tooManyRequests(w, relayQuotaWindow, "relay quota exceeded")
+		return
+	}
+	// Whatever is still charged when the request ends is given back.
+	charged := reserved
+	defer func() { t.relay.charge(addr, -charged) }()
+
+	id := newRequestID()
+	waiting := make(chan relayResponse, 1)
+	t.relay.mu.Lock()
+	t.relay.pending[id] = waiting
+	t.relay.mu.Unlock()
+	defer func() {
+		t.relay.mu.Lock()
+		delete(t.relay.pending, id)
+		t.relay.mu.Unlock()
+	}()
+
+	timer := time.NewTimer(relayResponseTimeout)
+	defer timer.Stop()
+	select {
+	case p.requests <- common.RelayRequest{ID: id, Path: path}:
+	case <-timer.C:
+		relayRequestsTotal.WithLabelValues("timeout").Inc()
+		http.Error(w, "peer did not pick up the request", http.StatusGatewayTimeout)
+		return
+	case <-r.Context().Done():
+		return
+	}
+
+	pickedUp := time.Now()
+	repoll := time.NewTicker(relayRepollGrace)
+	defer repoll.Stop()
+	var resp relayResponse
+wait:
+	for {
+		select {
+		case resp = <-waiting:
+			break wait
+		case <-repoll.C:
+			if !t.relay.polledSince(peerID, pickedUp) {
+				relayRequestsTotal.WithLabelValues("offline").Inc()
+				http.Error(w, "peer went away before answering", http.StatusBadGateway)
+				return
+			}
+		case <-timer.C:
+			relayRequestsTotal.WithLabelValues("timeout").Inc()
+			http.Error(w, "peer did not answer in time", http.StatusGatewayTimeout)
+			return
+		case <-r.Context().Done():
+			return
+		}
+	}
+
+	// Responses are at most relayMaxBody, so one larger than the
+	// reservation is larger than the whole quota.
+	used := int64(len(resp.body))
+	if t.relay.quota > 0 && used > reserved {
+		relayRequestsTotal.WithLabelValues("quota").Inc()
+		tooManyRequests(w, relayQuotaWindow, "relay quota exceeded")
+		return
+	}
+	charged = reserved - used
+	relayRequestsTotal.WithLabelValues("ok").Inc()
+	if resp.contentType != "" {
+		w.Header().Set("Content-Type", resp.contentType)
+	}
+	w.Header().Set("Content-Length", strconv.Itoa(len(resp.body)))
+	w.WriteHeader(resp.status)
+	for body := resp.body; len(body) > 0; {
+		n := min(len(body), 64<<10)
+		t.relay.limiter.wait(n)
+		if _, err := w.Write(body[:n]); err != nil {
+			return
+		}
+		relayBytesTotal.Add(float64(n))
+		body = body[n:]
+	}
+}
+
+// relayedFileHash returns the file hash in a peer API path, if any.
+func relayedFileHash(path string) string {
+	for _, prefix := range []string{"/metadata/", "/chunk/", "/range/"} {
+		if rest, ok := strings.CutPrefix(path, prefix); ok {
+			hash, _, _ := strings.Cut(rest, "/")
+			return hash
+		}
+	}
+	return ""
+}
+
+func newRequestID() string {
+	b := make([]byte, 16)
+	rand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// byteLimiter limits the rate of bytes sent through the relay as a whole.
+type byteLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // bytes per second
+	tokens float64
+	last   time.Time
+}
+
+// newByteLimiter returns a limiter for rate bytes per second, or nil, which
+// does not limit, if rate is not positive.
+func newByteLimiter(rate float64) *byteLimiter {
+	if rate <= 0 {
+		return nil
+	}
+	return &byteLimiter{rate: rate, tokens: rate, last: time.Now()}
+}
+
+// wait blocks until n more bytes may be sent. l may be nil.
+func (l *byteLimiter) wait(n int) {
+	if l == nil {
+		return
+	}
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens = min(l.tokens+now.Sub(l.last).Seconds()*l.rate, l.rate)
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
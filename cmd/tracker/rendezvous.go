@@ -0,0 +1,137 @@
+package main
+
+import (
+	"log"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// endpointTTL is how long a registered endpoint is handed out after the
+// peer's last register message. Peers re-register well within it, which
+// also keeps their NAT mapping open.
+const endpointTTL = time.Minute
+
+// rendezvous is a UDP service that records the public endpoint of each
+// peer's QUIC socket and coordinates hole punching between peers. Peers
+// register from the socket they serve and download on, so the endpoint is
+// the one their NAT maps that socket to.
+type rendezvous struct {
+	conn  *net.UDPConn
+	guard *guard
+
+	mu        sync.Mutex
+	endpoints map[string]endpoint // peer ID -> endpoint
+}
+
+type endpoint struct {
+	addr netip.AddrPort
+	seen time.Time
+}
+
+func newRendezvous(addr string, guard *guard) (*rendezvous, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := net.ListenUDP("udp", udpAddr)
+	if err != nil {
+		return nil, err
+	}
+	return &rendezvous{conn: conn, guard: guard, endpoints: make(map[string]endpoint)}, nil
+}
+
+// serve handles rendezvous messages until the connection fails.
+func (rv *rendezvous) serve() error {
+	buf := make([]byte, 2048)
+	for {
+		n, src, err := rv.conn.ReadFromUDPAddrPort(buf)
+		if err != nil {
+			return err
+		}
+		src = netip.AddrPortFrom(src.Addr().Unmap(), src.Port())
+		if rv.guard.blocked(src.Addr()) > 0 {
+			rejectedTotal.WithLabelValues("blocked").Inc()
+			continue
+		}
+		if ok, _ := rv.guard.allow(src.Addr()); !ok {
+			rejectedTotal.WithLabelValues("rate").Inc()
+			continue
+		}
+		msg, err := common.ParseRendezvous(buf[:n])
+		if err != nil {
+			continue
+		}
+		rv.handle(msg, src)
+	}
+}
+
+func (rv *rendezvous) handle(msg *common.RendezvousMessage, src netip.AddrPort) {
+	if msg.Type != common.RendezvousRegister && msg.Type != common.RendezvousConnect {
+		return
+	}
+	if err := common.VerifyRendezvous(msg); err != nil {
+		rv.guard.strike(src.Addr(), "signature")
+		rejectedTotal.WithLabelValues("signature").Inc()
+		rv.send(&common.RendezvousMessage{Type: common.RendezvousError, Error: err.Error()}, src)
+		return
+	}
+
+	rv.mu.Lock()
+	rv.endpoints[msg.PeerID] = endpoint{addr: src, seen: time.Now()}
+	target, ok := rv.endpoints[msg.Target]
+	rv.mu.Unlock()
+	rendezvousTotal.WithLabelValues(msg.Type).Inc()
+
+	if msg.Type == common.RendezvousRegister {
+		rv.send(&common.RendezvousMessage{Type: common.RendezvousRegistered, Endpoint: src.String()}, src)
+		return
+	}
+	if !ok || time.Since(target.seen) > endpointTTL {
+		rv.send(&common.RendezvousMessage{Type: common.RendezvousError, Target: msg.Target, Error: "target peer is not registered"}, src)
+		return
+	}
+	// Tell both sides about each other at once, so they start sending
+	// at about the same time and each opens its NAT for the other.
+	rv.send(&common.RendezvousMessage{Type: common.RendezvousPunch, PeerID: msg.PeerID, Endpoint: src.String()}, target.addr)
+	rv.send(&common.RendezvousMessage{Type: common.RendezvousPunch, PeerID: msg.Target, Endpoint: target.addr.String()}, src)
+	log.Printf("Rendezvous: Punching between %s (%s) and %s (%s)", msg.PeerID, src, msg.Target, target.addr)
+}
+
+func (rv *rendezvous) send(msg *common.RendezvousMessage, to netip.AddrPort) {
+	if _, err := rv.conn.WriteToUDPAddrPort(msg.Marshal(), to); err != nil {
+		log.Printf("Rendezvous: Could not send %s to %s: %v", msg.Type, to, err)
+	}
+}
+
+// endpoint returns the public endpoint peerID last registered from, or ""
+// if it has not registered recently. rv may be nil.
+func (rv *rendezvous) endpoint(peerID string) string {
+	if rv == nil {
+		return ""
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	e, ok := rv.endpoints[peerID]
+	if !ok || time.Since(e.seen) > endpointTTL {
+		return ""
+	}
+	return e.addr.String()
+}
+
+// prune forgets endpoints that have not been registered recently.
+func (rv *rendezvous) prune() {
+	if rv == nil {
+		return
+	}
+	rv.mu.Lock()
+	defer rv.mu.Unlock()
+	for id, e := range rv.endpoints {
+		if time.Since(e.seen) > endpointTTL {
+			delete(rv.endpoints, id)
+		}
+	}
+}
@@ -0,0 +1,50 @@
+package main
+
+import (
+	"crypto/tls"
+	"net/http"
+	"os"
+	"path/filepath"
+
+	"dropeer/internal/common"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// loadCertificate loads the tracker's TLS certificate, creating it in the
+// user's config directory if no paths are given and none exists yet.
+func loadCertificate(certPath, keyPath string) (tls.Certificate, error) {
+	if certPath == "" || keyPath == "" {
+		dir, err := os.UserConfigDir()
+		if err != nil {
+			return tls.Certificate{}, err
+		}
+		if certPath == "" {
+			certPath = filepath.Join(dir, "dropeer", "tracker.crt")
+		}
+		if keyPath == "" {
+			keyPath = filepath.Join(dir, "dropeer", "tracker.key")
+		}
+	}
+	return common.LoadOrCreateCertificate(certPath, keyPath)
+}
+
+// serveTLS serves handler over HTTPS on addr and, if useHTTP3 is set, over
+// HTTP/3 on the same UDP port. HTTPS responses then advertise HTTP/3 with an
+// Alt-Svc header.
+func serveTLS(addr string, cert tls.Certificate, useHTTP3 bool, handler http.Handler) error {
+	tlsConfig := &tls.Config{Certificates: []tls.Certificate{cert}}
+	server := &http.Server{Addr: addr, Handler: handler, TLSConfig: tlsConfig}
+
+	errs := make(chan error, 2)
+	if useHTTP3 {
+		h3 := &http3.Server{Addr: addr, Handler: handler, TLSConfig: http3.ConfigureTLSConfig(tlsConfig)}
+		server.Handler = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			h3.SetQUICHeaders(w.Header())
+			handler.ServeHTTP(w, r)
+		})
+		go func() { errs <- h3.ListenAndServe() }()
+	}
+	go func() { errs <- server.ListenAndServeTLS("", "") }()
+	return <-errs
+}
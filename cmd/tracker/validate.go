@@ -0,0 +1,100 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/netip"
+
+	"dropeer/internal/common"
+)
+
+const (
+	// maxBodySize bounds the size of a request body.
+	maxBodySize = 16 << 10
+	// maxFileNameLen bounds the file name shown on the dashboard.
+	maxFileNameLen = 255
+	// maxPeerAddrs bounds the addresses a peer may announce.
+	maxPeerAddrs = 16
+)
+
+// decodeRequest decodes the JSON body of r into v. It writes an error
+// response and returns false if the body is too large or malformed.
+func decodeRequest(w http.ResponseWriter, r *http.Request, v any) bool {
+	r.Body = http.MaxBytesReader(w, r.Body, maxBodySize)
+	if err := json.NewDecoder(r.Body).Decode(v); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			http.Error(w, "request body too large", http.StatusRequestEntityTooLarge)
+		} else {
+			http.Error(w, "invalid request: "+err.Error(), http.StatusBadRequest)
+		}
+		return false
+	}
+	return true
+}
+
+func validateHash(hash string) error {
+	if !common.ValidHash(hash) {
+		return errors.New("file_hash must be a hex-encoded SHA-256 hash")
+	}
+	return nil
+}
+
+func validateAnnounce(req *common.AnnounceRequest) error {
+	if err := validateHash(req.FileHash); err != nil {
+		return err
+	}
+	if req.PeerInfo.ID == "" {
+		return errors.New("peer id is required")
+	}
+	if req.PeerInfo.Port < 1 || req.PeerInfo.Port > 65535 {
+		return fmt.Errorf("port %d out of range", req.PeerInfo.Port)
+	}
+	if len(req.PeerInfo.Addrs) > maxPeerAddrs {
+		return fmt.Errorf("at most %d addresses may be announced", maxPeerAddrs)
+	}
+	for _, a := range req.PeerInfo.Addrs {
+		if _, err := netip.ParseAddr(a); err != nil {
+			return fmt.Errorf("invalid peer address %q", a)
+		}
+	}
+	if len(req.FileName) > maxFileNameLen {
+		return errors.New("file_name too long")
+	}
+	if req.FileSize < 0 || req.PeerInfo.Left < 0 || req.Uploaded < 0 || req.Downloaded < 0 {
+		return errors.New("sizes and counters must not be negative")
+	}
+	switch req.Event {
+	case "", common.AnnounceStarted, common.AnnounceProgress, common.AnnounceCompleted, common.AnnounceStopped:
+	default:
+		return fmt.Errorf("unknown event %q", req.Event)
+	}
+	return nil
+}
+
+func validateWant(req *common.WantRequest) error {
+	if err := validateHash(req.FileHash); err != nil {
+		return err
+	}
+	if req.NumWant < 0 {
+		return errors.New("numwant must not be negative")
+	}
+	return nil
+}
+
+func validateWithdraw(req *common.WithdrawRequest) error {
+	if err := validateHash(req.FileHash); err != nil {
+		return err
+	}
+	if req.PeerID == "" {
+		return errors.New("peer_id is required")
+	}
+	return nil
+}
+
+// shortHash abbreviates a hash for log messages.
+func shortHash(hash string) string {
+	return hash[:min(len(hash), 10)]
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"dropeer/internal/common"
+)
+
+var (
+	testHash  = strings.Repeat("ab", 32)
+	otherHash = strings.Repeat("cd", 32)
+)
+
+func newTestIdentity(t *testing.T) *common.Identity {
+	t.Helper()
+	id, err := common.NewIdentity()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return id
+}
+
+// announceBody returns a signed announce of hash by id, edited by edit
+// before signing. The peer is at 192.0.2.1, where httptest requests come
+// from.
+func announceBody(t *testing.T, id *common.Identity, hash string, edit func(*common.AnnounceRequest)) string {
+	t.Helper()
+	req := common.AnnounceRequest{FileHash: hash, PeerInfo: common.PeerInfo{IP: "192.0.2.1", Port: 4040}}
+	if edit != nil {
+		edit(&req)
+	}
+	id.SignAnnounce(&req)
+	return jsonBody(t, req)
+}
+
+func jsonBody(t *testing.T, v any) string {
+	t.Helper()
+	data, err := json.Marshal(v)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(data)
+}
+
+// post sends body to the handler at path and returns the response.
+func post(tr *Tracker, path, body string) *httptest.ResponseRecorder {
+	handlers := map[string]http.HandlerFunc{
+		"/announce": tr.announceHandler,
+		"/want":     tr.wantHandler,
+		"/withdraw": tr.withdrawHandler,
+	}
+	w := httptest.NewRecorder()
+	handlers[path](w, httptest.NewRequest("POST", path, strings.NewReader(body)))
+	return w
+}
+
+func TestRequestValidation(t *testing.T) {
+	id := newTestIdentity(t)
+	tests := []struct {
+		name string
+		path string
+		body string
+		want int
+	}{
+		{"valid announce", "/announce", announceBody(t, id, testHash, nil), http.StatusOK},
+		{"malformed JSON", "/announce", `{"file_hash": `, http.StatusBadRequest},
+		{"oversized body", "/announce", `{"file_name": "` + strings.Repeat("x", maxBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"short hash", "/announce", announceBody(t, id, "abcd", nil), http.StatusBadRequest},
+		{"non-hex hash", "/announce", announceBody(t, id, strings.Repeat("zz", 32), nil), http.StatusBadRequest},
+		{"port zero", "/announce", announceBody(t, id, testHash, func(r *common.AnnounceRequest) { r.PeerInfo.Port = 0 }), http.StatusBadRequest},
+		{"port too large", "/announce", announceBody(t, id, testHash, func(r *common.AnnounceRequest) { r.PeerInfo.Port = 65536 }), http.StatusBadRequest},
+		{"too many addresses", "/announce", announceBody(t, id, testHash, func(r *common.AnnounceRequest) {
+			r.PeerInfo.Addrs = make([]string, maxPeerAddrs+1)
+			for i := range r.PeerInfo.Addrs {
+				r.PeerInfo.Addrs[i] = "192.0.2.1"
+			}
+		}), http.StatusBadRequest},
+		{"invalid address", "/announce", announceBody(t, id, testHash, func(r *common.AnnounceRequest) { r.PeerInfo.Addrs = []string{"not-an-ip"} }), http.StatusBadRequest},
+		{"long file name", "/announce", announceBody(t, id, testHash, func(r *common.AnnounceRequest) { r.FileName = strings.Repeat("x", maxFileNameLen+1) }), http.StatusBadRequest},
+		{"negative size", "/announce", announceBody(t, id, testHash, func(r *common.AnnounceRequest) { r.PeerInfo.Left = -1 }), http.StatusBadRequest},
+		{"unknown event", "/announce", announceBody(t, id, testHash, func(r *common.AnnounceRequest) { r.Event = "paused" }), http.StatusBadRequest},
+		{"bad signature", "/announce", strings.Replace(announceBody(t, id, testHash, nil), `"port":4040`, `"port":4041`, 1), http.StatusForbidden},
+		{"want with malformed hash", "/want", jsonBody(t, common.WantRequest{FileHash: "abcd"}), http.StatusBadRequest},
+		{"want with negative numwant", "/want", jsonBody(t, common.WantRequest{FileHash: testHash, NumWant: -1}), http.StatusBadRequest},
+		{"oversized want", "/want", `{"peer_id": "` + strings.Repeat("x", maxBodySize) + `"}`, http.StatusRequestEntityTooLarge},
+		{"withdraw with malformed hash", "/withdraw", jsonBody(t, common.WithdrawRequest{FileHash: "abcd", PeerID: id.PeerID()}), http.StatusBadRequest},
+		{"withdraw without peer", "/withdraw", jsonBody(t, common.WithdrawRequest{FileHash: testHash}), http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker(nil, newGuard(0, 1, nil, nil))
+			if w := post(tr, tt.path, tt.body); w.Code != tt.want {
+				t.Errorf("status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
+
+func TestSwarmLimits(t *testing.T) {
+	a, b := newTestIdentity(t), newTestIdentity(t)
+	tests := []struct {
+		name     string
+		maxPeers int
+		maxFiles int
+		first    string // announced before the checked announce
+		body     string
+		want     int
+	}{
+		{"second peer of a full file", 1, 0, announceBody(t, a, testHash, nil), announceBody(t, b, testHash, nil), http.StatusForbidden},
+		{"peer re-announcing a full file", 1, 0, announceBody(t, a, testHash, nil), announceBody(t, a, testHash, nil), http.StatusOK},
+		{"second file of a full peer", 0, 1, announceBody(t, a, testHash, nil), announceBody(t, a, otherHash, nil), http.StatusForbidden},
+		{"other peer of a full peer's file", 0, 1, announceBody(t, a, testHash, nil), announceBody(t, b, testHash, nil), http.StatusOK},
+		{"no limits", 0, 0, announceBody(t, a, testHash, nil), announceBody(t, b, testHash, nil), http.StatusOK},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			tr := NewTracker(nil, newGuard(0, 1, nil, nil))
+			tr.maxPeersPerFile, tr.maxFilesPerPeer = tt.maxPeers, tt.maxFiles
+			if w := post(tr, "/announce", tt.first); w.Code != http.StatusOK {
+				t.Fatalf("first announce: status %d (%s)", w.Code, strings.TrimSpace(w.Body.String()))
+			}
+			if w := post(tr, "/announce", tt.body); w.Code != tt.want {
+				t.Errorf("status %d (%s), want %d", w.Code, strings.TrimSpace(w.Body.String()), tt.want)
+			}
+		})
+	}
+}
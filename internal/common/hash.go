@@ -0,0 +1,12 @@
+package common
+
+import "encoding/hex"
+
+// ValidHash reports whether s is a hex-encoded SHA256 hash.
+func ValidHash(s string) bool {
+	if len(s) != 64 {
+		return false
+	}
+	_, err := hex.DecodeString(s)
+	return err == nil
+}
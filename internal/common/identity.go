@@ -0,0 +1,149 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// SignatureMaxAge is how far the timestamp of a signed request may be from
+// the tracker's clock. It bounds how long a captured request can be replayed.
+const SignatureMaxAge = 5 * time.Minute
+
+var (
+	errBadSignature = errors.New("invalid signature")
+	errStale        = errors.New("signature timestamp too far from current time")
+)
+
+// Identity is a peer's signing key. The peer ID is derived from its public
+// key, so only the holder of the key can announce under that ID.
+type Identity struct {
+	key ed25519.PrivateKey
+}
+
+// NewIdentity generates a fresh identity.
+func NewIdentity() (*Identity, error) {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	return &Identity{key: key}, nil
+}
+
+// DefaultIdentityPath returns the location of the identity key of a peer
+// listening on port in the user's config directory. Peers on different
+// ports of the same host get different identities.
+func DefaultIdentityPath(port int) (string, error) {
+	dir, err := os.UserConfigDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dropeer", fmt.Sprintf("identity-%d.key", port)), nil
+}
+
+// LoadIdentity reads the identity stored at path, creating and saving a new
+// one if the file does not exist.
+func LoadIdentity(path string) (*Identity, error) {
+	seed, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		id, err := NewIdentity()
+		if err != nil {
+			return nil, err
+		}
+		if err := os.MkdirAll(filepath.Dir(path), 0o700); err != nil {
+			return nil, err
+		}
+		if err := os.WriteFile(path, id.key.Seed(), 0o600); err != nil {
+			return nil, err
+		}
+		return id, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(seed) != ed25519.SeedSize {
+		return nil, fmt.Errorf("corrupt identity key %s", path)
+	}
+	return &Identity{key: ed25519.NewKeyFromSeed(seed)}, nil
+}
+
+// PublicKey returns the identity's public key.
+func (id *Identity) PublicKey() []byte {
+	return id.key.Public().(ed25519.PublicKey)
+}
+
+// PeerID returns the peer ID derived from the identity's public key.
+func (id *Identity) PeerID() string {
+	return PeerIDFromKey(id.PublicKey())
+}
+
+// PeerIDFromKey derives a peer ID from a public key.
+func PeerIDFromKey(pub []byte) string {
+	sum := sha256.Sum256(pub)
+	return hex.EncodeToString(sum[:16])
+}
+
+// SignAnnounce stamps and signs req with the identity.
+func (id *Identity) SignAnnounce(req *AnnounceRequest) {
+	req.PeerInfo.ID = id.PeerID()
+	req.PeerInfo.PublicKey = id.PublicKey()
+	req.Timestamp = time.Now().Unix()
+	req.Signature = ed25519.Sign(id.key, req.signedBytes())
+}
+
+// SignWithdraw stamps and signs req with the identity.
+func (id *Identity) SignWithdraw(req *WithdrawRequest) {
+	req.PeerID = id.PeerID()
+	req.Timestamp = time.Now().Unix()
+	req.Signature = ed25519.Sign(id.key, req.signedBytes())
+}
+
+// VerifyAnnounce checks that req is recent and signed by the key it carries,
+// and that the peer ID belongs to that key.
+func VerifyAnnounce(req *AnnounceRequest) error {
+	pub := req.PeerInfo.PublicKey
+	if len(pub) != ed25519.PublicKeySize || PeerIDFromKey(pub) != req.PeerInfo.ID {
+		return errors.New("peer ID does not match public key")
+	}
+	return verify(pub, req.Timestamp, req.signedBytes(), req.Signature)
+}
+
+// VerifyWithdraw checks that req is recent and signed by pub, the key of the
+// peer being withdrawn.
+func VerifyWithdraw(req *WithdrawRequest, pub []byte) error {
+	if len(pub) != ed25519.PublicKeySize || PeerIDFromKey(pub) != req.PeerID {
+		return errors.New("peer ID does not match public key")
+	}
+	return verify(pub, req.Timestamp, req.signedBytes(), req.Signature)
+}
+
+func verify(pub []byte, timestamp int64, msg, sig []byte) error {
+	age := time.Since(time.Unix(timestamp, 0))
+	if age > SignatureMaxAge || age < -SignatureMaxAge {
+		return errStale
+	}
+	if !ed25519.Verify(pub, msg, sig) {
+		return errBadSignature
+	}
+	return nil
+}
+
+// signedBytes is the message an announce signature covers: every field
+// except the signature itself and LastSeen, which the tracker sets.
+func (r *AnnounceRequest) signedBytes() []byte {
+	msg, _ := json.Marshal([]any{"announce", r.FileHash, r.PeerInfo.ID, r.PeerInfo.IP, r.PeerInfo.Addrs, r.PeerInfo.Port, r.PeerInfo.Left,
+		r.Event, r.Uploaded, r.Downloaded, r.FileName, r.FileSize, r.Timestamp})
+	return msg
+}
+
+func (r *WithdrawRequest) signedBytes() []byte {
+	msg, _ := json.Marshal([]any{"withdraw", r.FileHash, r.PeerID, r.Timestamp})
+	return msg
+}
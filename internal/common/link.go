@@ -0,0 +1,69 @@
+package common
+
+import (
+	"encoding/base64"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+)
+
+// LinkScheme is the URL scheme of share links.
+const LinkScheme = "dropeer"
+
+// Link is a shareable reference to a file in the swarm.
+type Link struct {
+	FileHash string
+	FileName string
+	FileSize int64
+	// Key decrypts the file if it was shared encrypted. FileName and
+	// FileSize then describe the plaintext.
+	Key []byte
+}
+
+// String formats the link as dropeer://<hash>?name=<name>&size=<size>&key=<key>.
+func (l Link) String() string {
+	q := url.Values{}
+	if l.FileName != "" {
+		q.Set("name", l.FileName)
+	}
+	if l.FileSize > 0 {
+		q.Set("size", strconv.FormatInt(l.FileSize, 10))
+	}
+	if len(l.Key) > 0 {
+		q.Set("key", base64.RawURLEncoding.EncodeToString(l.Key))
+	}
+	u := url.URL{Scheme: LinkScheme, Host: l.FileHash, RawQuery: q.Encode()}
+	return u.String()
+}
+
+// ParseLink parses a share link. A bare file hash is accepted as well.
+func ParseLink(s string) (Link, error) {
+	if !strings.HasPrefix(s, LinkScheme+"://") {
+		return Link{FileHash: s}, nil
+	}
+	u, err := url.Parse(s)
+	if err != nil {
+		return Link{}, fmt.Errorf("invalid link: %w", err)
+	}
+	if u.Host == "" {
+		return Link{}, fmt.Errorf("invalid link: missing file hash")
+	}
+	link := Link{
+		FileHash: u.Host,
+		FileName: u.Query().Get("name"),
+	}
+	if size := u.Query().Get("size"); size != "" {
+		link.FileSize, err = strconv.ParseInt(size, 10, 64)
+		if err != nil {
+			return Link{}, fmt.Errorf("invalid link size: %w", err)
+		}
+	}
+	if key := u.Query().Get("key"); key != "" {
+		link.Key, err = base64.RawURLEncoding.DecodeString(key)
+		if err != nil {
+			return Link{}, fmt.Errorf("invalid link key: %w", err)
+		}
+	}
+	return link, nil
+}
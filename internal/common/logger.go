@@ -0,0 +1,7 @@
+package common
+
+// Logger is the logging interface used throughout dropeer. *log.Logger
+// satisfies it.
+type Logger interface {
+	Printf(format string, v ...any)
+}
@@ -13,28 +13,99 @@ const (
 
 // PeerInfo holds information about a peer.
 type PeerInfo struct {
-	ID       string    `json:"id"`
-	IP       string    `json:"ip"`
-	Port     int       `json:"port"`
+	ID string `json:"id"`
+	// IP is the peer's primary address. A peer may leave it empty when
+	// announcing to be recorded at the address it connects from.
+	IP   string `json:"ip"`
+	Port int    `json:"port"`
+	// Addrs lists every address the peer can be reached at, IPv4 and IPv6,
+	// including link-local addresses with a zone such as "fe80::1%eth0".
+	// The tracker only verifies IP, so these are tried after it.
+	Addrs    []string  `json:"addrs,omitempty"`
 	LastSeen time.Time `json:"last_seen"`
+	// Endpoint is the public UDP address, "ip:port", at which the tracker's
+	// rendezvous service sees the peer's QUIC socket. Peers that cannot be
+	// reached at their own addresses are connected through it by hole
+	// punching. The tracker sets it in want responses.
+	Endpoint string `json:"endpoint,omitempty"`
+	// Relayed reports that the peer can be reached through the tracker's
+	// relay. The tracker sets it in want responses.
+	Relayed bool `json:"relayed,omitempty"`
+	// Via, if set, is the base URL of the relay a downloader reaches the
+	// peer through. It is never sent.
+	Via string `json:"-"`
+	// PublicKey is the peer's identity key, from which ID is derived.
+	PublicKey []byte `json:"public_key,omitempty"`
+	// Left is how many bytes of the file the peer is still missing. Peers
+	// with nothing left are seeders, the others leechers.
+	Left int64 `json:"left,omitempty"`
 }
 
-// AnnounceRequest is sent by a client to announce it has a file.
+// Announce events. Announces without an event are periodic updates.
+const (
+	AnnounceStarted   = "started"   // a download began
+	AnnounceProgress  = "progress"  // a download is under way
+	AnnounceCompleted = "completed" // a download finished; the peer now seeds
+	AnnounceStopped   = "stopped"   // the peer left the swarm
+)
+
+// AnnounceRequest is sent by a client to announce it has a file, or is
+// downloading it.
 type AnnounceRequest struct {
 	FileHash string   `json:"file_hash"`
 	PeerInfo PeerInfo `json:"peer_info"`
+	Event    string   `json:"event,omitempty"`
+	// Uploaded and Downloaded count the bytes of the file this peer has
+	// sent to and received from other peers.
+	Uploaded   int64 `json:"uploaded,omitempty"`
+	Downloaded int64 `json:"downloaded,omitempty"`
+	// FileName and FileSize are optional and only used for display.
+	FileName string `json:"file_name,omitempty"`
+	FileSize int64  `json:"file_size,omitempty"`
+	// Timestamp and Signature are set by Identity.SignAnnounce.
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature"`
+}
+
+// WithdrawRequest is sent by a client to stop sharing a file.
+type WithdrawRequest struct {
+	FileHash string `json:"file_hash"`
+	PeerID   string `json:"peer_id"`
+	// Timestamp and Signature are set by Identity.SignWithdraw.
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature"`
 }
 
 // WantRequest is sent by a client to ask for peers with a file.
 type WantRequest struct {
 	FileHash string `json:"file_hash"`
+	// NumWant is how many peers to return. Zero lets the tracker decide.
+	NumWant int `json:"numwant,omitempty"`
+	// PeerID is the requester's ID, which is left out of the response.
+	PeerID string `json:"peer_id,omitempty"`
 }
 
-// WantResponse is the tracker's response with a list of peers.
+// WantResponse is the tracker's response with a random subset of the
+// swarm, seeders first, and statistics about the whole swarm.
 type WantResponse struct {
-	Peers []PeerInfo `json:"peers"`
+	Peers     []PeerInfo `json:"peers"`
+	Seeders   int        `json:"seeders"`
+	Leechers  int        `json:"leechers"`
+	Completed int        `json:"completed"` // downloads completed in this swarm
 }
 
+// Chunking is how a file is split into chunks.
+type Chunking string
+
+const (
+	// ChunkingFixed splits files into chunks of ChunkSize bytes.
+	ChunkingFixed Chunking = ""
+	// ChunkingCDC cuts files into chunks where their content says, with
+	// FastCDC, so that an edit only changes the chunks around it and other
+	// versions of a file share most of their chunks.
+	ChunkingCDC Chunking = "fastcdc"
+)
+
 // FileMetadata contains information about a file necessary for download.
 type FileMetadata struct {
 	FileName  string `json:"file_name"`
@@ -42,4 +113,10 @@ type FileMetadata struct {
 	FileHash  string `json:"file_hash"`
 	ChunkSize int    `json:"chunk_size"`
 	NumChunks int    `json:"num_chunks"`
+	// ChunkHashes holds the hex SHA256 of each chunk, in order.
+	ChunkHashes []string `json:"chunk_hashes,omitempty"`
+	// Chunking is how the file was split. Content-defined chunks vary in
+	// size, so ChunkSizes then lists the size of each.
+	Chunking   Chunking `json:"chunking,omitempty"`
+	ChunkSizes []int64  `json:"chunk_sizes,omitempty"`
 }
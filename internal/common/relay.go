@@ -0,0 +1,49 @@
+package common
+
+import (
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// RelayStatusHeader carries the status code of a peer's response to a
+// relayed request, which the peer posts back to the relay.
+const RelayStatusHeader = "X-Relay-Status"
+
+// RelayPoll is sent by a peer waiting for requests relayed to it. It is
+// signed so only the holder of a peer ID's key receives its requests.
+type RelayPoll struct {
+	PeerID    string `json:"peer_id"`
+	PublicKey []byte `json:"public_key"`
+	Timestamp int64  `json:"timestamp"`
+	Signature []byte `json:"signature"`
+}
+
+// RelayRequest is a request relayed to a peer in answer to a poll. The peer
+// handles it and posts the response to the relay under ID.
+type RelayRequest struct {
+	ID   string `json:"id"`
+	Path string `json:"path"`
+}
+
+// SignRelayPoll returns a poll signed with the identity.
+func (id *Identity) SignRelayPoll() *RelayPoll {
+	p := &RelayPoll{PeerID: id.PeerID(), PublicKey: id.PublicKey(), Timestamp: time.Now().Unix()}
+	p.Signature = ed25519.Sign(id.key, p.signedBytes())
+	return p
+}
+
+// VerifyRelayPoll checks that p is recent and signed by the key it carries,
+// and that the peer ID belongs to that key.
+func VerifyRelayPoll(p *RelayPoll) error {
+	if len(p.PublicKey) != ed25519.PublicKeySize || PeerIDFromKey(p.PublicKey) != p.PeerID {
+		return errors.New("peer ID does not match public key")
+	}
+	return verify(p.PublicKey, p.Timestamp, p.signedBytes(), p.Signature)
+}
+
+func (p *RelayPoll) signedBytes() []byte {
+	msg, _ := json.Marshal([]any{"relay-poll", p.PeerID, p.Timestamp})
+	return msg
+}
@@ -0,0 +1,86 @@
+package common
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// rendezvousMagic starts every rendezvous datagram. Its first byte has the
+// two high bits clear, so a QUIC stack sharing the socket passes the
+// datagram on as a non-QUIC packet.
+const rendezvousMagic = "\x00dprv1"
+
+// Rendezvous message types. A peer registers its QUIC socket with the
+// tracker, which answers with the endpoint it sees. To reach another peer it
+// sends a connect message; the tracker then sends a punch message with each
+// side's endpoint to the other, and both start sending to each other at once.
+const (
+	RendezvousRegister   = "register"
+	RendezvousRegistered = "registered"
+	RendezvousConnect    = "connect"
+	RendezvousPunch      = "punch"
+	RendezvousError      = "error"
+)
+
+// RendezvousMessage is a datagram exchanged with the tracker's rendezvous
+// service.
+type RendezvousMessage struct {
+	Type   string `json:"type"`
+	PeerID string `json:"peer_id,omitempty"`
+	// Target is the peer a connect message asks to reach.
+	Target string `json:"target,omitempty"`
+	// Endpoint is the public "ip:port" of the peer the message is about:
+	// the sender itself in a registered message, the other side in a punch.
+	Endpoint string `json:"endpoint,omitempty"`
+	Error    string `json:"error,omitempty"`
+
+	PublicKey []byte `json:"public_key,omitempty"`
+	Timestamp int64  `json:"timestamp,omitempty"`
+	Signature []byte `json:"signature,omitempty"`
+}
+
+// Marshal encodes the message as a datagram.
+func (m *RendezvousMessage) Marshal() []byte {
+	data, _ := json.Marshal(m)
+	return append([]byte(rendezvousMagic), data...)
+}
+
+// ParseRendezvous decodes a datagram. It fails for anything that is not a
+// rendezvous message.
+func ParseRendezvous(b []byte) (*RendezvousMessage, error) {
+	data, ok := bytes.CutPrefix(b, []byte(rendezvousMagic))
+	if !ok {
+		return nil, errors.New("not a rendezvous message")
+	}
+	var m RendezvousMessage
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, err
+	}
+	return &m, nil
+}
+
+// SignRendezvous stamps and signs a register or connect message with the
+// identity.
+func (id *Identity) SignRendezvous(m *RendezvousMessage) {
+	m.PeerID = id.PeerID()
+	m.PublicKey = id.PublicKey()
+	m.Timestamp = time.Now().Unix()
+	m.Signature = ed25519.Sign(id.key, m.signedBytes())
+}
+
+// VerifyRendezvous checks that m is recent and signed by the key it carries,
+// and that the peer ID belongs to that key.
+func VerifyRendezvous(m *RendezvousMessage) error {
+	if len(m.PublicKey) != ed25519.PublicKeySize || PeerIDFromKey(m.PublicKey) != m.PeerID {
+		return errors.New("peer ID does not match public key")
+	}
+	return verify(m.PublicKey, m.Timestamp, m.signedBytes(), m.Signature)
+}
+
+func (m *RendezvousMessage) signedBytes() []byte {
+	msg, _ := json.Marshal([]any{"rendezvous", m.Type, m.PeerID, m.Target, m.Timestamp})
+	return msg
+}
@@ -2,8 +2,11 @@ package discovery
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"log"
+	"net"
+	"strconv"
+	"strings"
 	"time"
 
 	"dropeer/internal/common"
@@ -11,44 +14,125 @@ import (
 	"github.com/grandcat/zeroconf"
 )
 
-// Publish tracker service using mDNS.
-func PublishService(port int) (*zeroconf.Server, error) {
-	server, err := zeroconf.Register("Dropeer-Tracker", common.ServiceName, common.ServiceDomain, port, []string{"txtv=0", "lo=1", "la=2"}, nil)
+// TrackerInfo is what a tracker advertises about itself over mDNS.
+type TrackerInfo struct {
+	// URL is the tracker's base URL.
+	URL string
+	// Fingerprint is the hex SHA-256 of the tracker's TLS certificate, which
+	// clients pin.
+	Fingerprint string
+	// HTTP3 reports whether the tracker also serves HTTP/3 on its port.
+	HTTP3 bool
+	// Rendezvous is the UDP address of the tracker's rendezvous service,
+	// or empty if it does not run one.
+	Rendezvous string
+	// Relay reports whether the tracker relays requests to peers that
+	// cannot be reached directly.
+	Relay bool
+}
+
+// txtVersion is the version of the TXT record format.
+const txtVersion = "1"
+
+// PublishService publishes the tracker service using mDNS. The TXT records
+// carry the certificate fingerprint, whether HTTP/3 is served, the port of
+// the rendezvous service, if rendezvousPort is not 0, and whether the tracker
+// relays.
+func PublishService(port int, fingerprint string, http3 bool, rendezvousPort int, relay bool) (*zeroconf.Server, error) {
+	txt := []string{"txtv=" + txtVersion, "fp=" + fingerprint}
+	if http3 {
+		txt = append(txt, "h3=1")
+	}
+	if rendezvousPort != 0 {
+		txt = append(txt, "rv="+strconv.Itoa(rendezvousPort))
+	}
+	if relay {
+		txt = append(txt, "relay=1")
+	}
+	server, err := zeroconf.Register("Dropeer-Tracker", common.ServiceName, common.ServiceDomain, port, txt, nil)
 	if err != nil {
 		return nil, fmt.Errorf("could not register service: %w", err)
 	}
 	return server, nil
 }
 
+// ErrTrackerNotFound is returned when no tracker answers before discovery times out.
+var ErrTrackerNotFound = errors.New("tracker discovery timed out")
+
+// discoveryTimeout bounds discovery when ctx has no deadline of its own.
+const discoveryTimeout = 5 * time.Second
+
 // DiscoverTracker finds the tracker on the LAN using mDNS.
-func DiscoverTracker() (string, error) {
+func DiscoverTracker(ctx context.Context) (*TrackerInfo, error) {
 	resolver, err := zeroconf.NewResolver(nil)
 	if err != nil {
-		return "", fmt.Errorf("failed to initialize resolver: %w", err)
+		return nil, fmt.Errorf("failed to initialize resolver: %w", err)
 	}
 
-	entries := make(chan *zeroconf.ServiceEntry)
-	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, discoveryTimeout)
+		defer cancel()
+	}
+	ctx, cancel := context.WithCancel(ctx)
 	defer cancel()
 
-	go func(results <-chan *zeroconf.ServiceEntry) {
-		for entry := range results {
-			log.Printf("Discovered tracker: %s at %s:%d", entry.Instance, entry.AddrIPv4[0], entry.Port)
-			entries <- entry
-		}
-	}(entries)
-
+	entries := make(chan *zeroconf.ServiceEntry)
 	if err := resolver.Browse(ctx, common.ServiceName, common.ServiceDomain, entries); err != nil {
-		return "", fmt.Errorf("failed to browse: %w", err)
+		return nil, fmt.Errorf("failed to browse: %w", err)
 	}
 
 	select {
 	case <-ctx.Done():
-		return "", fmt.Errorf("tracker discovery timed out")
+		if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+			return nil, ErrTrackerNotFound
+		}
+		return nil, ctx.Err()
 	case entry := <-entries:
-		if len(entry.AddrIPv4) == 0 {
-			return "", fmt.Errorf("discovered tracker but no IPv4 address found")
+		if entry == nil {
+			return nil, ErrTrackerNotFound
+		}
+		ip, err := trackerAddr(entry)
+		if err != nil {
+			return nil, err
+		}
+		return trackerInfo(ip, entry.Port, entry.Text)
+	}
+}
+
+// trackerAddr picks the address to reach a discovered tracker at: IPv4 if
+// it has one, else a global IPv6 address. Link-local IPv6 addresses are
+// only usable with a zone, which mDNS does not report.
+func trackerAddr(entry *zeroconf.ServiceEntry) (string, error) {
+	if len(entry.AddrIPv4) > 0 {
+		return entry.AddrIPv4[0].String(), nil
+	}
+	for _, ip := range entry.AddrIPv6 {
+		if ip.IsGlobalUnicast() {
+			return ip.String(), nil
 		}
-		return fmt.Sprintf("http://%s:%d", entry.AddrIPv4[0].String(), entry.Port), nil
 	}
+	return "", fmt.Errorf("discovered tracker but no usable address found")
+}
+
+// trackerInfo builds a TrackerInfo from a discovered address and TXT records.
+func trackerInfo(ip string, port int, text []string) (*TrackerInfo, error) {
+	txt := make(map[string]string)
+	for _, record := range text {
+		k, v, _ := strings.Cut(record, "=")
+		txt[k] = v
+	}
+	if txt["txtv"] != txtVersion || txt["fp"] == "" {
+		return nil, fmt.Errorf("discovered tracker does not advertise a TLS certificate fingerprint")
+	}
+	info := &TrackerInfo{
+		URL:         "https://" + net.JoinHostPort(ip, strconv.Itoa(port)),
+		Fingerprint: txt["fp"],
+		HTTP3:       txt["h3"] == "1",
+		Relay:       txt["relay"] == "1",
+	}
+	if rv, err := strconv.Atoi(txt["rv"]); err == nil && rv > 0 && rv <= 65535 {
+		info.Rendezvous = net.JoinHostPort(ip, txt["rv"])
+	}
+	return info, nil
 }
@@ -0,0 +1,171 @@
+package p2p
+
+import (
+	"fmt"
+	"io"
+	"os"
+
+	"dropeer/internal/common"
+)
+
+// Content-defined chunks are cut with FastCDC (Xia et al., 2016) at between
+// cdcMinSize and cdcMaxSize bytes, averaging about cdcAvgSize. Every peer
+// must cut the same way, so these and the gear table are part of the
+// protocol.
+const (
+	cdcMinSize = 256 << 10
+	cdcAvgSize = 1 << 20
+	cdcMaxSize = 4 << 20
+	// Below the average size a cut needs more matching bits, above it fewer,
+	// which keeps chunk sizes close to the average.
+	cdcMaskS = (1<<22 - 1) << (64 - 22)
+	cdcMaskL = (1<<18 - 1) << (64 - 18)
+)
+
+// gear maps each byte to a random value mixed into the rolling hash. It is
+// generated from a fixed seed with SplitMix64, so it is the same everywhere.
+var gear = func() (table [256]uint64) {
+	x := uint64(0x64726f70656572) // "dropeer"
+	for i := range table {
+		x += 0x9e3779b97f4a7c15
+		z := x
+		z = (z ^ z>>30) * 0xbf58476d1ce4e5b9
+		z = (z ^ z>>27) * 0x94d049bb133111eb
+		table[i] = z ^ z>>31
+	}
+	return table
+}()
+
+// cutPoint returns the length of the first content-defined chunk of data.
+// data must hold cdcMaxSize bytes unless it is the end of the file.
+func cutPoint(data []byte) int {
+	n := len(data)
+	if n <= cdcMinSize {
+		return n
+	}
+	n = min(n, cdcMaxSize)
+	normal := min(cdcAvgSize, n)
+	var fp uint64
+	i := cdcMinSize
+	for ; i < normal; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&cdcMaskS == 0 {
+			return i + 1
+		}
+	}
+	for ; i < n; i++ {
+		fp = fp<<1 + gear[data[i]]
+		if fp&cdcMaskL == 0 {
+			return i + 1
+		}
+	}
+	return n
+}
+
+// chunker splits a stream into chunks. The returned slice is only valid
+// until the next call; io.EOF means there are no more chunks.
+type chunker func() ([]byte, error)
+
+// newChunker returns a chunker splitting r as chunking says.
+func newChunker(r io.Reader, chunking common.Chunking) chunker {
+	if chunking == common.ChunkingCDC {
+		return cdcChunker(r)
+	}
+	buf := make([]byte, common.ChunkSize)
+	return func() ([]byte, error) {
+		n, err := io.ReadFull(r, buf)
+		if err == io.ErrUnexpectedEOF {
+			err = nil
+		}
+		return buf[:n], err
+	}
+}
+
+func cdcChunker(r io.Reader) chunker {
+	buf := make([]byte, 2*cdcMaxSize)
+	var start, end int
+	eof := false
+	return func() ([]byte, error) {
+		if end-start < cdcMaxSize && !eof {
+			end = copy(buf, buf[start:end])
+			start = 0
+			n, err := io.ReadFull(r, buf[end:])
+			end += n
+			if err == io.EOF || err == io.ErrUnexpectedEOF {
+				eof = true
+			} else if err != nil {
+				return nil, err
+			}
+		}
+		if start == end {
+			return nil, io.EOF
+		}
+		n := cutPoint(buf[start:end])
+		start += n
+		return buf[start-n : start], nil
+	}
+}
+
+// chunkLayout holds where each chunk of a file starts, followed by the file
+// size.
+type chunkLayout []int64
+
+// newChunkLayout works out the chunks of meta, checking that they cover the
+// file exactly.
+func newChunkLayout(meta *common.FileMetadata) (chunkLayout, error) {
+	if meta.FileSize < 0 || meta.NumChunks < 0 {
+		return nil, fmt.Errorf("invalid size %d or chunk count %d", meta.FileSize, meta.NumChunks)
+	}
+	switch meta.Chunking {
+	case common.ChunkingFixed:
+		if int64(meta.NumChunks) != (meta.FileSize+common.ChunkSize-1)/common.ChunkSize {
+			return nil, fmt.Errorf("%d chunks do not fit %d bytes", meta.NumChunks, meta.FileSize)
+		}
+	case common.ChunkingCDC:
+		if len(meta.ChunkSizes) != meta.NumChunks {
+			return nil, fmt.Errorf("%d chunk sizes for %d chunks", len(meta.ChunkSizes), meta.NumChunks)
+		}
+	default:
+		return nil, fmt.Errorf("unknown chunking %q", meta.Chunking)
+	}
+
+	layout := make(chunkLayout, meta.NumChunks+1)
+	switch meta.Chunking {
+	case common.ChunkingFixed:
+		for i := range meta.NumChunks {
+			layout[i] = int64(i) * common.ChunkSize
+		}
+	case common.ChunkingCDC:
+		for i, size := range meta.ChunkSizes {
+			if size <= 0 || size > cdcMaxSize {
+				return nil, fmt.Errorf("chunk %d has invalid size %d", i, size)
+			}
+			layout[i+1] = layout[i] + size
+		}
+		if layout[meta.NumChunks] != meta.FileSize {
+			return nil, fmt.Errorf("chunks add up to %d bytes, not %d", layout[meta.NumChunks], meta.FileSize)
+		}
+	}
+	layout[meta.NumChunks] = meta.FileSize
+	return layout, nil
+}
+
+func (l chunkLayout) offset(i int) int64 { return l[i] }
+
+func (l chunkLayout) length(i int) int64 { return l[i+1] - l[i] }
+
+// ReadRange reads size bytes at offset from a file, or fewer at its end.
+func ReadRange(filePath string, offset, size int64) ([]byte, error) {
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	buffer := make([]byte, size)
+	n, err := file.ReadAt(buffer, offset)
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	return buffer[:n], nil
+}
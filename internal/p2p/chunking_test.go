@@ -0,0 +1,201 @@
+package p2p
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"testing"
+
+	"dropeer/internal/common"
+)
+
+// split returns the hashes and sizes of the chunks of data.
+func split(t *testing.T, data []byte, chunking common.Chunking) (hashes [][32]byte, sizes []int) {
+	t.Helper()
+	next := newChunker(bytes.NewReader(data), chunking)
+	for {
+		chunk, err := next()
+		if len(chunk) > 0 {
+			hashes = append(hashes, sha256.Sum256(chunk))
+			sizes = append(sizes, len(chunk))
+		}
+		if err == io.EOF {
+			return hashes, sizes
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestChunkSizes(t *testing.T) {
+	tests := []struct {
+		name     string
+		size     int
+		chunking common.Chunking
+	}{
+		{"empty fixed", 0, common.ChunkingFixed},
+		{"empty cdc", 0, common.ChunkingCDC},
+		{"below minimum", cdcMinSize - 1, common.ChunkingCDC},
+		{"exactly minimum", cdcMinSize, common.ChunkingCDC},
+		{"one past minimum", cdcMinSize + 1, common.ChunkingCDC},
+		{"fixed partial last chunk", 3*common.ChunkSize + 17, common.ChunkingFixed},
+		{"cdc large", 32 << 20, common.ChunkingCDC},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			_, sizes := split(t, randomData(1, tt.size), tt.chunking)
+			total := 0
+			for i, size := range sizes {
+				total += size
+				last := i == len(sizes)-1
+				switch tt.chunking {
+				case common.ChunkingFixed:
+					if !last && size != common.ChunkSize {
+						t.Errorf("chunk %d has %d bytes, want %d", i, size, common.ChunkSize)
+					}
+				case common.ChunkingCDC:
+					if size > cdcMaxSize || !last && size < cdcMinSize {
+						t.Errorf("chunk %d has %d bytes, want %d to %d", i, size, cdcMinSize, cdcMaxSize)
+					}
+				}
+			}
+			if total != tt.size {
+				t.Errorf("chunks add up to %d bytes, want %d", total, tt.size)
+			}
+		})
+	}
+}
+
+func TestCDCAverageSize(t *testing.T) {
+	const size = 64 << 20
+	_, sizes := split(t, randomData(2, size), common.ChunkingCDC)
+	avg := size / len(sizes)
+	if avg < cdcAvgSize/2 || avg > 2*cdcAvgSize {
+		t.Errorf("average chunk size %d, want about %d", avg, cdcAvgSize)
+	}
+}
+
+func TestCDCMaxSizeOnUniformData(t *testing.T) {
+	// Data with no content to cut at is cut at the maximum size.
+	_, sizes := split(t, make([]byte, 3*cdcMaxSize+5), common.ChunkingCDC)
+	want := []int{cdcMaxSize, cdcMaxSize, cdcMaxSize, 5}
+	if len(sizes) != len(want) {
+		t.Fatalf("got chunk sizes %v, want %v", sizes, want)
+	}
+	for i := range want {
+		if sizes[i] != want[i] {
+			t.Fatalf("got chunk sizes %v, want %v", sizes, want)
+		}
+	}
+}
+
+func TestCDCBoundaryStability(t *testing.T) {
+	base := randomData(3, 24<<20)
+	edit := randomData(4, 1000)
+	at := 10 << 20
+	tests := []struct {
+		name string
+		data []byte
+	}{
+		{"unchanged", base},
+		{"insert", append(append(append([]byte{}, base[:at]...), edit...), base[at:]...)},
+		{"delete", append(append([]byte{}, base[:at]...), base[at+len(edit):]...)},
+		{"overwrite", append(append(append([]byte{}, base[:at]...), edit...), base[at+len(edit):]...)},
+		{"prepend", append(append([]byte{}, edit...), base...)},
+	}
+	orig, _ := split(t, base, common.ChunkingCDC)
+	known := make(map[[32]byte]bool)
+	for _, h := range orig {
+		known[h] = true
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			hashes, _ := split(t, tt.data, common.ChunkingCDC)
+			changed := 0
+			for _, h := range hashes {
+				if !known[h] {
+					changed++
+				}
+			}
+			// An edit only changes the chunks around it.
+			if changed > 2 {
+				t.Errorf("%d of %d chunks changed, want at most 2", changed, len(hashes))
+			}
+		})
+	}
+}
+
+func TestNewChunkLayout(t *testing.T) {
+	tests := []struct {
+		name    string
+		meta    common.FileMetadata
+		wantErr bool
+		offsets []int64
+	}{
+		{
+			name:    "fixed",
+			meta:    common.FileMetadata{FileSize: 2*common.ChunkSize + 1, NumChunks: 3},
+			offsets: []int64{0, common.ChunkSize, 2 * common.ChunkSize, 2*common.ChunkSize + 1},
+		},
+		{
+			name:    "fixed empty",
+			meta:    common.FileMetadata{},
+			offsets: []int64{0},
+		},
+		{
+			name:    "fixed wrong count",
+			meta:    common.FileMetadata{FileSize: common.ChunkSize + 1, NumChunks: 1},
+			wantErr: true,
+		},
+		{
+			name:    "cdc",
+			meta:    common.FileMetadata{Chunking: common.ChunkingCDC, FileSize: 30, NumChunks: 2, ChunkSizes: []int64{10, 20}},
+			offsets: []int64{0, 10, 30},
+		},
+		{
+			name:    "cdc missing sizes",
+			meta:    common.FileMetadata{Chunking: common.ChunkingCDC, FileSize: 30, NumChunks: 2, ChunkSizes: []int64{30}},
+			wantErr: true,
+		},
+		{
+			name:    "cdc sizes do not add up",
+			meta:    common.FileMetadata{Chunking: common.ChunkingCDC, FileSize: 31, NumChunks: 2, ChunkSizes: []int64{10, 20}},
+			wantErr: true,
+		},
+		{
+			name:    "cdc empty chunk",
+			meta:    common.FileMetadata{Chunking: common.ChunkingCDC, FileSize: 10, NumChunks: 2, ChunkSizes: []int64{10, 0}},
+			wantErr: true,
+		},
+		{
+			name:    "cdc chunk too large",
+			meta:    common.FileMetadata{Chunking: common.ChunkingCDC, FileSize: cdcMaxSize + 1, NumChunks: 1, ChunkSizes: []int64{cdcMaxSize + 1}},
+			wantErr: true,
+		},
+		{
+			name:    "unknown chunking",
+			meta:    common.FileMetadata{Chunking: "rabin"},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			layout, err := newChunkLayout(&tt.meta)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("newChunkLayout() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if err != nil {
+				return
+			}
+			if len(layout) != len(tt.offsets) {
+				t.Fatalf("layout %v, want %v", layout, tt.offsets)
+			}
+			for i, off := range tt.offsets {
+				if layout[i] != off {
+					t.Fatalf("layout %v, want %v", layout, tt.offsets)
+				}
+			}
+		})
+	}
+}
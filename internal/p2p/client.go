@@ -1,166 +1,426 @@
 package p2p
 
 import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log"
 	"net/http"
 	"os"
-	"sort"
+	"path/filepath"
 	"sync"
-	"time"
 
 	"dropeer/internal/common"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 )
 
-type peerSpeed struct {
-	peer common.PeerInfo
-	mbps float64
+// TempPath returns the path a download to outputPath is written to until it completes.
+func TempPath(outputPath string) string {
+	return outputPath + ".tmp"
 }
 
-// DownloadFile coordinates the download of a file from the best available peer.
-func DownloadFile(fileHash, outputPath string, peers []common.PeerInfo, fileManager *FileManager) error {
-	if len(peers) == 0 {
-		return fmt.Errorf("no peers found for file hash %s", fileHash)
+// maxChunkAttempts is how many times a chunk is tried before the download fails.
+const maxChunkAttempts = 5
+
+// TempPolicy decides what happens to the temp file of a failed download.
+type TempPolicy int
+
+const (
+	// TempResume keeps partial data so that a later call can resume it, but
+	// removes a complete file that fails verification. This is the default.
+	TempResume TempPolicy = iota
+	// TempKeep keeps the temp file after any failure, for inspection.
+	TempKeep
+	// TempRemove removes the temp file after any failure.
+	TempRemove
+)
+
+// removes reports whether the policy removes the temp file after err.
+func (p TempPolicy) removes(err error) bool {
+	switch p {
+	case TempKeep:
+		return false
+	case TempRemove:
+		return true
 	}
+	var mismatch *HashMismatchError
+	return errors.As(err, &mismatch)
+}
 
-	log.Println("Finding the best peer by running speed tests...")
-	bestPeer, bestSpeed, err := findBestPeer(peers)
-	if err != nil {
-		return fmt.Errorf("could not determine best peer: %w", err)
+// DownloadOptions configures a download.
+type DownloadOptions struct {
+	// Progress, if set, is called with progress events. It is called from
+	// the download goroutines and must not block.
+	Progress func(ProgressEvent)
+	// Logger receives log output. It defaults to the standard logger.
+	Logger common.Logger
+	// MaxInFlight caps the bytes requested from peers but not yet
+	// received. Defaults to DefaultMaxInFlight.
+	MaxInFlight int64
+	// Scores, if set, rates the peers and is updated as chunks arrive, so
+	// later downloads start out knowing which peers are good. Otherwise
+	// each download starts from scratch.
+	Scores *PeerScores
+	// Rendezvous, if set, connects to peers behind NATs by hole punching.
+	// Downloads then dial out from its socket.
+	Rendezvous *Rendezvous
+	// Relay, if set, is used to reach peers that cannot be reached
+	// directly or by hole punching.
+	Relay *RelayClient
+	// Preallocate reserves disk space for the whole file before any chunk
+	// is downloaded, where the file system supports it.
+	Preallocate bool
+	// TempPolicy decides whether the temp file is kept when the download
+	// fails.
+	TempPolicy TempPolicy
+	// Local, if set, is searched for the whole file before anything is
+	// downloaded, and for chunks the file has in common with local files.
+	Local *LocalStore
+	// HardLink makes a file found in Local a hard link to the local copy
+	// rather than a copy, where possible. Changing either file then changes
+	// both.
+	HardLink bool
+}
+
+// DownloadFile downloads a file from peers, unless opts.Local already holds
+// it. It connects to all of them in
+// the background and fetches each chunk from the peer the scores rate best
+// at the time, dropping peers that keep failing. Data is written to
+// TempPath(outputPath), which is only renamed to outputPath once it is
+// verified and synced to disk. If the download fails the temp file is kept
+// or removed according to opts.TempPolicy; a later call resumes a kept one.
+func DownloadFile(ctx context.Context, fileHash, outputPath string, peers []common.PeerInfo, fileManager *FileManager, opts DownloadOptions) (err error) {
+	logger := opts.Logger
+	if logger == nil {
+		logger = log.Default()
+	}
+	if f, ok := opts.Local.file(fileHash); ok {
+		err := reuseFile(f, fileHash, outputPath, fileManager, opts)
+		if err == nil {
+			logger.Printf("Reused local copy %s. Saved to %s", f.path, outputPath)
+			return nil
+		}
+		logger.Printf("Could not reuse local copy %s: %v", f.path, err)
+		opts.Local.forget(f.path)
+	}
+	if len(peers) == 0 {
+		return ErrNoPeers
+	}
+	scores := opts.Scores
+	if scores == nil {
+		scores = NewPeerScores()
 	}
-	log.Printf("Best peer found: %s (%s:%d) with %.2f Mbps", bestPeer.ID, bestPeer.IP, bestPeer.Port, bestSpeed) // Speed isn't returned here, could be added.
 
-	client, err := createQUICClient()
+	client, err := createQUICClient(opts, scores)
 	if err != nil {
 		return err
 	}
+	connectCtx, stopConnecting := context.WithCancel(ctx)
+	defer stopConnecting()
+	pool := newPeerPool(connectCtx, client, peers, scores, opts.MaxInFlight, opts, logger)
 
-	// 1. Get file metadata from the chosen peer
-	meta, err := getMetadataFromPeer(client, bestPeer, fileHash)
+	// 1. Get file metadata from the first peer that answers
+	meta, layout, err := fetchMetadata(ctx, client, pool, fileHash)
 	if err != nil {
-		return fmt.Errorf("failed to get metadata from peer %s: %w", bestPeer.ID, err)
+		return err
 	}
-	log.Printf("Downloading '%s' (%d chunks)...", meta.FileName, meta.NumChunks)
+	logger.Printf("Downloading '%s' (%d chunks)...", meta.FileName, meta.NumChunks)
 
-	// 2. Create a temporary file
-	tempOutputPath := outputPath + ".tmp"
-	outFile, err := os.Create(tempOutputPath)
+	// 2. Create a temporary file, or reuse the one left by an interrupted download
+	tempOutputPath := TempPath(outputPath)
+	outFile, err := os.OpenFile(tempOutputPath, os.O_RDWR|os.O_CREATE, 0o644)
 	if err != nil {
 		return fmt.Errorf("failed to create output file: %w", err)
 	}
 	defer outFile.Close()
-	outFile.Truncate(meta.FileSize) // Pre-allocate space
+	defer func() {
+		if err != nil && opts.TempPolicy.removes(err) {
+			outFile.Close()
+			os.Remove(tempOutputPath)
+		}
+	}()
+	missing := missingChunks(outFile, meta, layout)
+	if len(missing) < meta.NumChunks {
+		logger.Printf("Resuming download, %d of %d chunks already present", meta.NumChunks-len(missing), meta.NumChunks)
+	}
+	if err := allocate(outFile, meta.FileSize, opts.Preallocate); err != nil {
+		return err
+	}
+	if len(missing) > 0 {
+		// An older version at outputPath may share chunks with the new one.
+		refs := opts.Local.chunks(meta.Chunking)
+		addChunkRefs(refs, fileManager.index, outputPath, meta.Chunking)
+		missing = reuseChunks(outFile, meta, layout, missing, refs, logger)
+	}
 
-	// 3. Download chunks in parallel
-	var wg sync.WaitGroup
-	chunks := make(chan int, meta.NumChunks)
+	progress := newProgressTracker(opts.Progress, fileHash, meta.FileSize, meta.NumChunks)
+	var presentBytes int64
+	isMissing := make(map[int]bool, len(missing))
+	for _, i := range missing {
+		isMissing[i] = true
+	}
 	for i := 0; i < meta.NumChunks; i++ {
+		if !isMissing[i] {
+			presentBytes += layout.length(i)
+		}
+	}
+	progress.started(meta.NumChunks-len(missing), presentBytes)
+
+	// 3. Download chunks in parallel, retrying failed ones. Failing to write
+	// is not the peers' fault, so it aborts the download.
+	ctx, abort := context.WithCancelCause(ctx)
+	defer abort(nil)
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	remaining := len(missing)
+	attempts := make(map[int]int)
+	var failed []int
+	chunks := make(chan int, len(missing))
+	for _, i := range missing {
 		chunks <- i
 	}
-	close(chunks)
+	if remaining == 0 {
+		close(chunks)
+	}
 
-	numWorkers := 10 // Concurrent downloads
-	for range numWorkers {
+	// finish records the outcome of a chunk download from peerID. Failed
+	// chunks are requeued until they run out of attempts.
+	finish := func(chunkIndex int, peerID string, err error) {
+		mu.Lock()
+		defer mu.Unlock()
+		if err != nil {
+			attempts[chunkIndex]++
+			if attempts[chunkIndex] < maxChunkAttempts && ctx.Err() == nil {
+				logger.Printf("Error downloading chunk %d: %v. Will retry.", chunkIndex, err)
+				progress.retry(chunkIndex, peerID, attempts[chunkIndex], err)
+				chunks <- chunkIndex
+				return
+			}
+			logger.Printf("Giving up on chunk %d: %v", chunkIndex, err)
+			failed = append(failed, chunkIndex)
+		}
+		remaining--
+		if remaining == 0 {
+			close(chunks)
+		}
+	}
+
+	// Each chunk is requested as soon as a peer has room for it; the pool
+	// decides how many requests run at once.
+	for chunkIndex := range chunks {
+		l, err := pool.acquire(ctx, layout.length(chunkIndex))
+		if errors.Is(err, ErrNoReachablePeers) {
+			// Retrying cannot help once every peer is gone.
+			abort(err)
+			break
+		}
+		if err != nil {
+			finish(chunkIndex, "", err)
+			continue
+		}
 		wg.Add(1)
 		go func() {
 			defer wg.Done()
-			for chunkIndex := range chunks {
-				data, err := downloadChunk(client, bestPeer, fileHash, chunkIndex)
-				if err != nil {
-					log.Printf("Error downloading chunk %d: %v. Will retry.", chunkIndex, err)
-					// A real implementation would have a retry mechanism
-					continue
-				}
-				offset := int64(chunkIndex) * int64(common.ChunkSize)
-				_, err = outFile.WriteAt(data, offset)
-				if err != nil {
-					log.Printf("Error writing chunk %d to file: %v", chunkIndex, err)
+			data, err := downloadChunk(ctx, client, l.peer, chunkPath(fileHash, meta, layout, chunkIndex))
+			if err == nil {
+				err = verifyChunk(meta, layout, chunkIndex, data)
+			}
+			pool.release(l, len(data), err)
+			if err == nil {
+				if _, werr := outFile.WriteAt(data, layout.offset(chunkIndex)); werr != nil {
+					err = fmt.Errorf("could not write to output file: %w", werr)
+					abort(err)
 				}
-				fmt.Printf("\rDownloaded chunk %d/%d", chunkIndex+1, meta.NumChunks)
 			}
+			if err == nil {
+				progress.chunkDone(chunkIndex, l.peer.ID, len(data))
+			}
+			finish(chunkIndex, l.peer.ID, err)
 		}()
 	}
 	wg.Wait()
-	fmt.Println("\nDownload complete.")
+	if ctx.Err() != nil {
+		return context.Cause(ctx)
+	}
+	if len(failed) > 0 {
+		return &ChunksFailedError{Chunks: failed}
+	}
 
-	// 4. Rename file and add to file manager
-	if err := os.Rename(tempOutputPath, outputPath); err != nil {
-		return fmt.Errorf("failed to rename temp file: %w", err)
+	// 4. Verify the file and move it into place
+	if err := complete(outFile, tempOutputPath, outputPath, fileHash, fileManager, progress); err != nil {
+		return err
 	}
-	fileManager.AddFile(outputPath)
 
-	// 5. Verify final file hash
-	finalHash, err := HashFile(outputPath)
+	logger.Printf("File verified successfully. Saved to %s", outputPath)
+	return nil
+}
+
+// reuseFile completes a download from the local file f instead of peers.
+// The copy is made next to the temp file of the download, which is only
+// removed once the copy is in place, so a failed attempt can still resume.
+func reuseFile(f localFile, fileHash, outputPath string, fileManager *FileManager, opts DownloadOptions) error {
+	tempPath := outputPath + ".local.tmp"
+	if err := copyLocal(f.path, tempPath, opts.HardLink); err != nil {
+		return err
+	}
+	file, err := os.OpenFile(tempPath, os.O_RDWR, 0)
 	if err != nil {
-		return fmt.Errorf("could not hash final file: %w", err)
+		return err
 	}
-	if finalHash != fileHash {
-		return fmt.Errorf("file hash mismatch! Expected %s, got %s", fileHash, finalHash)
+	defer file.Close()
+	progress := newProgressTracker(opts.Progress, fileHash, f.meta.FileSize, f.meta.NumChunks)
+	progress.started(f.meta.NumChunks, f.meta.FileSize)
+	if err := complete(file, tempPath, outputPath, fileHash, fileManager, progress); err != nil {
+		file.Close()
+		os.Remove(tempPath)
+		return err
 	}
-
-	log.Printf("File verified successfully. Saved to %s", outputPath)
+	os.Remove(TempPath(outputPath))
 	return nil
 }
 
-func findBestPeer(peers []common.PeerInfo) (common.PeerInfo, float64, error) {
-	client, err := createQUICClient()
+// complete verifies the data in file, at tempPath, as it is on disk and only
+// then moves it durably to outputPath and shares it, reusing the hashes.
+func complete(file *os.File, tempPath, outputPath, fileHash string, fileManager *FileManager, progress *progressTracker) error {
+	if err := file.Sync(); err != nil {
+		return fmt.Errorf("could not sync output file: %w", err)
+	}
+	final, err := GetFileMetadata(tempPath, fileManager.index.chunkingMode())
+	if err != nil {
+		err = fmt.Errorf("could not hash downloaded file: %w", err)
+	} else if final.FileHash != fileHash {
+		err = &HashMismatchError{Expected: fileHash, Got: final.FileHash}
+	}
+	progress.verified(err)
 	if err != nil {
-		return common.PeerInfo{}, 0, err
+		return err
 	}
 
-	speeds := make(chan peerSpeed, len(peers))
-	var wg sync.WaitGroup
+	if err := file.Close(); err != nil {
+		return fmt.Errorf("could not close output file: %w", err)
+	}
+	if err := os.Rename(tempPath, outputPath); err != nil {
+		return fmt.Errorf("failed to rename temp file: %w", err)
+	}
+	if err := syncDir(filepath.Dir(outputPath)); err != nil {
+		return fmt.Errorf("could not sync output directory: %w", err)
+	}
+	final.FileName = filepath.Base(outputPath)
+	if err := fileManager.addHashed(outputPath, final); err != nil {
+		return fmt.Errorf("could not share downloaded file: %w", err)
+	}
+	return nil
+}
 
-	for _, p := range peers {
-		wg.Add(1)
-		go func(peer common.PeerInfo) {
-			defer wg.Done()
-			start := time.Now()
-			req, _ := http.NewRequest("GET", fmt.Sprintf("https://%s:%d/speedtest", peer.IP, peer.Port), nil)
-			resp, err := client.Do(req)
-			if err != nil {
-				log.Printf("Speed test failed for peer %s: %v", peer.ID, err)
-				return
-			}
-			defer resp.Body.Close()
+// allocate sizes file to size bytes, first checking that the disk has room
+// for the part not yet written. With reserve the space is also preallocated,
+// so that a full disk cannot interrupt the download later.
+func allocate(file *os.File, size int64, reserve bool) error {
+	stat, err := file.Stat()
+	if err != nil {
+		return err
+	}
+	need := size - allocatedSize(stat)
+	if free, err := freeSpace(filepath.Dir(file.Name())); err == nil && need > free {
+		return &InsufficientSpaceError{Path: file.Name(), Need: need, Free: free}
+	}
+	if err := file.Truncate(size); err != nil {
+		return fmt.Errorf("could not resize output file: %w", err)
+	}
+	if reserve {
+		if err := preallocate(file, size); err != nil {
+			return fmt.Errorf("could not preallocate output file: %w", err)
+		}
+	}
+	return nil
+}
 
-			body, err := io.ReadAll(resp.Body)
-			if err != nil {
-				log.Printf("Failed to read speed test response from %s: %v", peer.ID, err)
-				return
+// missingChunks returns the indexes of chunks not yet correctly written to
+// file. Without chunk hashes to check against, every chunk is missing.
+func missingChunks(file *os.File, meta *common.FileMetadata, layout chunkLayout) []int {
+	var missing []int
+	stat, err := file.Stat()
+	canResume := err == nil && stat.Size() > 0 && len(meta.ChunkHashes) == meta.NumChunks
+	buffer := make([]byte, cdcMaxSize)
+	for i := 0; i < meta.NumChunks; i++ {
+		if canResume {
+			n, err := file.ReadAt(buffer[:layout.length(i)], layout.offset(i))
+			if err == nil || err == io.EOF {
+				sum := sha256.Sum256(buffer[:n])
+				if hex.EncodeToString(sum[:]) == meta.ChunkHashes[i] {
+					continue
+				}
 			}
-			duration := time.Since(start)
-			mbps := (float64(len(body)) * 8) / (1024 * 1024) / duration.Seconds()
-			log.Printf("Peer @ %s speed: %.2f Mbps", peer.IP, mbps)
-			speeds <- peerSpeed{peer: peer, mbps: mbps}
-		}(p)
+		}
+		missing = append(missing, i)
 	}
-	wg.Wait()
-	close(speeds)
+	return missing
+}
 
-	var sortedSpeeds []peerSpeed
-	for s := range speeds {
-		sortedSpeeds = append(sortedSpeeds, s)
+// verifyChunk checks downloaded chunk data against the chunk hashes in meta,
+// when the peer provided them.
+func verifyChunk(meta *common.FileMetadata, layout chunkLayout, chunkIndex int, data []byte) error {
+	if int64(len(data)) != layout.length(chunkIndex) {
+		return fmt.Errorf("%w: %d bytes, expected %d", errCorrupt, len(data), layout.length(chunkIndex))
 	}
-	if len(sortedSpeeds) == 0 {
-		return common.PeerInfo{}, 0, fmt.Errorf("all peers failed the speed test")
+	if len(meta.ChunkHashes) != meta.NumChunks {
+		return nil
 	}
+	sum := sha256.Sum256(data)
+	if hex.EncodeToString(sum[:]) != meta.ChunkHashes[chunkIndex] {
+		return fmt.Errorf("%w: hash mismatch", errCorrupt)
+	}
+	return nil
+}
 
-	// Sort by speed, descending
-	sort.Slice(sortedSpeeds, func(i, j int) bool {
-		return sortedSpeeds[i].mbps > sortedSpeeds[j].mbps
-	})
+// chunkPath returns the peer API path of chunk i. Fixed-size chunks are
+// asked for by index, content-defined ones by their byte range, which any
+// peer with the file can serve however it split the file itself.
+func chunkPath(fileHash string, meta *common.FileMetadata, layout chunkLayout, i int) string {
+	if meta.Chunking == common.ChunkingFixed {
+		return fmt.Sprintf("/chunk/%s/%d", fileHash, i)
+	}
+	return fmt.Sprintf("/range/%s/%d/%d", fileHash, layout.offset(i), layout.length(i))
+}
 
-	return sortedSpeeds[0].peer, sortedSpeeds[0].mbps, nil
+// fetchMetadata gets the file's metadata, and where its chunks lie, from the
+// first peer in pool that provides valid metadata.
+func fetchMetadata(ctx context.Context, client *http.Client, pool *peerPool, fileHash string) (*common.FileMetadata, chunkLayout, error) {
+	for {
+		l, err := pool.acquire(ctx, 0)
+		if err != nil {
+			return nil, nil, err
+		}
+		meta, err := getMetadataFromPeer(ctx, client, l.peer, fileHash)
+		var layout chunkLayout
+		if err == nil {
+			layout, err = newChunkLayout(meta)
+		}
+		if err != nil {
+			err = &PeerError{PeerID: l.peer.ID, Err: fmt.Errorf("failed to get metadata: %w", err)}
+		}
+		pool.release(l, 0, err)
+		if err == nil {
+			return meta, layout, nil
+		}
+		if ctx.Err() != nil {
+			return nil, nil, ctx.Err()
+		}
+	}
 }
 
-func getMetadataFromPeer(client *http.Client, peer common.PeerInfo, fileHash string) (*common.FileMetadata, error) {
-	url := fmt.Sprintf("https://%s:%d/metadata/%s", peer.IP, peer.Port, fileHash)
-	resp, err := client.Get(url)
+func getMetadataFromPeer(ctx context.Context, client *http.Client, peer common.PeerInfo, fileHash string) (*common.FileMetadata, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", peerURL(peer, "/metadata/"+fileHash), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -173,9 +433,12 @@ func getMetadataFromPeer(client *http.Client, peer common.PeerInfo, fileHash str
 	return &meta, nil
 }
 
-func downloadChunk(client *http.Client, peer common.PeerInfo, fileHash string, chunkIndex int) ([]byte, error) {
-	url := fmt.Sprintf("https://%s:%d/chunk/%s/%d", peer.IP, peer.Port, fileHash, chunkIndex)
-	resp, err := client.Get(url)
+func downloadChunk(ctx context.Context, client *http.Client, peer common.PeerInfo, path string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, "GET", peerURL(peer, path), nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := client.Do(req)
 	if err != nil {
 		return nil, err
 	}
@@ -188,14 +451,38 @@ func downloadChunk(client *http.Client, peer common.PeerInfo, fileHash string, c
 	return io.ReadAll(resp.Body)
 }
 
-func createQUICClient() (*http.Client, error) {
+// createQUICClient returns an HTTP/3 client for peers, whose connections
+// report their round-trip times to scores. If the rendezvous is ready the
+// client dials through its socket, so peers that opened their NAT for it can
+// answer. Requests to the relay go to it instead.
+func createQUICClient(opts DownloadOptions, scores *PeerScores) (*http.Client, error) {
 	tlsConfig, err := common.GenerateTLSConfig()
 	if err != nil {
 		return nil, fmt.Errorf("could not generate TLS config for client: %w", err)
 	}
-	return &http.Client{
-		Transport: &http3.Transport{
-			TLSClientConfig: tlsConfig,
-		},
-	}, nil
+	transport := &http3.Transport{
+		TLSClientConfig: tlsConfig,
+		QUICConfig:      &quic.Config{Tracer: scores.tracer},
+	}
+	if opts.Rendezvous.ready() {
+		transport.Dial = opts.Rendezvous.dial
+	}
+	if opts.Relay != nil {
+		return &http.Client{Transport: &peerTransport{quic: transport, relay: opts.Relay}}, nil
+	}
+	return &http.Client{Transport: transport}, nil
+}
+
+// peerTransport sends requests for relayed peers to the relay and all
+// others over QUIC.
+type peerTransport struct {
+	quic  http.RoundTripper
+	relay *RelayClient
+}
+
+func (t *peerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if req.URL.Host == t.relay.base.Host {
+		return t.relay.RoundTrip(req)
+	}
+	return t.quic.RoundTrip(req)
 }
@@ -0,0 +1,182 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync/atomic"
+	"testing"
+
+	"dropeer/internal/common"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/http3"
+)
+
+// startPeer serves h over QUIC on a local port until the test ends and
+// returns the peer to download from.
+func startPeer(t *testing.T, h http.Handler) common.PeerInfo {
+	t.Helper()
+	tlsConfig, err := common.GenerateTLSConfig()
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	ln, err := quic.ListenEarly(conn, http3.ConfigureTLSConfig(tlsConfig), &quic.Config{Allow0RTT: true})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := &http3.Server{Handler: h}
+	go server.ServeListener(ln)
+	t.Cleanup(func() {
+		server.Close()
+		conn.Close()
+	})
+	return common.PeerInfo{ID: "seeder", IP: "127.0.0.1", Port: conn.LocalAddr().(*net.UDPAddr).Port}
+}
+
+// seed shares data from a new file manager and returns its hash and the
+// peer API serving it.
+func seed(t *testing.T, data []byte) (string, http.Handler) {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "seeded")
+	writeFile(t, path, data)
+	logger := log.New(io.Discard, "", 0)
+	fm := NewFileManager(nil, logger)
+	hash, err := fm.AddFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return hash, NewP2PServer(fm, "", logger).Handler()
+}
+
+func testDownload(t *testing.T, fileHash, outputPath string, peer common.PeerInfo, policy TempPolicy) error {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	return DownloadFile(context.Background(), fileHash, outputPath, []common.PeerInfo{peer}, NewFileManager(nil, logger), DownloadOptions{
+		Logger:     logger,
+		TempPolicy: policy,
+	})
+}
+
+func TestDownloadFile(t *testing.T) {
+	data := randomData(1, 2*common.ChunkSize+1000)
+	hash, h := seed(t, data)
+	output := filepath.Join(t.TempDir(), "out")
+	if err := testDownload(t, hash, output, startPeer(t, h), TempResume); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != string(data) {
+		t.Error("downloaded file differs from the seeded one")
+	}
+	if _, err := os.Stat(TempPath(output)); !os.IsNotExist(err) {
+		t.Errorf("temp file left behind: %v", err)
+	}
+}
+
+func TestDownloadTempPolicy(t *testing.T) {
+	data := randomData(2, 2*common.ChunkSize+1000)
+	hash, h := seed(t, data)
+	// corrupt serves the file as if it had another hash, so every chunk
+	// verifies but the whole file does not.
+	const otherHash = "0000000000000000000000000000000000000000000000000000000000000000"
+	corrupt := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		r.URL.Path = strings.Replace(r.URL.Path, otherHash, hash, 1)
+		h.ServeHTTP(w, r)
+	})
+	// failing serves the metadata and first chunk only.
+	failing := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/chunk/") && !strings.HasSuffix(r.URL.Path, "/0") {
+			http.Error(w, "failed to read chunk", http.StatusInternalServerError)
+			return
+		}
+		h.ServeHTTP(w, r)
+	})
+
+	tests := []struct {
+		name     string
+		hash     string
+		handler  http.Handler
+		policy   TempPolicy
+		wantTemp bool
+	}{
+		{"corrupt file with TempResume", otherHash, corrupt, TempResume, false},
+		{"corrupt file with TempKeep", otherHash, corrupt, TempKeep, true},
+		{"corrupt file with TempRemove", otherHash, corrupt, TempRemove, false},
+		{"failed chunks with TempResume", hash, failing, TempResume, true},
+		{"failed chunks with TempKeep", hash, failing, TempKeep, true},
+		{"failed chunks with TempRemove", hash, failing, TempRemove, false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			output := filepath.Join(t.TempDir(), "out")
+			err := testDownload(t, tt.hash, output, startPeer(t, tt.handler), tt.policy)
+			if err == nil {
+				t.Fatal("download succeeded")
+			}
+			var mismatch *HashMismatchError
+			if errors.As(err, &mismatch) != (tt.hash == otherHash) {
+				t.Errorf("unexpected error %v", err)
+			}
+			if _, err := os.Stat(output); !os.IsNotExist(err) {
+				t.Errorf("output file exists after a failed download: %v", err)
+			}
+			_, err = os.Stat(TempPath(output))
+			if exists := err == nil; exists != tt.wantTemp {
+				t.Errorf("temp file exists = %v, want %v", exists, tt.wantTemp)
+			}
+		})
+	}
+}
+
+func TestDownloadInsufficientSpace(t *testing.T) {
+	dir := t.TempDir()
+	free, err := freeSpace(dir)
+	if err != nil {
+		t.Skipf("free space not available: %v", err)
+	}
+	if free > 1<<40 {
+		t.Skip("too much free space to exceed")
+	}
+	data := randomData(3, 1000)
+	hash, h := seed(t, data)
+	// The peer claims the file is larger than the free space.
+	var chunkRequests atomic.Int32
+	huge := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if strings.HasPrefix(r.URL.Path, "/metadata/") {
+			size := free + common.ChunkSize
+			json.NewEncoder(w).Encode(common.FileMetadata{
+				FileHash:  hash,
+				FileName:  "huge",
+				FileSize:  size,
+				NumChunks: int((size + common.ChunkSize - 1) / common.ChunkSize),
+			})
+			return
+		}
+		chunkRequests.Add(1)
+		h.ServeHTTP(w, r)
+	})
+
+	err = testDownload(t, hash, filepath.Join(dir, "out"), startPeer(t, huge), TempResume)
+	var space *InsufficientSpaceError
+	if !errors.As(err, &space) {
+		t.Fatalf("download error = %v, want InsufficientSpaceError", err)
+	}
+	if n := chunkRequests.Load(); n > 0 {
+		t.Errorf("%d chunks requested before the space check", n)
+	}
+}
@@ -0,0 +1,188 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"strconv"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// attemptDelay is how long a connection attempt to one address of a peer
+// gets before the next address is tried alongside it, as in Happy Eyeballs
+// (RFC 8305).
+const attemptDelay = 250 * time.Millisecond
+
+// peerURL returns the URL of path on peer, or on the relay peer is reached
+// through. IPv6 addresses, including link-local ones with a zone, are
+// bracketed and escaped as needed.
+func peerURL(peer common.PeerInfo, path string) string {
+	if peer.Via != "" {
+		base, _ := url.JoinPath(peer.Via, "relay", "peer", peer.ID)
+		return base + path
+	}
+	u := url.URL{
+		Scheme: "https",
+		Host:   net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port)),
+		Path:   path,
+	}
+	return u.String()
+}
+
+// peerAddrs returns the addresses of peer to try, in order. The primary
+// address comes first, then the others alternating between IPv6 and IPv4.
+func peerAddrs(peer common.PeerInfo) []string {
+	seen := map[string]bool{peer.IP: true}
+	var v6, v4 []string
+	for _, a := range peer.Addrs {
+		addr, err := netip.ParseAddr(a)
+		if err != nil || seen[a] {
+			continue
+		}
+		seen[a] = true
+		if addr.Is4() || addr.Is4In6() {
+			v4 = append(v4, a)
+		} else {
+			v6 = append(v6, a)
+		}
+	}
+	addrs := []string{peer.IP}
+	for len(v6) > 0 || len(v4) > 0 {
+		if len(v6) > 0 {
+			addrs, v6 = append(addrs, v6[0]), v6[1:]
+		}
+		if len(v4) > 0 {
+			addrs, v4 = append(addrs, v4[0]), v4[1:]
+		}
+	}
+	return addrs
+}
+
+// connectPeer finds an address at which peer answers. Addresses are tried in
+// the order of peerAddrs, starting the next one when the previous fails or
+// after attemptDelay, and the first to answer wins. If the options allow,
+// hole punching through the tracker is tried next, and the relay last. The
+// returned PeerInfo has IP and Port set to the winning address, or Via set
+// to the relay.
+func connectPeer(ctx context.Context, client *http.Client, peer common.PeerInfo, opts DownloadOptions) (common.PeerInfo, error) {
+	rv := opts.Rendezvous
+	var attempts []func(context.Context) (common.PeerInfo, error)
+	for _, addr := range peerAddrs(peer) {
+		candidate := peer
+		candidate.IP = addr
+		attempts = append(attempts, func(ctx context.Context) (common.PeerInfo, error) {
+			return candidate, ping(ctx, client, candidate)
+		})
+	}
+	if rv.ready() && peer.Endpoint != "" && !hasEndpoint(peer) {
+		attempts = append(attempts, func(ctx context.Context) (common.PeerInfo, error) {
+			punched, err := rv.connect(ctx, peer)
+			if err != nil {
+				return peer, fmt.Errorf("hole punching: %w", err)
+			}
+			return punched, ping(ctx, client, punched)
+		})
+	}
+	if opts.Relay != nil && peer.Relayed {
+		attempts = append(attempts, func(ctx context.Context) (common.PeerInfo, error) {
+			select {
+			case <-time.After(relayDelay):
+			case <-ctx.Done():
+				return peer, ctx.Err()
+			}
+			relayed := peer
+			relayed.Via = opts.Relay.base.String()
+			if err := ping(ctx, client, relayed); err != nil {
+				return peer, fmt.Errorf("relay: %w", err)
+			}
+			return relayed, nil
+		})
+	}
+	if len(attempts) == 1 {
+		return peer, nil
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	type result struct {
+		peer common.PeerInfo
+		err  error
+	}
+	results := make(chan result, len(attempts))
+	next, pending := 0, 0
+	start := func() {
+		attempt := attempts[next]
+		next++
+		pending++
+		go func() {
+			p, err := attempt(ctx)
+			results <- result{peer: p, err: err}
+		}()
+	}
+
+	start()
+	timer := time.NewTimer(attemptDelay)
+	defer timer.Stop()
+	var lastErr error
+	for pending > 0 {
+		select {
+		case r := <-results:
+			pending--
+			if r.err == nil {
+				return r.peer, nil
+			}
+			lastErr = r.err
+			if next < len(attempts) {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		case <-timer.C:
+			if next < len(attempts) {
+				start()
+				timer.Reset(attemptDelay)
+			}
+		case <-ctx.Done():
+			return peer, ctx.Err()
+		}
+	}
+	if lastErr == nil {
+		lastErr = errors.New("no addresses")
+	}
+	return peer, lastErr
+}
+
+// hasEndpoint reports whether the public endpoint of peer is one of its own
+// addresses, in which case it is not behind a NAT and punching is pointless.
+func hasEndpoint(peer common.PeerInfo) bool {
+	endpoint, err := netip.ParseAddrPort(peer.Endpoint)
+	if err != nil || int(endpoint.Port()) != peer.Port {
+		return false
+	}
+	for _, a := range peerAddrs(peer) {
+		if addr, err := netip.ParseAddr(a); err == nil && addr.WithZone("").Unmap() == endpoint.Addr().Unmap() {
+			return true
+		}
+	}
+	return false
+}
+
+// ping checks that peer answers HTTP requests. Any response will do.
+func ping(ctx context.Context, client *http.Client, peer common.PeerInfo) error {
+	req, err := http.NewRequestWithContext(ctx, "GET", peerURL(peer, "/ping"), nil)
+	if err != nil {
+		return err
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"errors"
+	"os"
+	"syscall"
+)
+
+// freeSpace returns the bytes available to unprivileged users on the file
+// system holding dir.
+func freeSpace(dir string) (int64, error) {
+	var st syscall.Statfs_t
+	if err := syscall.Statfs(dir, &st); err != nil {
+		return 0, err
+	}
+	return int64(st.Bavail) * int64(st.Bsize), nil
+}
+
+// allocatedSize returns the bytes of disk actually used by a file, which is
+// less than its size if it is sparse.
+func allocatedSize(stat os.FileInfo) int64 {
+	if st, ok := stat.Sys().(*syscall.Stat_t); ok {
+		return st.Blocks * 512
+	}
+	return stat.Size()
+}
+
+// preallocate reserves disk space for the first size bytes of file, so
+// that writing them cannot fail for lack of space. It does nothing on file
+// systems that do not support it.
+func preallocate(file *os.File, size int64) error {
+	err := syscall.Fallocate(int(file.Fd()), 0, 0, size)
+	if errors.Is(err, syscall.EOPNOTSUPP) || errors.Is(err, syscall.ENOSYS) {
+		return nil
+	}
+	return err
+}
+
+// syncDir flushes dir to disk, making a file renamed into it durable.
+func syncDir(dir string) error {
+	d, err := os.Open(dir)
+	if err != nil {
+		return err
+	}
+	defer d.Close()
+	return d.Sync()
+}
+
+// reflink makes dst share the data of src without copying it, on file
+// systems that support it such as Btrfs and XFS.
+func reflink(dst, src *os.File) error {
+	const ficlone = 0x40049409 // FICLONE ioctl
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, dst.Fd(), ficlone, src.Fd()); errno != 0 {
+		return errno
+	}
+	return nil
+}
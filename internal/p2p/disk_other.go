@@ -0,0 +1,40 @@
+//go:build !linux
+
+package p2p
+
+import (
+	"errors"
+	"os"
+)
+
+// freeSpace is not available on this platform, so free space is not checked.
+func freeSpace(dir string) (int64, error) {
+	return 0, errors.ErrUnsupported
+}
+
+// allocatedSize returns the size of a file; sparse files are not detected on
+// this platform.
+func allocatedSize(stat os.FileInfo) int64 {
+	return stat.Size()
+}
+
+// preallocate is not available on this platform; space is allocated as
+// chunks are written.
+func preallocate(file *os.File, size int64) error {
+	return nil
+}
+
+// syncDir tries to flush dir to disk. Not every platform can sync a
+// directory, so failures are ignored.
+func syncDir(dir string) error {
+	if d, err := os.Open(dir); err == nil {
+		d.Sync()
+		d.Close()
+	}
+	return nil
+}
+
+// reflink is not available on this platform; files are copied instead.
+func reflink(dst, src *os.File) error {
+	return errors.ErrUnsupported
+}
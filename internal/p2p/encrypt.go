@@ -0,0 +1,196 @@
+package p2p
+
+import (
+	"bufio"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+
+	"dropeer/internal/common"
+)
+
+// KeySize is the size in bytes of the keys of encrypted files.
+const KeySize = 32
+
+// Encrypted files are split into blocks that are sealed separately with
+// AES-GCM. Plaintext blocks are sized so that each sealed block is exactly
+// one chunk, which lets a chunk be decrypted on its own. The nonce of a block
+// is its index, which is safe because every file gets a fresh key, and the
+// last block is sealed with different additional data so truncation at a
+// block boundary is detected.
+const plainBlockSize = common.ChunkSize - 16 // GCM tag size
+
+var errTruncated = errors.New("encrypted file is truncated")
+
+// DefaultEncryptedDir returns where the ciphertext of encrypted files is
+// kept in the user's cache directory.
+func DefaultEncryptedDir() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dropeer", "encrypted"), nil
+}
+
+// NewKey returns a random key for EncryptFile.
+func NewKey() ([]byte, error) {
+	key := make([]byte, KeySize)
+	if _, err := rand.Read(key); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+func newGCM(key []byte) (cipher.AEAD, error) {
+	if len(key) != KeySize {
+		return nil, fmt.Errorf("invalid key size %d", len(key))
+	}
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(block)
+}
+
+func blockNonce(gcm cipher.AEAD, index uint64) []byte {
+	nonce := make([]byte, gcm.NonceSize())
+	binary.BigEndian.PutUint64(nonce[len(nonce)-8:], index)
+	return nonce
+}
+
+func blockAD(last bool) []byte {
+	if last {
+		return []byte{1}
+	}
+	return []byte{0}
+}
+
+// readBlock fills buf from r and reports whether it was the last block.
+func readBlock(r *bufio.Reader, buf []byte) (int, bool, error) {
+	n, err := io.ReadFull(r, buf)
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return n, true, nil
+	}
+	if err != nil {
+		return n, false, err
+	}
+	if _, err := r.Peek(1); err == io.EOF {
+		return n, true, nil
+	} else if err != nil {
+		return n, false, err
+	}
+	return n, false, nil
+}
+
+// EncryptFile encrypts the file at src with key into dir. The ciphertext is
+// named after its hash, which is returned with its path.
+func EncryptFile(src, dir string, key []byte) (path, hash string, err error) {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return "", "", err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return "", "", err
+	}
+	defer in.Close()
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", "", err
+	}
+	out, err := os.CreateTemp(dir, "encrypt-*.tmp")
+	if err != nil {
+		return "", "", err
+	}
+	defer os.Remove(out.Name())
+	defer out.Close()
+
+	h := sha256.New()
+	w := io.MultiWriter(out, h)
+	r := bufio.NewReaderSize(in, plainBlockSize)
+	buf := make([]byte, plainBlockSize)
+	sealed := make([]byte, 0, common.ChunkSize)
+	for index := uint64(0); ; index++ {
+		n, last, err := readBlock(r, buf)
+		if err != nil {
+			return "", "", err
+		}
+		sealed = gcm.Seal(sealed[:0], blockNonce(gcm, index), buf[:n], blockAD(last))
+		if _, err := w.Write(sealed); err != nil {
+			return "", "", err
+		}
+		if last {
+			break
+		}
+	}
+	if err := out.Close(); err != nil {
+		return "", "", err
+	}
+
+	hash = hex.EncodeToString(h.Sum(nil))
+	path = filepath.Join(dir, hash)
+	if err := os.Rename(out.Name(), path); err != nil {
+		return "", "", err
+	}
+	return path, hash, nil
+}
+
+// DecryptFile decrypts the file at src, created by EncryptFile, to dst.
+func DecryptFile(src, dst string, key []byte) error {
+	gcm, err := newGCM(key)
+	if err != nil {
+		return err
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	tmpPath := TempPath(dst)
+	out, err := os.Create(tmpPath)
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmpPath)
+	defer out.Close()
+
+	r := bufio.NewReaderSize(in, common.ChunkSize)
+	buf := make([]byte, common.ChunkSize)
+	plain := make([]byte, 0, plainBlockSize)
+	for index := uint64(0); ; index++ {
+		n, last, err := readBlock(r, buf)
+		if err != nil {
+			return err
+		}
+		if n == 0 {
+			return errTruncated
+		}
+		plain, err = gcm.Open(plain[:0], blockNonce(gcm, index), buf[:n], blockAD(last))
+		if err != nil {
+			if last {
+				// The block may be intact but not the one sealed as last.
+				if _, err := gcm.Open(nil, blockNonce(gcm, index), buf[:n], blockAD(false)); err == nil {
+					return errTruncated
+				}
+			}
+			return fmt.Errorf("could not decrypt block %d: wrong key or corrupt data", index)
+		}
+		if _, err := out.Write(plain); err != nil {
+			return err
+		}
+		if last {
+			break
+		}
+	}
+	if err := out.Close(); err != nil {
+		return err
+	}
+	return os.Rename(tmpPath, dst)
+}
@@ -0,0 +1,168 @@
+package p2p
+
+import (
+	"bytes"
+	"errors"
+	"math/rand/v2"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"dropeer/internal/common"
+)
+
+// randomData returns n pseudo-random bytes that are the same for each seed.
+func randomData(seed byte, n int) []byte {
+	data := make([]byte, n)
+	rand.NewChaCha8([32]byte{seed}).Read(data)
+	return data
+}
+
+// encryptTemp encrypts data with key and returns the ciphertext's path.
+func encryptTemp(t *testing.T, data, key []byte) string {
+	t.Helper()
+	dir := t.TempDir()
+	src := filepath.Join(dir, "plain")
+	if err := os.WriteFile(src, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+	path, hash, err := EncryptFile(src, filepath.Join(dir, "enc"), key)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := HashFile(path); err != nil || got != hash {
+		t.Fatalf("ciphertext hash %s, EncryptFile returned %s (%v)", got, hash, err)
+	}
+	return path
+}
+
+func TestEncryptRoundTrip(t *testing.T) {
+	sizes := []struct {
+		name string
+		size int
+	}{
+		{"empty", 0},
+		{"small", 100},
+		{"one block", plainBlockSize},
+		{"one block plus one", plainBlockSize + 1},
+		{"several blocks", 3*plainBlockSize + 12345},
+	}
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tt := range sizes {
+		t.Run(tt.name, func(t *testing.T) {
+			data := randomData(5, tt.size)
+			enc := encryptTemp(t, data, key)
+			stat, err := os.Stat(enc)
+			if err != nil {
+				t.Fatal(err)
+			}
+			// Every sealed block but the last is exactly one chunk.
+			if blocks := max((tt.size+plainBlockSize-1)/plainBlockSize, 1); stat.Size() != int64(tt.size+16*blocks) {
+				t.Errorf("ciphertext is %d bytes, want %d", stat.Size(), tt.size+16*blocks)
+			}
+
+			dst := filepath.Join(t.TempDir(), "out")
+			if err := DecryptFile(enc, dst, key); err != nil {
+				t.Fatal(err)
+			}
+			got, err := os.ReadFile(dst)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !bytes.Equal(got, data) {
+				t.Error("decrypted data differs from the original")
+			}
+		})
+	}
+}
+
+func TestDecryptDetectsTampering(t *testing.T) {
+	key, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := NewKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := randomData(6, 2*plainBlockSize+500)
+
+	tests := []struct {
+		name      string
+		key       []byte
+		tamper    func(enc []byte) []byte
+		truncated bool
+	}{
+		{
+			name: "wrong key",
+			key:  otherKey,
+		},
+		{
+			name:   "flipped bit",
+			tamper: func(enc []byte) []byte { enc[common.ChunkSize+10] ^= 1; return enc },
+		},
+		{
+			name:      "truncated at block boundary",
+			tamper:    func(enc []byte) []byte { return enc[:2*common.ChunkSize] },
+			truncated: true,
+		},
+		{
+			name:   "truncated mid block",
+			tamper: func(enc []byte) []byte { return enc[:common.ChunkSize+100] },
+		},
+		{
+			name:      "empty",
+			tamper:    func(enc []byte) []byte { return nil },
+			truncated: true,
+		},
+		{
+			name: "blocks swapped",
+			tamper: func(enc []byte) []byte {
+				first := append([]byte{}, enc[:common.ChunkSize]...)
+				copy(enc, enc[common.ChunkSize:2*common.ChunkSize])
+				copy(enc[common.ChunkSize:], first)
+				return enc
+			},
+		},
+		{
+			name:   "block appended",
+			tamper: func(enc []byte) []byte { return append(enc, enc[:common.ChunkSize]...) },
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			enc := encryptTemp(t, data, key)
+			if tt.tamper != nil {
+				ciphertext, err := os.ReadFile(enc)
+				if err != nil {
+					t.Fatal(err)
+				}
+				if err := os.WriteFile(enc, tt.tamper(ciphertext), 0o644); err != nil {
+					t.Fatal(err)
+				}
+			}
+			decryptKey := key
+			if tt.key != nil {
+				decryptKey = tt.key
+			}
+
+			dst := filepath.Join(t.TempDir(), "out")
+			err := DecryptFile(enc, dst, decryptKey)
+			if err == nil {
+				t.Fatal("DecryptFile succeeded on tampered data")
+			}
+			if tt.truncated && !errors.Is(err, errTruncated) {
+				t.Errorf("got error %v, want %v", err, errTruncated)
+			}
+			if _, err := os.Stat(dst); !os.IsNotExist(err) {
+				t.Error("output file was created")
+			}
+			if _, err := os.Stat(TempPath(dst)); !os.IsNotExist(err) {
+				t.Error("temp file was left behind")
+			}
+		})
+	}
+}
@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrNoPeers is returned when there are no peers to download a file from.
+	ErrNoPeers = errors.New("no peers found")
+	// ErrNoReachablePeers is returned when none of the peers could be reached.
+	ErrNoReachablePeers = errors.New("none of the peers could be reached")
+)
+
+// PeerError reports a failed request to a peer.
+type PeerError struct {
+	PeerID string
+	Err    error
+}
+
+func (e *PeerError) Error() string {
+	return fmt.Sprintf("peer %s: %v", e.PeerID, e.Err)
+}
+
+func (e *PeerError) Unwrap() error { return e.Err }
+
+// ChunksFailedError is returned when some chunks could not be downloaded.
+type ChunksFailedError struct {
+	Chunks []int
+}
+
+func (e *ChunksFailedError) Error() string {
+	return fmt.Sprintf("%d chunks could not be downloaded", len(e.Chunks))
+}
+
+// HashMismatchError is returned when a downloaded file does not match the
+// requested hash.
+type HashMismatchError struct {
+	Expected string
+	Got      string
+}
+
+func (e *HashMismatchError) Error() string {
+	return fmt.Sprintf("file hash mismatch! Expected %s, got %s", e.Expected, e.Got)
+}
+
+// InsufficientSpaceError is returned when there is not enough free disk
+// space for a download.
+type InsufficientSpaceError struct {
+	Path string
+	Need int64 // bytes still to be written
+	Free int64
+}
+
+func (e *InsufficientSpaceError) Error() string {
+	return fmt.Sprintf("not enough disk space for %s: need %d bytes, %d free", e.Path, e.Need, e.Free)
+}
@@ -1,20 +1,33 @@
 package p2p
 
 import (
+	"context"
 	"crypto/sha256"
 	"encoding/hex"
 	"io"
+	"log"
 	"os"
 	"path/filepath"
+	"sort"
 	"sync"
+	"time"
 
 	"dropeer/internal/common"
 )
 
-// NewFileManager creates a new file manager.
-func NewFileManager() *FileManager {
+// NewFileManager creates a new file manager. Hashes are cached in index;
+// a nil index keeps them in memory only. A nil logger logs to the standard logger.
+func NewFileManager(index *HashIndex, logger common.Logger) *FileManager {
+	if logger == nil {
+		logger = log.Default()
+	}
+	if index == nil {
+		index, _ = OpenHashIndex("", logger)
+	}
 	return &FileManager{
-		files:     make(map[string]string),
+		index:     index,
+		logger:    logger,
+		files:     make(map[string]sharedFile),
 		downloads: &sync.Map{},
 	}
 }
@@ -22,26 +35,206 @@ func NewFileManager() *FileManager {
 // FileManager keeps track of local files being shared.
 type FileManager struct {
 	mu        sync.RWMutex
-	files     map[string]string // fileHash -> filePath
-	downloads *sync.Map         // fileHash -> DownloadState
+	index     *HashIndex
+	logger    common.Logger
+	files     map[string]sharedFile // fileHash -> sharedFile
+	downloads *sync.Map             // fileHash -> DownloadState
+	onChange  func(oldHash string, meta *common.FileMetadata)
+}
+
+// checkInterval is how long Check trusts a shared file to be unchanged
+// after it last looked at the file on disk.
+const checkInterval = time.Second
+
+type sharedFile struct {
+	path    string
+	meta    *common.FileMetadata
+	stat    os.FileInfo // stat the metadata was computed from
+	checked time.Time   // when the file was last found unchanged
+}
+
+// changed reports whether the file on disk no longer matches its metadata.
+func (f sharedFile) changed() bool {
+	stat, err := os.Stat(f.path)
+	if err != nil {
+		return true
+	}
+	return stat.Size() != f.stat.Size() || !stat.ModTime().Equal(f.stat.ModTime()) || fileInode(stat) != fileInode(f.stat)
 }
 
 func (fm *FileManager) AddFile(filePath string) (string, error) {
-	hash, err := HashFile(filePath)
+	meta, stat, err := fm.index.metadataWithStat(filePath)
 	if err != nil {
 		return "", err
 	}
 	fm.mu.Lock()
-	fm.files[hash] = filePath
+	fm.files[meta.FileHash] = sharedFile{path: filePath, meta: meta, stat: stat}
+	fm.mu.Unlock()
+	return meta.FileHash, nil
+}
+
+// addHashed shares the file at filePath, whose metadata the caller has just
+// computed, without hashing it again.
+func (fm *FileManager) addHashed(filePath string, meta *common.FileMetadata) error {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return err
+	}
+	stat, err := os.Stat(absPath)
+	if err != nil {
+		return err
+	}
+	fm.index.put(absPath, stat, meta)
+	fm.mu.Lock()
+	fm.files[meta.FileHash] = sharedFile{path: filePath, meta: meta, stat: stat}
+	fm.mu.Unlock()
+	return nil
+}
+
+// FlushIndex saves the hashes computed since the hash index was last saved.
+func (fm *FileManager) FlushIndex() error {
+	return fm.index.Flush()
+}
+
+// SetChunking sets how files are split into chunks when they are hashed.
+// Files shared before keep their chunks until they are rehashed.
+func (fm *FileManager) SetChunking(chunking common.Chunking) {
+	fm.index.SetChunking(chunking)
+}
+
+// setName changes the file name given to peers for the shared file with the
+// given hash.
+func (fm *FileManager) setName(hash, name string) {
+	fm.mu.Lock()
+	defer fm.mu.Unlock()
+	if f, ok := fm.files[hash]; ok {
+		meta := *f.meta
+		meta.FileName = name
+		f.meta = &meta
+		fm.files[hash] = f
+	}
+}
+
+// RemoveFile stops sharing the file with the given hash.
+func (fm *FileManager) RemoveFile(hash string) {
+	fm.mu.Lock()
+	delete(fm.files, hash)
+	fm.mu.Unlock()
+}
+
+// SharedPaths returns the paths of all shared files mapped to their hashes.
+func (fm *FileManager) SharedPaths() map[string]string {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	paths := make(map[string]string, len(fm.files))
+	for hash, f := range fm.files {
+		paths[f.path] = hash
+	}
+	return paths
+}
+
+// OnChange registers a function called when a shared file is modified or
+// removed. meta holds the file's new metadata, or is nil if the file is gone
+// or could not be rehashed.
+func (fm *FileManager) OnChange(fn func(oldHash string, meta *common.FileMetadata)) {
+	fm.mu.Lock()
+	fm.onChange = fn
+	fm.mu.Unlock()
+}
+
+// Hashes returns the hashes of all shared files.
+func (fm *FileManager) Hashes() []string {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	hashes := make([]string, 0, len(fm.files))
+	for hash := range fm.files {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// Check verifies that the file shared under hash is unchanged on disk, at
+// most once per checkInterval. A changed file is withdrawn at once and false
+// is returned so that stale data is never served under the old hash; it is
+// rehashed under its new hash in the background.
+func (fm *FileManager) Check(hash string) bool {
+	fm.mu.RLock()
+	f, ok := fm.files[hash]
+	fm.mu.RUnlock()
+	if !ok {
+		return false
+	}
+	if time.Since(f.checked) < checkInterval {
+		return true
+	}
+	changed := f.changed()
+
+	fm.mu.Lock()
+	cur, ok := fm.files[hash]
+	if !ok {
+		// Another caller already handled this change.
+		fm.mu.Unlock()
+		return false
+	}
+	if !changed {
+		cur.checked = time.Now()
+		fm.files[hash] = cur
+		fm.mu.Unlock()
+		return true
+	}
+	delete(fm.files, hash)
+	onChange := fm.onChange
 	fm.mu.Unlock()
-	return hash, nil
+
+	fm.logger.Printf("Shared file %s changed on disk, withdrawing %s", f.path, hash[:10])
+	go fm.rehash(f.path, hash, onChange)
+	return false
+}
+
+// rehash shares the changed file at path under its new hash and reports the
+// change to onChange.
+func (fm *FileManager) rehash(path, oldHash string, onChange func(string, *common.FileMetadata)) {
+	var meta *common.FileMetadata
+	if newHash, err := fm.AddFile(path); err != nil {
+		fm.logger.Printf("Could not rehash %s: %v", path, err)
+	} else {
+		meta, _ = fm.GetMetadata(newHash)
+	}
+	if onChange != nil {
+		onChange(oldHash, meta)
+	}
+}
+
+// Watch checks all shared files for modification every interval until ctx is done.
+func (fm *FileManager) Watch(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, hash := range fm.Hashes() {
+				fm.Check(hash)
+			}
+		}
+	}
 }
 
 func (fm *FileManager) GetFilePath(hash string) (string, bool) {
 	fm.mu.RLock()
 	defer fm.mu.RUnlock()
-	path, ok := fm.files[hash]
-	return path, ok
+	f, ok := fm.files[hash]
+	return f.path, ok
+}
+
+// GetMetadata returns the cached metadata of a shared file.
+func (fm *FileManager) GetMetadata(hash string) (*common.FileMetadata, bool) {
+	fm.mu.RLock()
+	defer fm.mu.RUnlock()
+	f, ok := fm.files[hash]
+	return f.meta, ok
 }
 
 // HashFile computes the SHA256 hash of a file.
@@ -59,46 +252,57 @@ func HashFile(path string) (string, error) {
 	return hex.EncodeToString(hash.Sum(nil)), nil
 }
 
-// GetFileMetadata generates metadata for a given file.
-func GetFileMetadata(filePath string) (*common.FileMetadata, error) {
-	stat, err := os.Stat(filePath)
+// GetFileMetadata generates metadata for a given file, split into chunks as
+// chunking says, hashing the whole file and each of its chunks in a single
+// pass.
+func GetFileMetadata(filePath string, chunking common.Chunking) (*common.FileMetadata, error) {
+	file, err := os.Open(filePath)
 	if err != nil {
 		return nil, err
 	}
+	defer file.Close()
 
-	hash, err := HashFile(filePath)
+	stat, err := file.Stat()
 	if err != nil {
 		return nil, err
 	}
 
-	return &common.FileMetadata{
-		FileName:  filepath.Base(filePath),
-		FileSize:  stat.Size(),
-		FileHash:  hash,
-		ChunkSize: common.ChunkSize,
-		NumChunks: int((stat.Size() + int64(common.ChunkSize) - 1) / int64(common.ChunkSize)),
-	}, nil
-}
-
-// ReadChunk reads a specific chunk from a file.
-func ReadChunk(filePath string, chunkIndex int) ([]byte, error) {
-	file, err := os.Open(filePath)
-	if err != nil {
-		return nil, err
+	fileHash := sha256.New()
+	var chunkHashes []string
+	var chunkSizes []int64
+	next := newChunker(file, chunking)
+	for {
+		chunk, err := next()
+		if len(chunk) > 0 {
+			fileHash.Write(chunk)
+			sum := sha256.Sum256(chunk)
+			chunkHashes = append(chunkHashes, hex.EncodeToString(sum[:]))
+			chunkSizes = append(chunkSizes, int64(len(chunk)))
+		}
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, err
+		}
 	}
-	defer file.Close()
 
-	offset := int64(chunkIndex * common.ChunkSize)
-	_, err = file.Seek(offset, 0)
-	if err != nil {
-		return nil, err
+	meta := &common.FileMetadata{
+		FileName:    filepath.Base(filePath),
+		FileSize:    stat.Size(),
+		FileHash:    hex.EncodeToString(fileHash.Sum(nil)),
+		ChunkSize:   common.ChunkSize,
+		NumChunks:   len(chunkHashes),
+		ChunkHashes: chunkHashes,
+		Chunking:    chunking,
 	}
-
-	buffer := make([]byte, common.ChunkSize)
-	n, err := file.Read(buffer)
-	if err != nil && err != io.EOF {
-		return nil, err
+	if chunking == common.ChunkingCDC {
+		meta.ChunkSizes = chunkSizes
 	}
+	return meta, nil
+}
 
-	return buffer[:n], nil
+// ReadChunk reads a specific fixed-size chunk from a file.
+func ReadChunk(filePath string, chunkIndex int) ([]byte, error) {
+	return ReadRange(filePath, int64(chunkIndex)*common.ChunkSize, common.ChunkSize)
 }
@@ -0,0 +1,200 @@
+package p2p
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// HashIndex is a persistent cache of file metadata keyed by path, size,
+// mtime and inode, so unchanged files are not rehashed across restarts.
+// Changes are written out indexSaveDelay after the first unsaved one, so
+// hashing many files does not rewrite the index for each; Flush writes them
+// at once.
+type HashIndex struct {
+	mu       sync.Mutex
+	path     string                // index file on disk, empty for in-memory only
+	entries  map[string]indexEntry // absolute file path -> entry
+	chunking common.Chunking       // how files are split when hashed
+	pending  *time.Timer           // set while changes are waiting to be saved
+	logger   common.Logger
+}
+
+// indexSaveDelay is how long changes to the index may go unsaved.
+const indexSaveDelay = 5 * time.Second
+
+type indexEntry struct {
+	Size    int64               `json:"size"`
+	ModTime time.Time           `json:"mod_time"`
+	Inode   uint64              `json:"inode"`
+	Meta    common.FileMetadata `json:"meta"`
+}
+
+// DefaultIndexPath returns the location of the hash index in the user's cache directory.
+func DefaultIndexPath() (string, error) {
+	dir, err := os.UserCacheDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, "dropeer", "index.json"), nil
+}
+
+// OpenHashIndex loads the index stored at path, leaving out files that no
+// longer exist. A missing file yields an empty index. An empty path gives an
+// index that is never persisted. A nil logger logs to the standard logger.
+func OpenHashIndex(path string, logger common.Logger) (*HashIndex, error) {
+	if logger == nil {
+		logger = log.Default()
+	}
+	idx := &HashIndex{
+		path:    path,
+		entries: make(map[string]indexEntry),
+		logger:  logger,
+	}
+	if path == "" {
+		return idx, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return idx, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &idx.entries); err != nil {
+		return nil, fmt.Errorf("corrupt hash index %s: %w", path, err)
+	}
+	idx.prune()
+	return idx, nil
+}
+
+// Metadata returns the metadata for filePath, hashing the file only if it is
+// not in the index or has changed since it was indexed.
+func (idx *HashIndex) Metadata(filePath string) (*common.FileMetadata, error) {
+	meta, _, err := idx.metadataWithStat(filePath)
+	return meta, err
+}
+
+// SetChunking sets how files hashed from now on are split into chunks.
+// Indexed files split another way are rehashed when next looked up.
+func (idx *HashIndex) SetChunking(chunking common.Chunking) {
+	idx.mu.Lock()
+	idx.chunking = chunking
+	idx.mu.Unlock()
+}
+
+func (idx *HashIndex) chunkingMode() common.Chunking {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	return idx.chunking
+}
+
+// metadataWithStat is like Metadata but also returns the file info the
+// metadata corresponds to.
+func (idx *HashIndex) metadataWithStat(filePath string) (*common.FileMetadata, os.FileInfo, error) {
+	return idx.metadataChunked(filePath, idx.chunkingMode())
+}
+
+// metadataChunked is like metadataWithStat but splits the file as chunking
+// says rather than as the index does.
+func (idx *HashIndex) metadataChunked(filePath string, chunking common.Chunking) (*common.FileMetadata, os.FileInfo, error) {
+	absPath, err := filepath.Abs(filePath)
+	if err != nil {
+		return nil, nil, err
+	}
+	stat, err := os.Stat(absPath)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	idx.mu.Lock()
+	entry, ok := idx.entries[absPath]
+	idx.mu.Unlock()
+	if ok && entry.matches(stat) && entry.Meta.Chunking == chunking {
+		meta := entry.Meta
+		return &meta, stat, nil
+	}
+
+	meta, err := GetFileMetadata(absPath, chunking)
+	if err != nil {
+		return nil, nil, err
+	}
+	idx.put(absPath, stat, meta)
+	return meta, stat, nil
+}
+
+// put records meta as the metadata of the file at absPath with info stat
+// and schedules a save.
+func (idx *HashIndex) put(absPath string, stat os.FileInfo, meta *common.FileMetadata) {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	idx.entries[absPath] = indexEntry{
+		Size:    stat.Size(),
+		ModTime: stat.ModTime(),
+		Inode:   fileInode(stat),
+		Meta:    *meta,
+	}
+	if idx.path != "" && idx.pending == nil {
+		idx.pending = time.AfterFunc(indexSaveDelay, func() {
+			if err := idx.Flush(); err != nil {
+				idx.logger.Printf("Could not save hash index: %v", err)
+			}
+		})
+	}
+}
+
+// Flush saves any changes to the index that are waiting to be saved.
+func (idx *HashIndex) Flush() error {
+	idx.mu.Lock()
+	defer idx.mu.Unlock()
+	if idx.pending == nil {
+		return nil
+	}
+	idx.pending.Stop()
+	idx.pending = nil
+	return idx.save()
+}
+
+func (e indexEntry) matches(stat os.FileInfo) bool {
+	return e.Size == stat.Size() && e.ModTime.Equal(stat.ModTime()) && e.Inode == fileInode(stat)
+}
+
+// prune drops the entries of files that no longer exist, so the index does
+// not grow with every file ever hashed. The caller must hold idx.mu, or be
+// the only user of idx.
+func (idx *HashIndex) prune() {
+	for path := range idx.entries {
+		if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+			delete(idx.entries, path)
+		}
+	}
+}
+
+// save writes the index to disk, without the entries of files that no
+// longer exist. The caller must hold idx.mu.
+func (idx *HashIndex) save() error {
+	if idx.path == "" {
+		return nil
+	}
+	idx.prune()
+	data, err := json.Marshal(idx.entries)
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(idx.path), 0o755); err != nil {
+		return err
+	}
+	tmp := idx.path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, idx.path)
+}
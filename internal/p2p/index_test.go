@@ -0,0 +1,181 @@
+package p2p
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+func TestHashIndexStaleness(t *testing.T) {
+	tests := []struct {
+		name   string
+		change func(t *testing.T, idx *HashIndex, path string)
+		stale  bool // whether the index should notice the change
+	}{
+		{
+			name:   "unchanged",
+			change: func(t *testing.T, idx *HashIndex, path string) {},
+		},
+		{
+			name: "content changed, same size and mtime",
+			change: func(t *testing.T, idx *HashIndex, path string) {
+				// Not noticed: the index trusts size, mtime and inode.
+				stat, _ := os.Stat(path)
+				writeFile(t, path, []byte("HELLO WORLD"))
+				os.Chtimes(path, stat.ModTime(), stat.ModTime())
+			},
+		},
+		{
+			name: "size changed",
+			change: func(t *testing.T, idx *HashIndex, path string) {
+				stat, _ := os.Stat(path)
+				writeFile(t, path, []byte("hello world, again"))
+				os.Chtimes(path, stat.ModTime(), stat.ModTime())
+			},
+			stale: true,
+		},
+		{
+			name: "mtime changed",
+			change: func(t *testing.T, idx *HashIndex, path string) {
+				writeFile(t, path, []byte("HELLO WORLD"))
+				os.Chtimes(path, time.Now().Add(time.Hour), time.Now().Add(time.Hour))
+			},
+			stale: true,
+		},
+		{
+			name: "replaced by another file",
+			change: func(t *testing.T, idx *HashIndex, path string) {
+				stat, _ := os.Stat(path)
+				other := path + ".new"
+				writeFile(t, other, []byte("HELLO WORLD"))
+				os.Chtimes(other, stat.ModTime(), stat.ModTime())
+				if err := os.Rename(other, path); err != nil {
+					t.Fatal(err)
+				}
+			},
+			stale: true,
+		},
+		{
+			name: "chunking changed",
+			change: func(t *testing.T, idx *HashIndex, path string) {
+				idx.SetChunking(common.ChunkingCDC)
+			},
+			stale: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			path := filepath.Join(t.TempDir(), "file")
+			writeFile(t, path, []byte("hello world"))
+			idx, err := OpenHashIndex("", nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			before, err := idx.Metadata(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			tt.change(t, idx, path)
+			after, err := idx.Metadata(path)
+			if err != nil {
+				t.Fatal(err)
+			}
+			current, err := GetFileMetadata(path, idx.chunkingMode())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if tt.stale {
+				if after.FileHash != current.FileHash || after.Chunking != current.Chunking {
+					t.Errorf("index returned %s (%q), want rehashed %s (%q)", after.FileHash[:10], after.Chunking, current.FileHash[:10], current.Chunking)
+				}
+			} else if after.FileHash != before.FileHash {
+				t.Errorf("index rehashed the file: got %s, want cached %s", after.FileHash[:10], before.FileHash[:10])
+			}
+		})
+	}
+}
+
+func TestHashIndexPersistence(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "index.json")
+	path := filepath.Join(dir, "file")
+	writeFile(t, path, []byte("hello world"))
+
+	idx, err := OpenHashIndex(indexPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	meta, err := idx.Metadata(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(indexPath); !os.IsNotExist(err) {
+		t.Fatal("index was saved before the save delay")
+	}
+	if err := idx.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopened, err := OpenHashIndex(indexPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	absPath, _ := filepath.Abs(path)
+	entry, ok := reopened.entries[absPath]
+	if !ok {
+		t.Fatal("flushed entry is missing after reopening the index")
+	}
+	if entry.Meta.FileHash != meta.FileHash {
+		t.Errorf("reopened index has hash %s, want %s", entry.Meta.FileHash[:10], meta.FileHash[:10])
+	}
+}
+
+func TestHashIndexPruning(t *testing.T) {
+	dir := t.TempDir()
+	indexPath := filepath.Join(dir, "index.json")
+	kept, removed := filepath.Join(dir, "kept"), filepath.Join(dir, "removed")
+	writeFile(t, kept, []byte("kept"))
+	writeFile(t, removed, []byte("removed"))
+
+	idx, err := OpenHashIndex(indexPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, path := range []string{kept, removed} {
+		if _, err := idx.Metadata(path); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := os.Remove(removed); err != nil {
+		t.Fatal(err)
+	}
+	if err := idx.Flush(); err != nil {
+		t.Fatal(err)
+	}
+	if len(idx.entries) != 1 {
+		t.Errorf("index has %d entries after saving, want the removed file dropped", len(idx.entries))
+	}
+
+	// Files removed while the index is not open are dropped when it is loaded.
+	if err := os.Remove(kept); err != nil {
+		t.Fatal(err)
+	}
+	reopened, err := OpenHashIndex(indexPath, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(reopened.entries) != 0 {
+		t.Errorf("reopened index has %d entries, want none", len(reopened.entries))
+	}
+}
+
+func writeFile(t *testing.T, path string, data []byte) {
+	t.Helper()
+	if err := os.WriteFile(path, data, 0o644); err != nil {
+		t.Fatal(err)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !unix
+
+package p2p
+
+import "os"
+
+// fileInode is not available on this platform; size and mtime are used alone.
+func fileInode(stat os.FileInfo) uint64 {
+	return 0
+}
@@ -0,0 +1,215 @@
+package p2p
+
+import (
+	"io"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// LocalStore finds data for downloads that is already on this machine, in
+// the files shared by a FileManager or in other directories. Files in the
+// directories are hashed once and then looked up in the FileManager's index.
+type LocalStore struct {
+	files *FileManager
+	dirs  []string
+
+	mu      sync.Mutex
+	scanned time.Time
+	cached  []localFile
+}
+
+// localScanTTL is how long the result of a scan is reused, so that the
+// lookups made for one download walk the directories once. Data reused from
+// local files is verified, so a slightly stale list is harmless.
+const localScanTTL = 30 * time.Second
+
+// NewLocalStore creates a store of the files shared by files and those
+// found under dirs.
+func NewLocalStore(files *FileManager, dirs []string) *LocalStore {
+	return &LocalStore{files: files, dirs: dirs}
+}
+
+type localFile struct {
+	path string
+	meta *common.FileMetadata
+}
+
+// chunkRef locates a chunk in a local file.
+type chunkRef struct {
+	path   string
+	offset int64
+	size   int64
+}
+
+// scan lists the local files, shared files first. Files that changed since
+// they were shared are skipped.
+func (s *LocalStore) scan() []localFile {
+	if s == nil {
+		return nil
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if time.Since(s.scanned) < localScanTTL {
+		return s.cached
+	}
+	var shared []sharedFile
+	s.files.mu.RLock()
+	for _, f := range s.files.files {
+		shared = append(shared, f)
+	}
+	s.files.mu.RUnlock()
+	var files []localFile
+	for _, f := range shared {
+		if !f.changed() {
+			files = append(files, localFile{path: f.path, meta: f.meta})
+		}
+	}
+
+	for _, dir := range s.dirs {
+		filepath.WalkDir(dir, func(path string, d fs.DirEntry, err error) error {
+			if err != nil || !d.Type().IsRegular() || strings.HasSuffix(path, ".tmp") {
+				return nil
+			}
+			meta, _, err := s.files.index.metadataWithStat(path)
+			if err != nil {
+				s.files.logger.Printf("Could not index local file %s: %v", path, err)
+				return nil
+			}
+			files = append(files, localFile{path: path, meta: meta})
+			return nil
+		})
+	}
+	s.cached, s.scanned = files, time.Now()
+	return files
+}
+
+// file returns a local file with the given hash.
+func (s *LocalStore) file(hash string) (localFile, bool) {
+	for _, f := range s.scan() {
+		if f.meta.FileHash == hash {
+			return f, true
+		}
+	}
+	return localFile{}, false
+}
+
+// forget drops the file at path from the cached scan, after it could not
+// be reused.
+func (s *LocalStore) forget(path string) {
+	if s == nil {
+		return
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.cached = slices.DeleteFunc(slices.Clone(s.cached), func(f localFile) bool { return f.path == path })
+}
+
+// Has reports whether a file with the given hash is available locally.
+func (s *LocalStore) Has(hash string) bool {
+	_, ok := s.file(hash)
+	return ok
+}
+
+// chunks maps the hashes of the chunks of local files split as chunking
+// says to where they can be read.
+func (s *LocalStore) chunks(chunking common.Chunking) map[string]chunkRef {
+	refs := make(map[string]chunkRef)
+	for _, f := range s.scan() {
+		if f.meta.Chunking == chunking {
+			addMetadataRefs(refs, f.path, f.meta)
+		}
+	}
+	return refs
+}
+
+// addChunkRefs adds the chunks of the file at path, split as chunking says,
+// to refs. The file is only hashed if index has not seen it as it is now. It
+// does nothing if there is no such file.
+func addChunkRefs(refs map[string]chunkRef, index *HashIndex, path string, chunking common.Chunking) {
+	if _, err := os.Stat(path); err != nil {
+		return
+	}
+	if meta, _, err := index.metadataChunked(path, chunking); err == nil {
+		addMetadataRefs(refs, path, meta)
+	}
+}
+
+func addMetadataRefs(refs map[string]chunkRef, path string, meta *common.FileMetadata) {
+	layout, err := newChunkLayout(meta)
+	if err != nil || len(meta.ChunkHashes) != meta.NumChunks {
+		return
+	}
+	for i, hash := range meta.ChunkHashes {
+		if _, ok := refs[hash]; !ok {
+			refs[hash] = chunkRef{path: path, offset: layout.offset(i), size: layout.length(i)}
+		}
+	}
+}
+
+// reuseChunks copies the missing chunks of meta that are found locally into
+// file and returns the chunks still missing.
+func reuseChunks(file *os.File, meta *common.FileMetadata, layout chunkLayout, missing []int, refs map[string]chunkRef, logger common.Logger) []int {
+	if len(refs) == 0 || len(meta.ChunkHashes) != meta.NumChunks {
+		return missing
+	}
+	var still []int
+	var reused int
+	for _, i := range missing {
+		ref, ok := refs[meta.ChunkHashes[i]]
+		if !ok {
+			still = append(still, i)
+			continue
+		}
+		data, err := ReadRange(ref.path, ref.offset, ref.size)
+		if err == nil {
+			err = verifyChunk(meta, layout, i, data)
+		}
+		if err == nil {
+			_, err = file.WriteAt(data, layout.offset(i))
+		}
+		if err != nil {
+			still = append(still, i)
+			continue
+		}
+		reused++
+	}
+	if reused > 0 {
+		logger.Printf("Reused %d chunks from local files", reused)
+	}
+	return still
+}
+
+// copyLocal creates dst with the contents of src: as a hard link if link is
+// set and src is on the same file system, otherwise as a reflink where the
+// file system supports it, or else as a plain copy.
+func copyLocal(src, dst string, link bool) error {
+	if err := os.Remove(dst); err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	if link && os.Link(src, dst) == nil {
+		return nil
+	}
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0o644)
+	if err != nil {
+		return err
+	}
+	defer out.Close()
+	if reflink(out, in) != nil {
+		if _, err := io.Copy(out, in); err != nil {
+			return err
+		}
+	}
+	return out.Close()
+}
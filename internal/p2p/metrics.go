@@ -0,0 +1,57 @@
+package p2p
+
+import (
+	"net"
+	"net/http"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+// serverMetrics are the Prometheus metrics of a P2PServer. Each server has
+// its own registry so several can run in one process.
+type serverMetrics struct {
+	registry        *prometheus.Registry
+	bytesServed     *prometheus.CounterVec
+	chunkDuration   prometheus.Histogram
+	errors          *prometheus.CounterVec
+	activeTransfers prometheus.Gauge
+}
+
+func newServerMetrics() *serverMetrics {
+	m := &serverMetrics{
+		registry: prometheus.NewRegistry(),
+		bytesServed: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dropeer_peer_bytes_served_total",
+			Help: "Chunk bytes served, by file and requesting peer address.",
+		}, []string{"file", "peer"}),
+		chunkDuration: prometheus.NewHistogram(prometheus.HistogramOpts{
+			Name:    "dropeer_peer_chunk_duration_seconds",
+			Help:    "Time to read and send a chunk.",
+			Buckets: prometheus.ExponentialBuckets(0.001, 2, 14),
+		}),
+		errors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "dropeer_peer_errors_total",
+			Help: "Failed requests, by handler and status code.",
+		}, []string{"handler", "code"}),
+		activeTransfers: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "dropeer_peer_active_transfers",
+			Help: "Chunk requests currently being served.",
+		}),
+	}
+	m.registry.MustRegister(m.bytesServed, m.chunkDuration, m.errors, m.activeTransfers)
+	return m
+}
+
+func (m *serverMetrics) handler() http.Handler {
+	return promhttp.HandlerFor(m.registry, promhttp.HandlerOpts{})
+}
+
+// remoteHost returns the requesting peer's address without its port.
+func remoteHost(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
@@ -0,0 +1,212 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"math"
+	"net/http"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+const (
+	// maxPeerErrors is how many requests to a peer may fail in a row before
+	// it is dropped from a download.
+	maxPeerErrors = 3
+	// maxPeerCorrupt is how many corrupt chunks a peer may serve before it
+	// is dropped from a download.
+	maxPeerCorrupt = 2
+	// initialDepth is how many requests a peer gets at once before its rate
+	// is known, and maxDepth how many it may ever get.
+	initialDepth = 2
+	maxDepth     = 32
+	// rateAlpha is the weight of a new sample in a peer's delivery rate.
+	rateAlpha = 0.3
+	// DefaultMaxInFlight is the default cap on bytes requested but not yet
+	// received across all peers.
+	DefaultMaxInFlight = 64 << 20
+)
+
+// errCorrupt marks chunks that failed verification.
+var errCorrupt = errors.New("corrupt chunk")
+
+// peerPool is the set of peers a download fetches chunks from. Peers join as
+// connections to them succeed and are dropped when they keep failing; each
+// request goes to the peer the scores rate best among those with room in
+// their pipeline.
+//
+// A peer's pipeline is as deep as its bandwidth-delay product in chunks,
+// plus one so it always has a request queued, and grows as its measured
+// rate does. Requests in flight across all peers are capped at maxInFlight
+// bytes.
+type peerPool struct {
+	scores      *PeerScores
+	logger      common.Logger
+	maxInFlight int64
+
+	mu         sync.Mutex
+	peers      map[string]*poolPeer
+	connecting int
+	inFlight   int64         // bytes
+	changed    chan struct{} // closed when peers join or leave, or requests end
+}
+
+type poolPeer struct {
+	info     common.PeerInfo
+	inflight int
+	errors   int // in a row
+	corrupt  int
+	rate     float64 // bytes per second delivered, all requests together
+	lastDone time.Time
+}
+
+// lease is a request to a peer acquired from the pool.
+type lease struct {
+	peer  common.PeerInfo
+	size  int64
+	start time.Time
+}
+
+// newPeerPool starts connecting to peers in the background. The attempts
+// stop when ctx is done. maxInFlight defaults to DefaultMaxInFlight.
+func newPeerPool(ctx context.Context, client *http.Client, peers []common.PeerInfo, scores *PeerScores, maxInFlight int64, opts DownloadOptions, logger common.Logger) *peerPool {
+	if maxInFlight <= 0 {
+		maxInFlight = DefaultMaxInFlight
+	}
+	p := &peerPool{
+		scores:      scores,
+		logger:      logger,
+		maxInFlight: maxInFlight,
+		peers:       make(map[string]*poolPeer),
+		connecting:  len(peers),
+		changed:     make(chan struct{}),
+	}
+	for _, peer := range peers {
+		go func() {
+			connected, err := connectPeer(ctx, client, peer, opts)
+			p.mu.Lock()
+			defer p.mu.Unlock()
+			p.connecting--
+			if err != nil {
+				logger.Printf("Could not reach peer %s: %v", peer.ID, err)
+			} else {
+				if connected.Via != "" {
+					logger.Printf("Connected to peer %s through the relay", peer.ID)
+				} else {
+					logger.Printf("Connected to peer %s at %s", peer.ID, peerAddr(connected))
+				}
+				p.peers[peer.ID] = &poolPeer{info: connected}
+			}
+			p.signal()
+		}()
+	}
+	return p
+}
+
+// signal wakes up acquires waiting for a change. The caller must hold p.mu.
+func (p *peerPool) signal() {
+	close(p.changed)
+	p.changed = make(chan struct{})
+}
+
+// depth returns how many requests pp may have in flight. The caller must
+// hold p.mu.
+func (p *peerPool) depth(pp *poolPeer) int {
+	rtt := p.scores.rttOf(pp.info)
+	if pp.rate == 0 || rtt == 0 {
+		return initialDepth
+	}
+	bdp := pp.rate * rtt.Seconds() / common.ChunkSize
+	return min(int(math.Ceil(bdp))+1, maxDepth)
+}
+
+// acquire returns a lease on the peer to request size bytes from, waiting
+// until a peer has room in its pipeline and the in-flight cap allows it.
+// Every acquire must be followed by a release.
+func (p *peerPool) acquire(ctx context.Context, size int64) (*lease, error) {
+	for {
+		p.mu.Lock()
+		var ready []common.PeerInfo
+		if p.inFlight == 0 || p.inFlight+size <= p.maxInFlight {
+			for _, pp := range p.peers {
+				if pp.inflight < p.depth(pp) {
+					ready = append(ready, pp.info)
+				}
+			}
+		}
+		peer, ok := p.scores.pick(ready, func(id string) int { return p.peers[id].inflight })
+		if ok {
+			p.peers[peer.ID].inflight++
+			p.inFlight += size
+			p.mu.Unlock()
+			return &lease{peer: peer, size: size, start: time.Now()}, nil
+		}
+		if len(p.peers) == 0 && p.connecting == 0 {
+			p.mu.Unlock()
+			return nil, ErrNoReachablePeers
+		}
+		changed := p.changed
+		p.mu.Unlock()
+
+		select {
+		case <-changed:
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+	}
+}
+
+// release records the outcome of a leased request that received got bytes,
+// dropping the peer if it keeps failing.
+func (p *peerPool) release(l *lease, got int, err error) {
+	peer := l.peer
+	switch {
+	case err == nil:
+		p.scores.success(peer, got, time.Since(l.start))
+	case errors.Is(err, errCorrupt):
+		p.scores.corrupt(peer.ID)
+	case errors.Is(err, context.Canceled):
+	default:
+		p.scores.failure(peer.ID)
+	}
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+	p.inFlight -= l.size
+	defer p.signal()
+	pp, ok := p.peers[peer.ID]
+	if !ok {
+		return
+	}
+	pp.inflight--
+	switch {
+	case err == nil:
+		pp.errors = 0
+		if got > 0 {
+			// With requests pipelined, the time since the previous one
+			// finished is what this one added.
+			now := time.Now()
+			since := l.start
+			if pp.lastDone.After(since) {
+				since = pp.lastDone
+			}
+			if d := now.Sub(since).Seconds(); d > 0 && pp.rate == 0 {
+				pp.rate = float64(got) / d
+			} else if d > 0 {
+				pp.rate = rateAlpha*float64(got)/d + (1-rateAlpha)*pp.rate
+			}
+			pp.lastDone = now
+		}
+	case errors.Is(err, errCorrupt):
+		pp.corrupt++
+	case errors.Is(err, context.Canceled):
+	default:
+		pp.errors++
+	}
+	if pp.errors >= maxPeerErrors || pp.corrupt >= maxPeerCorrupt {
+		p.logger.Printf("Dropping peer %s: %v", peer.ID, err)
+		delete(p.peers, peer.ID)
+	}
+}
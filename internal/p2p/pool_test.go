@@ -0,0 +1,174 @@
+package p2p
+
+import (
+	"context"
+	"errors"
+	"io"
+	"log"
+	"testing"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// newTestPool returns a pool of peers that are already connected.
+func newTestPool(maxInFlight int64, peers ...common.PeerInfo) *peerPool {
+	p := newPeerPool(context.Background(), nil, nil, NewPeerScores(), maxInFlight, DownloadOptions{}, log.New(io.Discard, "", 0))
+	for _, peer := range peers {
+		p.peers[peer.ID] = &poolPeer{info: peer}
+	}
+	return p
+}
+
+// requestFrom leases a request to the peer with the given ID and releases it
+// with err.
+func requestFrom(t *testing.T, p *peerPool, id string, err error) {
+	t.Helper()
+	p.mu.Lock()
+	pp, ok := p.peers[id]
+	if ok {
+		pp.inflight++
+	}
+	p.mu.Unlock()
+	if !ok {
+		t.Fatalf("peer %s not in the pool", id)
+	}
+	got := 0
+	if err == nil {
+		got = common.ChunkSize
+	}
+	p.release(&lease{peer: pp.info}, got, err)
+}
+
+func TestPeerPoolDropsPeers(t *testing.T) {
+	failed := errors.New("failed")
+	tests := []struct {
+		name     string
+		errs     []error
+		wantKept bool
+	}{
+		{"failures in a row", []error{failed, failed, failed}, false},
+		{"failures with a success between", []error{failed, failed, nil, failed, failed}, true},
+		{"corrupt chunks", []error{errCorrupt, nil, errCorrupt}, false},
+		{"one corrupt chunk", []error{errCorrupt, nil, nil}, true},
+		{"cancelled requests", []error{context.Canceled, context.Canceled, context.Canceled}, true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			p := newTestPool(0, testPeer("a"), testPeer("b"))
+			for _, err := range tt.errs {
+				requestFrom(t, p, "a", err)
+			}
+			_, kept := p.peers["a"]
+			if kept != tt.wantKept {
+				t.Errorf("peer kept = %v, want %v", kept, tt.wantKept)
+			}
+			if _, ok := p.peers["b"]; !ok {
+				t.Error("other peer dropped")
+			}
+		})
+	}
+}
+
+func TestPeerPoolNoReachablePeers(t *testing.T) {
+	p := newTestPool(0, testPeer("a"))
+	for range maxPeerErrors {
+		requestFrom(t, p, "a", errors.New("failed"))
+	}
+	if _, err := p.acquire(context.Background(), common.ChunkSize); !errors.Is(err, ErrNoReachablePeers) {
+		t.Errorf("acquire() error = %v, want %v", err, ErrNoReachablePeers)
+	}
+}
+
+func TestPeerPoolDepth(t *testing.T) {
+	const mib = 1 << 20
+	tests := []struct {
+		name string
+		rate float64 // bytes per second
+		rtt  time.Duration
+		want int
+	}{
+		{"nothing measured", 0, 0, initialDepth},
+		{"no rate yet", 0, 50 * time.Millisecond, initialDepth},
+		{"no round trip yet", 10 * mib, 0, initialDepth},
+		{"less than a chunk in flight", 4 * mib, 100 * time.Millisecond, 2},
+		{"ten chunks in flight", 100 * mib, 100 * time.Millisecond, 11},
+		{"part of a chunk rounds up", 25 * mib, 100 * time.Millisecond, 4},
+		{"capped", 1000 * mib, time.Second, maxDepth},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			peer := testPeer("a")
+			p := newTestPool(0, peer)
+			p.peers["a"].rate = tt.rate
+			if tt.rtt > 0 {
+				p.scores.rtt[peerAddr(peer)] = tt.rtt
+			}
+			if got := p.depth(p.peers["a"]); got != tt.want {
+				t.Errorf("depth() = %d, want %d", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPeerPoolPipelineLimit(t *testing.T) {
+	p := newTestPool(0, testPeer("a"))
+	for range initialDepth {
+		if _, err := p.acquire(context.Background(), common.ChunkSize); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.acquire(ctx, common.ChunkSize); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("acquire() beyond the pipeline depth error = %v, want it to wait", err)
+	}
+}
+
+func TestPeerPoolInFlightCap(t *testing.T) {
+	p := newTestPool(2*common.ChunkSize, testPeer("a"), testPeer("b"))
+	var leases []*lease
+	for range 2 {
+		l, err := p.acquire(context.Background(), common.ChunkSize)
+		if err != nil {
+			t.Fatal(err)
+		}
+		leases = append(leases, l)
+	}
+
+	// The peers have room in their pipelines, but the cap is reached.
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := p.acquire(ctx, common.ChunkSize); !errors.Is(err, context.DeadlineExceeded) {
+		t.Fatalf("acquire() beyond the cap error = %v, want it to wait", err)
+	}
+
+	done := make(chan error)
+	go func() {
+		_, err := p.acquire(context.Background(), common.ChunkSize)
+		done <- err
+	}()
+	p.release(leases[0], common.ChunkSize, nil)
+	select {
+	case err := <-done:
+		if err != nil {
+			t.Fatal(err)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("acquire() still waiting after a release")
+	}
+	if p.inFlight != 2*common.ChunkSize {
+		t.Errorf("%d bytes in flight, want %d", p.inFlight, 2*common.ChunkSize)
+	}
+}
+
+func TestPeerPoolOversizedRequest(t *testing.T) {
+	// A request larger than the cap still goes out when nothing else is in
+	// flight, or the download could never finish.
+	p := newTestPool(common.ChunkSize/2, testPeer("a"))
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if _, err := p.acquire(ctx, common.ChunkSize); err != nil {
+		t.Errorf("acquire() error = %v", err)
+	}
+}
@@ -0,0 +1,130 @@
+package p2p
+
+import (
+	"sync"
+	"time"
+)
+
+// EventKind identifies the kind of a ProgressEvent.
+type EventKind string
+
+const (
+	// EventStarted is sent once the file's metadata is known. Chunks already
+	// present from an interrupted download are counted as done.
+	EventStarted EventKind = "started"
+	// EventChunkDone is sent each time a chunk has been written.
+	EventChunkDone EventKind = "chunk_done"
+	// EventRetry is sent when a chunk failed and is requeued; Err says why.
+	EventRetry EventKind = "retry"
+	// EventVerified is sent after the whole file has been checked against
+	// its hash; Err is set if verification failed.
+	EventVerified EventKind = "verified"
+)
+
+// ProgressEvent describes the progress of a download. Every event carries
+// the overall totals; Chunk, Peer, PeerRate and Err are set where relevant.
+type ProgressEvent struct {
+	Kind        EventKind
+	FileHash    string
+	BytesDone   int64
+	BytesTotal  int64
+	ChunksDone  int
+	ChunksTotal int
+	Rate        float64       // overall download rate in bytes/s
+	ETA         time.Duration // estimated time remaining, 0 if unknown
+	Chunk       int
+	Peer        string
+	PeerRate    float64 // average rate from Peer in bytes/s
+	Attempt     int     // retry attempt number for EventRetry
+	Err         error
+}
+
+// progressTracker accumulates download progress and emits events.
+type progressTracker struct {
+	mu          sync.Mutex
+	emit        func(ProgressEvent)
+	fileHash    string
+	start       time.Time
+	bytesTotal  int64
+	chunksTotal int
+	bytesDone   int64
+	chunksDone  int
+	resumed     int64            // bytes present before the download started
+	peerBytes   map[string]int64 // peer ID -> bytes received
+}
+
+func newProgressTracker(emit func(ProgressEvent), fileHash string, bytesTotal int64, chunksTotal int) *progressTracker {
+	if emit == nil {
+		emit = func(ProgressEvent) {}
+	}
+	return &progressTracker{
+		emit:        emit,
+		fileHash:    fileHash,
+		start:       time.Now(),
+		bytesTotal:  bytesTotal,
+		chunksTotal: chunksTotal,
+		peerBytes:   make(map[string]int64),
+	}
+}
+
+// started reports the download as started with chunks and bytes already present.
+func (p *progressTracker) started(chunks int, bytes int64) {
+	p.mu.Lock()
+	p.chunksDone = chunks
+	p.bytesDone = bytes
+	p.resumed = bytes
+	ev := p.event(EventStarted)
+	p.mu.Unlock()
+	p.emit(ev)
+}
+
+func (p *progressTracker) chunkDone(chunk int, peer string, size int) {
+	p.mu.Lock()
+	p.chunksDone++
+	p.bytesDone += int64(size)
+	p.peerBytes[peer] += int64(size)
+	ev := p.event(EventChunkDone)
+	ev.Chunk = chunk
+	ev.Peer = peer
+	ev.PeerRate = float64(p.peerBytes[peer]) / time.Since(p.start).Seconds()
+	p.mu.Unlock()
+	p.emit(ev)
+}
+
+func (p *progressTracker) retry(chunk int, peer string, attempt int, err error) {
+	p.mu.Lock()
+	ev := p.event(EventRetry)
+	ev.Chunk = chunk
+	ev.Peer = peer
+	ev.Attempt = attempt
+	ev.Err = err
+	p.mu.Unlock()
+	p.emit(ev)
+}
+
+func (p *progressTracker) verified(err error) {
+	p.mu.Lock()
+	ev := p.event(EventVerified)
+	ev.Err = err
+	p.mu.Unlock()
+	p.emit(ev)
+}
+
+// event builds an event with the current totals. The caller must hold p.mu.
+func (p *progressTracker) event(kind EventKind) ProgressEvent {
+	ev := ProgressEvent{
+		Kind:        kind,
+		FileHash:    p.fileHash,
+		BytesDone:   p.bytesDone,
+		BytesTotal:  p.bytesTotal,
+		ChunksDone:  p.chunksDone,
+		ChunksTotal: p.chunksTotal,
+	}
+	if elapsed := time.Since(p.start).Seconds(); elapsed > 0 {
+		ev.Rate = float64(p.bytesDone-p.resumed) / elapsed
+	}
+	if ev.Rate > 0 {
+		ev.ETA = time.Duration(float64(p.bytesTotal-p.bytesDone) / ev.Rate * float64(time.Second))
+	}
+	return ev
+}
@@ -0,0 +1,88 @@
+package p2p
+
+import (
+	"math"
+	"testing"
+	"time"
+)
+
+func TestProgressRateAndETA(t *testing.T) {
+	tests := []struct {
+		name     string
+		total    int64
+		resumed  int64
+		chunks   []int // sizes of chunks downloaded
+		elapsed  time.Duration
+		wantRate float64
+		wantETA  time.Duration
+	}{
+		{
+			name:     "fresh download",
+			total:    1000,
+			chunks:   []int{100, 100},
+			elapsed:  10 * time.Second,
+			wantRate: 20,
+			wantETA:  40 * time.Second,
+		},
+		{
+			name:     "resumed bytes do not count towards the rate",
+			total:    1000,
+			resumed:  600,
+			chunks:   []int{200},
+			elapsed:  10 * time.Second,
+			wantRate: 20,
+			wantETA:  10 * time.Second,
+		},
+		{
+			name:    "nothing downloaded yet",
+			total:   1000,
+			resumed: 500,
+			elapsed: 10 * time.Second,
+		},
+		{
+			name:     "finished",
+			total:    300,
+			chunks:   []int{100, 200},
+			elapsed:  3 * time.Second,
+			wantRate: 100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			var last ProgressEvent
+			p := newProgressTracker(func(ev ProgressEvent) { last = ev }, "hash", tt.total, 10)
+			p.start = time.Now().Add(-tt.elapsed)
+			p.started(0, tt.resumed)
+			for i, size := range tt.chunks {
+				p.chunkDone(i, "peer", size)
+			}
+
+			done := tt.resumed
+			for _, size := range tt.chunks {
+				done += int64(size)
+			}
+			if last.BytesDone != done || last.BytesTotal != tt.total || last.ChunksDone != len(tt.chunks) {
+				t.Errorf("event reports %d/%d bytes and %d chunks, want %d/%d and %d", last.BytesDone, last.BytesTotal, last.ChunksDone, done, tt.total, len(tt.chunks))
+			}
+			// The clock runs on while the test does, so allow a little slack.
+			if math.Abs(last.Rate-tt.wantRate) > tt.wantRate*0.01 {
+				t.Errorf("Rate = %.2f, want %.2f", last.Rate, tt.wantRate)
+			}
+			if d := last.ETA - tt.wantETA; d < -tt.wantETA/100 || d > tt.wantETA/100 {
+				t.Errorf("ETA = %s, want %s", last.ETA, tt.wantETA)
+			}
+		})
+	}
+}
+
+func TestProgressPeerRate(t *testing.T) {
+	var last ProgressEvent
+	p := newProgressTracker(func(ev ProgressEvent) { last = ev }, "hash", 1000, 10)
+	p.start = time.Now().Add(-10 * time.Second)
+	p.chunkDone(0, "a", 300)
+	p.chunkDone(1, "b", 100)
+	p.chunkDone(2, "a", 200)
+	if last.Peer != "a" || math.Abs(last.PeerRate-50) > 0.5 {
+		t.Errorf("peer %s at %.2f B/s, want a at 50 B/s", last.Peer, last.PeerRate)
+	}
+}
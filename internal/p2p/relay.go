@@ -0,0 +1,154 @@
+package p2p
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// relayRetryDelay is how long a peer waits before polling again after the
+// relay failed.
+const relayRetryDelay = 5 * time.Second
+
+// relayDelay is how long a downloader tries a peer directly before also
+// trying it through the relay, which is slower and metered.
+const relayDelay = 2 * time.Second
+
+// RelayClient connects this peer to a relay, through which peers that cannot
+// reach each other directly exchange requests. A peer keeps a poll open so
+// requests for it can be passed on, and a downloader sends requests for
+// relayed peers to it.
+type RelayClient struct {
+	base      *url.URL
+	transport http.RoundTripper
+	token     string
+	identity  *common.Identity
+	logger    common.Logger
+}
+
+// NewRelayClient creates a client for the relay at baseURL, reached through
+// transport. Requests carry token as a bearer token if it is not empty.
+func NewRelayClient(baseURL string, transport http.RoundTripper, token string, identity *common.Identity, logger common.Logger) (*RelayClient, error) {
+	base, err := url.Parse(baseURL)
+	if err != nil || base.Host == "" {
+		return nil, fmt.Errorf("invalid relay URL %q", baseURL)
+	}
+	return &RelayClient{base: base, transport: transport, token: token, identity: identity, logger: logger}, nil
+}
+
+// RoundTrip sends req to the relay with the client's token.
+func (c *RelayClient) RoundTrip(req *http.Request) (*http.Response, error) {
+	if c.token != "" {
+		req = req.Clone(req.Context())
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+	return c.transport.RoundTrip(req)
+}
+
+// peerURL returns the URL of path on peer through the relay.
+func (c *RelayClient) peerURL(peerID, path string) string {
+	return c.base.JoinPath("relay", "peer", peerID).String() + path
+}
+
+// Serve polls the relay for requests to this peer and answers them with
+// handler until ctx is done.
+func (c *RelayClient) Serve(ctx context.Context, handler http.Handler) {
+	client := &http.Client{Transport: c}
+	for ctx.Err() == nil {
+		req, err := c.poll(ctx, client)
+		if err != nil {
+			if ctx.Err() == nil {
+				c.logger.Printf("Relay poll failed: %v", err)
+				select {
+				case <-time.After(relayRetryDelay):
+				case <-ctx.Done():
+				}
+			}
+			continue
+		}
+		if req != nil {
+			go c.answer(ctx, client, handler, req)
+		}
+	}
+}
+
+// poll waits for the next request relayed to this peer. It returns nil if
+// none arrived before the relay ended the poll.
+func (c *RelayClient) poll(ctx context.Context, client *http.Client) (*common.RelayRequest, error) {
+	body, _ := json.Marshal(c.identity.SignRelayPoll())
+	req, err := http.NewRequestWithContext(ctx, "POST", c.base.JoinPath("relay", "poll").String(), bytes.NewReader(body))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+		var relayed common.RelayRequest
+		if err := json.NewDecoder(resp.Body).Decode(&relayed); err != nil {
+			return nil, err
+		}
+		return &relayed, nil
+	case http.StatusNoContent:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("relay returned status %s", resp.Status)
+	}
+}
+
+// answer handles a relayed request and posts the response to the relay.
+func (c *RelayClient) answer(ctx context.Context, client *http.Client, handler http.Handler, relayed *common.RelayRequest) {
+	req, err := http.NewRequestWithContext(ctx, "GET", relayed.Path, nil)
+	if err != nil {
+		return
+	}
+	rec := &bufferedResponse{header: make(http.Header), status: http.StatusOK}
+	handler.ServeHTTP(rec, req)
+
+	post, err := http.NewRequestWithContext(ctx, "POST", c.base.JoinPath("relay", "respond", relayed.ID).String(), &rec.body)
+	if err != nil {
+		return
+	}
+	post.Header.Set(common.RelayStatusHeader, strconv.Itoa(rec.status))
+	post.Header.Set("Content-Type", rec.header.Get("Content-Type"))
+	resp, err := client.Do(post)
+	if err != nil {
+		c.logger.Printf("Could not send relayed response: %v", err)
+		return
+	}
+	resp.Body.Close()
+}
+
+// bufferedResponse collects a handler's response so it can be posted to the
+// relay in one request.
+type bufferedResponse struct {
+	header      http.Header
+	status      int
+	wroteHeader bool
+	body        bytes.Buffer
+}
+
+func (r *bufferedResponse) Header() http.Header { return r.header }
+
+func (r *bufferedResponse) WriteHeader(status int) {
+	if !r.wroteHeader {
+		r.status = status
+		r.wroteHeader = true
+	}
+}
+
+func (r *bufferedResponse) Write(b []byte) (int, error) {
+	r.wroteHeader = true
+	return r.body.Write(b)
+}
@@ -0,0 +1,216 @@
+package p2p
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"net"
+	"net/netip"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+
+	"github.com/quic-go/quic-go"
+)
+
+const (
+	// registerInterval is how often a peer re-registers with the rendezvous
+	// service. It is short enough to keep most NAT mappings open.
+	registerInterval = 20 * time.Second
+	// punchTimeout bounds the wait for the tracker to answer a connect.
+	punchTimeout = 3 * time.Second
+	// punchProbes is how many probes are sent to open a NAT for a peer.
+	punchProbes   = 5
+	probeInterval = 100 * time.Millisecond
+)
+
+// Rendezvous registers this peer with the tracker's rendezvous service and
+// asks it to coordinate hole punching to peers that cannot be reached
+// directly. It shares the UDP socket of the peer's QUIC transport, so the
+// endpoint the tracker sees is the one other peers must connect to, and
+// downloads dial out through the same socket.
+type Rendezvous struct {
+	server    netip.AddrPort
+	identity  *common.Identity
+	logger    common.Logger
+	transport *quic.Transport
+
+	mu       sync.Mutex
+	endpoint string                                    // as the tracker last saw it
+	waiting  map[string]chan *common.RendezvousMessage // target peer ID -> punch reply
+}
+
+// NewRendezvous creates a client for the rendezvous service at addr.
+func NewRendezvous(addr string, identity *common.Identity, logger common.Logger) (*Rendezvous, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid rendezvous address: %w", err)
+	}
+	server := udpAddr.AddrPort()
+	return &Rendezvous{
+		server:   netip.AddrPortFrom(server.Addr().Unmap(), server.Port()),
+		identity: identity,
+		logger:   logger,
+		waiting:  make(map[string]chan *common.RendezvousMessage),
+	}, nil
+}
+
+// Start registers with the tracker through transport and keeps the
+// registration alive until the transport is closed.
+func (r *Rendezvous) Start(transport *quic.Transport) {
+	r.transport = transport
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		r.readLoop()
+	}()
+	go func() {
+		ticker := time.NewTicker(registerInterval)
+		defer ticker.Stop()
+		for {
+			r.send(common.RendezvousRegister, "")
+			select {
+			case <-ticker.C:
+			case <-done:
+				return
+			}
+		}
+	}()
+}
+
+// Endpoint returns this peer's public endpoint as the tracker sees it, or ""
+// if the tracker has not answered yet.
+func (r *Rendezvous) Endpoint() string {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.endpoint
+}
+
+func (r *Rendezvous) send(msgType, target string) {
+	msg := &common.RendezvousMessage{Type: msgType, Target: target}
+	r.identity.SignRendezvous(msg)
+	if _, err := r.transport.WriteTo(msg.Marshal(), net.UDPAddrFromAddrPort(r.server)); err != nil {
+		r.logger.Printf("Could not send %s to rendezvous service: %v", msgType, err)
+	}
+}
+
+// readLoop handles the non-QUIC datagrams arriving on the socket. Only
+// messages from the tracker are acted on; probes from other peers have done
+// their job by arriving.
+func (r *Rendezvous) readLoop() {
+	buf := make([]byte, 2048)
+	for {
+		n, from, err := r.transport.ReadNonQUICPacket(context.Background(), buf)
+		if err != nil {
+			return
+		}
+		udpFrom, ok := from.(*net.UDPAddr)
+		if !ok {
+			continue
+		}
+		src := udpFrom.AddrPort()
+		if netip.AddrPortFrom(src.Addr().Unmap(), src.Port()) != r.server {
+			continue
+		}
+		msg, err := common.ParseRendezvous(buf[:n])
+		if err != nil {
+			continue
+		}
+		switch msg.Type {
+		case common.RendezvousRegistered:
+			r.mu.Lock()
+			if msg.Endpoint != r.endpoint {
+				r.logger.Printf("Rendezvous: public endpoint is %s", msg.Endpoint)
+			}
+			r.endpoint = msg.Endpoint
+			r.mu.Unlock()
+		case common.RendezvousPunch:
+			go r.probe(msg.Endpoint)
+			r.reply(msg.PeerID, msg)
+		case common.RendezvousError:
+			if msg.Target != "" {
+				r.reply(msg.Target, msg)
+			} else {
+				r.logger.Printf("Rendezvous: %s", msg.Error)
+			}
+		}
+	}
+}
+
+// reply hands msg to a connect waiting for peerID, if any.
+func (r *Rendezvous) reply(peerID string, msg *common.RendezvousMessage) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if ch, ok := r.waiting[peerID]; ok {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+// probe sends a few datagrams to endpoint so this side's NAT lets the other
+// peer's packets in.
+func (r *Rendezvous) probe(endpoint string) {
+	addr, err := netip.ParseAddrPort(endpoint)
+	if err != nil {
+		return
+	}
+	probe := (&common.RendezvousMessage{Type: common.RendezvousPunch}).Marshal()
+	for range punchProbes {
+		r.transport.WriteTo(probe, net.UDPAddrFromAddrPort(addr))
+		time.Sleep(probeInterval)
+	}
+}
+
+// connect asks the tracker to coordinate hole punching with peer and returns
+// the peer with its address set to the public endpoint to dial.
+func (r *Rendezvous) connect(ctx context.Context, peer common.PeerInfo) (common.PeerInfo, error) {
+	ch := make(chan *common.RendezvousMessage, 1)
+	r.mu.Lock()
+	r.waiting[peer.ID] = ch
+	r.mu.Unlock()
+	defer func() {
+		r.mu.Lock()
+		delete(r.waiting, peer.ID)
+		r.mu.Unlock()
+	}()
+
+	r.send(common.RendezvousConnect, peer.ID)
+	timer := time.NewTimer(punchTimeout)
+	defer timer.Stop()
+	select {
+	case msg := <-ch:
+		if msg.Type == common.RendezvousError {
+			return peer, errors.New(msg.Error)
+		}
+		addr, err := netip.ParseAddrPort(msg.Endpoint)
+		if err != nil {
+			return peer, fmt.Errorf("invalid endpoint from rendezvous service: %w", err)
+		}
+		peer.IP = addr.Addr().String()
+		peer.Port = int(addr.Port())
+		return peer, nil
+	case <-timer.C:
+		return peer, errors.New("rendezvous service did not answer")
+	case <-ctx.Done():
+		return peer, ctx.Err()
+	}
+}
+
+// dial opens a QUIC connection to addr through the shared socket. It has the
+// signature of http3.Transport.Dial.
+func (r *Rendezvous) dial(ctx context.Context, addr string, tlsConf *tls.Config, conf *quic.Config) (*quic.Conn, error) {
+	udpAddr, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	return r.transport.DialEarly(ctx, udpAddr, tlsConf, conf)
+}
+
+// ready reports whether the rendezvous has a socket to use. r may be nil.
+func (r *Rendezvous) ready() bool {
+	return r != nil && r.transport != nil
+}
@@ -0,0 +1,229 @@
+package p2p
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"math"
+	"math/rand/v2"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+
+	"github.com/quic-go/quic-go"
+	"github.com/quic-go/quic-go/logging"
+)
+
+const (
+	// throughputAlpha is the weight of a new chunk in a peer's throughput
+	// average.
+	throughputAlpha = 0.3
+	// scoreHalfLife is how quickly what is known about a peer fades: its
+	// counts halve, and its throughput moves halfway back to the prior.
+	scoreHalfLife = time.Hour
+	// priorThroughput is assumed for peers nothing is known about, in bytes
+	// per second. It is optimistic so new peers get tried.
+	priorThroughput = 50 << 20
+	// exploreRate is the share of chunks requested from a random peer
+	// rather than the best, so scores of other peers stay current.
+	exploreRate = 0.1
+)
+
+// PeerScores rates peers by how well they serve chunks: their throughput,
+// the round-trip time QUIC measures to them, how often their requests fail
+// or return corrupt data, and how recently any of that was seen. Downloads
+// use it to choose which peer to fetch each chunk from. The zero value is
+// not usable; create one with NewPeerScores or LoadPeerScores.
+type PeerScores struct {
+	mu    sync.Mutex
+	peers map[string]*peerScore    // peer ID -> score
+	rtt   map[string]time.Duration // "ip:port" -> smoothed RTT
+}
+
+type peerScore struct {
+	Throughput float64       `json:"throughput"` // bytes per second
+	RTT        time.Duration `json:"rtt"`
+	Successes  float64       `json:"successes"`
+	Errors     float64       `json:"errors"`
+	Corrupt    float64       `json:"corrupt"`
+	Updated    time.Time     `json:"updated"`
+}
+
+// NewPeerScores returns empty scores.
+func NewPeerScores() *PeerScores {
+	return &PeerScores{peers: make(map[string]*peerScore), rtt: make(map[string]time.Duration)}
+}
+
+// LoadPeerScores reads scores saved at path. A missing file yields empty
+// scores.
+func LoadPeerScores(path string) (*PeerScores, error) {
+	s := NewPeerScores()
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return s, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(data, &s.peers); err != nil {
+		return nil, err
+	}
+	// A file holding null decodes to a nil map, and null entries to nil
+	// scores.
+	if s.peers == nil {
+		s.peers = make(map[string]*peerScore)
+	}
+	for id, score := range s.peers {
+		if score == nil {
+			delete(s.peers, id)
+		}
+	}
+	return s, nil
+}
+
+// Save writes the scores to path.
+func (s *PeerScores) Save(path string) error {
+	s.mu.Lock()
+	data, err := json.Marshal(s.peers)
+	s.mu.Unlock()
+	if err != nil {
+		return err
+	}
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	tmp := path + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// get returns the score of peerID with its counts decayed to now, creating
+// it if needed. The caller must hold s.mu.
+func (s *PeerScores) get(peerID string) *peerScore {
+	ps, ok := s.peers[peerID]
+	if !ok {
+		ps = &peerScore{Throughput: priorThroughput, Updated: time.Now()}
+		s.peers[peerID] = ps
+		return ps
+	}
+	decay := math.Exp2(-time.Since(ps.Updated).Seconds() / scoreHalfLife.Seconds())
+	ps.Successes *= decay
+	ps.Errors *= decay
+	ps.Corrupt *= decay
+	ps.Throughput = priorThroughput + (ps.Throughput-priorThroughput)*decay
+	ps.Updated = time.Now()
+	return ps
+}
+
+// success records that peer served size bytes in d. Requests without a body
+// only count towards reliability.
+func (s *PeerScores) success(peer common.PeerInfo, size int, d time.Duration) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := s.get(peer.ID)
+	ps.Successes++
+	if size > 0 && d > 0 {
+		rate := float64(size) / d.Seconds()
+		ps.Throughput = throughputAlpha*rate + (1-throughputAlpha)*ps.Throughput
+	}
+	if rtt, ok := s.rtt[peerAddr(peer)]; ok {
+		ps.RTT = rtt
+	}
+}
+
+// failure records a failed request to peerID.
+func (s *PeerScores) failure(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(peerID).Errors++
+}
+
+// corrupt records that peerID served data that failed verification.
+func (s *PeerScores) corrupt(peerID string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.get(peerID).Corrupt++
+}
+
+// score rates peer; higher is better. It is the expected throughput scaled
+// by the share of requests that succeed, with corrupt data weighing heavily,
+// and by the round trip for peers without a measured throughput yet.
+func (s *PeerScores) score(peer common.PeerInfo) float64 {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	ps := s.get(peer.ID)
+	reliability := (ps.Successes + 1) / (ps.Successes + ps.Errors + 5*ps.Corrupt + 1)
+	score := ps.Throughput * reliability
+	rtt := ps.RTT
+	if measured, ok := s.rtt[peerAddr(peer)]; ok {
+		rtt = measured
+	}
+	if ps.Successes < 1 && rtt > 0 {
+		score /= 1 + rtt.Seconds()/0.05
+	}
+	return score
+}
+
+// rttOf returns the round-trip time QUIC measured to peer, or 0 if none
+// is known.
+func (s *PeerScores) rttOf(peer common.PeerInfo) time.Duration {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if rtt, ok := s.rtt[peerAddr(peer)]; ok {
+		return rtt
+	}
+	if ps, ok := s.peers[peer.ID]; ok {
+		return ps.RTT
+	}
+	return 0
+}
+
+// pick chooses the peer to request the next chunk from. load is the number
+// of requests in flight to each peer, which share its throughput. Now and
+// then a random peer is chosen instead, so no peer's score goes stale.
+func (s *PeerScores) pick(peers []common.PeerInfo, load func(peerID string) int) (common.PeerInfo, bool) {
+	if len(peers) == 0 {
+		return common.PeerInfo{}, false
+	}
+	if len(peers) > 1 && rand.Float64() < exploreRate {
+		return peers[rand.IntN(len(peers))], true
+	}
+	best, bestScore := peers[0], -1.0
+	for _, p := range peers {
+		if sc := s.score(p) / float64(1+load(p.ID)); sc > bestScore {
+			best, bestScore = p, sc
+		}
+	}
+	return best, true
+}
+
+// tracer records the smoothed RTT of QUIC connections. It is used as
+// quic.Config.Tracer.
+func (s *PeerScores) tracer(ctx context.Context, p logging.Perspective, id quic.ConnectionID) *logging.ConnectionTracer {
+	var remote string
+	return &logging.ConnectionTracer{
+		StartedConnection: func(local, r net.Addr, src, dest logging.ConnectionID) {
+			remote = r.String()
+		},
+		UpdatedMetrics: func(rttStats *logging.RTTStats, cwnd, bytesInFlight logging.ByteCount, packetsInFlight int) {
+			if remote == "" {
+				return
+			}
+			s.mu.Lock()
+			s.rtt[remote] = rttStats.SmoothedRTT()
+			s.mu.Unlock()
+		},
+	}
+}
+
+// peerAddr returns the "ip:port" QUIC connects to for peer.
+func peerAddr(peer common.PeerInfo) string {
+	return net.JoinHostPort(peer.IP, strconv.Itoa(peer.Port))
+}
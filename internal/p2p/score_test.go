@@ -0,0 +1,148 @@
+package p2p
+
+import (
+	"math"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+func testPeer(id string) common.PeerInfo {
+	return common.PeerInfo{ID: id, IP: "192.0.2.1", Port: 4040}
+}
+
+func TestPeerScoresUpdates(t *testing.T) {
+	s := NewPeerScores()
+	fresh := s.score(testPeer("fresh"))
+
+	s.success(testPeer("fast"), common.ChunkSize, 10*time.Millisecond)
+	s.success(testPeer("slow"), common.ChunkSize, time.Second)
+	s.failure("failing")
+	s.corrupt("corrupt")
+
+	want := throughputAlpha*common.ChunkSize + (1-throughputAlpha)*priorThroughput
+	if got := s.peers["slow"].Throughput; math.Abs(got-want) > 1 {
+		t.Errorf("throughput after one chunk = %.0f, want %.0f", got, want)
+	}
+	slow, fast := s.score(testPeer("slow")), s.score(testPeer("fast"))
+	failing, corrupt := s.score(testPeer("failing")), s.score(testPeer("corrupt"))
+	if !(fast > fresh && fresh > slow) {
+		t.Errorf("scores fast %.0f, fresh %.0f, slow %.0f, want them in that order", fast, fresh, slow)
+	}
+	if !(fresh > failing && failing > corrupt) {
+		t.Errorf("scores fresh %.0f, failing %.0f, corrupt %.0f, want them in that order", fresh, failing, corrupt)
+	}
+}
+
+func TestPeerScoresDecay(t *testing.T) {
+	s := NewPeerScores()
+	s.peers["a"] = &peerScore{
+		Throughput: priorThroughput / 2,
+		Successes:  8,
+		Errors:     4,
+		Corrupt:    2,
+		Updated:    time.Now().Add(-scoreHalfLife),
+	}
+	s.mu.Lock()
+	ps := s.get("a")
+	s.mu.Unlock()
+	const slack = 0.01
+	if math.Abs(ps.Successes-4) > slack || math.Abs(ps.Errors-2) > slack || math.Abs(ps.Corrupt-1) > slack {
+		t.Errorf("counts after a half-life = %.2f, %.2f, %.2f, want 4, 2, 1", ps.Successes, ps.Errors, ps.Corrupt)
+	}
+	if want := priorThroughput * 0.75; math.Abs(ps.Throughput-want) > want*slack {
+		t.Errorf("throughput after a half-life = %.0f, want %.0f", ps.Throughput, want)
+	}
+}
+
+func TestPeerScoresRTT(t *testing.T) {
+	s := NewPeerScores()
+	near, far := testPeer("near"), common.PeerInfo{ID: "far", IP: "198.51.100.1", Port: 4040}
+	s.rtt[peerAddr(near)] = 5 * time.Millisecond
+	s.rtt[peerAddr(far)] = 200 * time.Millisecond
+	if s.score(near) <= s.score(far) {
+		t.Error("unmeasured peers are not ranked by round trip")
+	}
+	if got := s.rttOf(far); got != 200*time.Millisecond {
+		t.Errorf("rttOf = %s, want 200ms", got)
+	}
+}
+
+func TestPeerScoresPick(t *testing.T) {
+	s := NewPeerScores()
+	peers := []common.PeerInfo{testPeer("a"), testPeer("b"), testPeer("c")}
+	s.success(peers[1], common.ChunkSize, 10*time.Millisecond)
+	noLoad := func(string) int { return 0 }
+
+	picked := make(map[string]int)
+	for range 1000 {
+		p, ok := s.pick(peers, noLoad)
+		if !ok {
+			t.Fatal("no peer picked")
+		}
+		picked[p.ID]++
+	}
+	// Apart from exploration the best peer is always picked.
+	if picked["b"] < 850 || picked["a"] == 0 || picked["c"] == 0 {
+		t.Errorf("picks %v, want mostly b and some of the others", picked)
+	}
+
+	// Load shares a peer's throughput between its requests.
+	loaded := func(id string) int {
+		if id == "b" {
+			return 100
+		}
+		return 0
+	}
+	picked = make(map[string]int)
+	for range 1000 {
+		p, _ := s.pick(peers, loaded)
+		picked[p.ID]++
+	}
+	if picked["b"] > 100 {
+		t.Errorf("picks %v, want the loaded peer avoided", picked)
+	}
+
+	if _, ok := s.pick(nil, noLoad); ok {
+		t.Error("picked a peer from none")
+	}
+}
+
+func TestPeerScoresSaveLoad(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "scores", "scores.json")
+	s := NewPeerScores()
+	s.success(testPeer("a"), common.ChunkSize, time.Second)
+	s.failure("b")
+	if err := s.Save(path); err != nil {
+		t.Fatal(err)
+	}
+	loaded, err := LoadPeerScores(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(loaded.peers) != 2 || loaded.peers["a"].Successes != 1 || loaded.peers["b"].Errors != 1 {
+		t.Errorf("loaded %+v", loaded.peers)
+	}
+
+	for _, data := range []string{`null`, `{"a": null}`} {
+		writeFile(t, path, []byte(data))
+		loaded, err := LoadPeerScores(path)
+		if err != nil {
+			t.Fatalf("loading %s: %v", data, err)
+		}
+		if len(loaded.peers) != 0 {
+			t.Errorf("loading %s gave %v", data, loaded.peers)
+		}
+		loaded.failure("a") // must not panic
+	}
+
+	if _, err := LoadPeerScores(filepath.Join(t.TempDir(), "missing.json")); err != nil {
+		t.Errorf("loading a missing file: %v", err)
+	}
+	writeFile(t, path, []byte("{"))
+	if _, err := LoadPeerScores(path); err == nil {
+		t.Error("loaded a corrupt file")
+	}
+}
@@ -1,15 +1,21 @@
 package p2p
 
 import (
+	"context"
 	"encoding/json"
 	"fmt"
 	"log"
+	"net"
 	"net/http"
 	"strconv"
 	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 
 	"dropeer/internal/common"
 
+	"github.com/quic-go/quic-go"
 	"github.com/quic-go/quic-go/http3"
 )
 
@@ -17,49 +23,153 @@ import (
 type P2PServer struct {
 	fileManager *FileManager
 	addr        string
+	logger      common.Logger
+	metrics     *serverMetrics
+	uploaded    sync.Map // fileHash -> *atomic.Int64
+
+	mu        sync.Mutex
+	conn      *net.UDPConn
+	transport *quic.Transport
 }
 
-// NewP2PServer creates a new peer server.
-func NewP2PServer(fileManager *FileManager, addr string) *P2PServer {
+// NewP2PServer creates a new peer server. A nil logger logs to the standard logger.
+func NewP2PServer(fileManager *FileManager, addr string, logger common.Logger) *P2PServer {
+	if logger == nil {
+		logger = log.Default()
+	}
 	return &P2PServer{
 		fileManager: fileManager,
 		addr:        addr,
+		logger:      logger,
+		metrics:     newServerMetrics(),
 	}
 }
 
-// Start runs the P2P server.
-func (s *P2PServer) Start() error {
+// Handler returns the handler of the peer API, which Start serves. Requests
+// arriving through a relay are handled by it too.
+func (s *P2PServer) Handler() http.Handler {
 	mux := http.NewServeMux()
-	mux.HandleFunc("/metadata/", s.metadataHandler)
-	mux.HandleFunc("/chunk/", s.chunkHandler)
-	mux.HandleFunc("/speedtest", s.speedTestHandler)
+	mux.HandleFunc("/metadata/", s.instrument("metadata", s.metadataHandler))
+	mux.HandleFunc("/chunk/", s.instrument("chunk", s.chunkHandler))
+	mux.HandleFunc("/range/", s.instrument("range", s.rangeHandler))
+	mux.HandleFunc("/speedtest", s.instrument("speedtest", s.speedTestHandler))
+	mux.HandleFunc("/ping", func(w http.ResponseWriter, r *http.Request) { w.WriteHeader(http.StatusNoContent) })
+	return mux
+}
 
+// Start runs the P2P server until ctx is done.
+func (s *P2PServer) Start(ctx context.Context) error {
 	tlsConfig, err := common.GenerateTLSConfig()
 	if err != nil {
 		return fmt.Errorf("failed to generate TLS config: %w", err)
 	}
 
-	server := http3.Server{
-		Addr:      s.addr,
-		Handler:   mux,
-		TLSConfig: tlsConfig,
+	transport, err := s.Transport()
+	if err != nil {
+		return err
+	}
+	ln, err := transport.ListenEarly(http3.ConfigureTLSConfig(tlsConfig), &quic.Config{Allow0RTT: true})
+	if err != nil {
+		return fmt.Errorf("failed to listen: %w", err)
+	}
+	server := http3.Server{Handler: s.Handler()}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+		transport.Close()
+		s.conn.Close()
+	}()
+
+	s.logger.Printf("P2P server listening on %s (QUIC/HTTP3)", s.addr)
+	err = server.ServeListener(ln)
+	if ctx.Err() != nil {
+		return nil
+	}
+	return err
+}
+
+// Transport returns the QUIC transport on the server's UDP socket, opening
+// the socket on first use. Start serves on it, and it can also be used to
+// dial other peers from the same address.
+func (s *P2PServer) Transport() (*quic.Transport, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.transport != nil {
+		return s.transport, nil
+	}
+	addr, err := net.ResolveUDPAddr("udp", s.addr)
+	if err != nil {
+		return nil, fmt.Errorf("invalid listen address: %w", err)
+	}
+	conn, err := net.ListenUDP("udp", addr)
+	if err != nil {
+		return nil, fmt.Errorf("failed to listen: %w", err)
+	}
+	s.conn = conn
+	s.transport = &quic.Transport{Conn: conn}
+	return s.transport, nil
+}
+
+// Uploaded returns how many chunk bytes of a file have been served.
+func (s *P2PServer) Uploaded(fileHash string) int64 {
+	if counter, ok := s.uploaded.Load(fileHash); ok {
+		return counter.(*atomic.Int64).Load()
+	}
+	return 0
+}
+
+// ServeMetrics serves Prometheus metrics over plain HTTP on addr until ctx
+// is done. addr should normally be a localhost address.
+func (s *P2PServer) ServeMetrics(ctx context.Context, addr string) error {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", s.metrics.handler())
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	go func() {
+		<-ctx.Done()
+		server.Close()
+	}()
+
+	s.logger.Printf("P2P metrics listening on %s", addr)
+	err := server.ListenAndServe()
+	if ctx.Err() != nil {
+		return nil
 	}
+	return err
+}
+
+// statusRecorder captures the status code written by a handler.
+type statusRecorder struct {
+	http.ResponseWriter
+	status int
+}
+
+func (r *statusRecorder) WriteHeader(status int) {
+	r.status = status
+	r.ResponseWriter.WriteHeader(status)
+}
 
-	log.Printf("P2P server listening on %s (QUIC/HTTP3)", s.addr)
-	return server.ListenAndServe()
+// instrument counts the failed requests of handler.
+func (s *P2PServer) instrument(name string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		rec := &statusRecorder{ResponseWriter: w, status: http.StatusOK}
+		handler(rec, r)
+		if rec.status >= 400 {
+			s.metrics.errors.WithLabelValues(name, strconv.Itoa(rec.status)).Inc()
+		}
+	}
 }
 
 func (s *P2PServer) metadataHandler(w http.ResponseWriter, r *http.Request) {
 	hash := strings.TrimPrefix(r.URL.Path, "/metadata/")
-	filePath, ok := s.fileManager.GetFilePath(hash)
-	if !ok {
+	if !s.fileManager.Check(hash) {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
-
-	meta, err := GetFileMetadata(filePath)
-	if err != nil {
-		http.Error(w, "could not get file metadata", http.StatusInternalServerError)
+	meta, ok := s.fileManager.GetMetadata(hash)
+	if !ok {
+		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
 
@@ -80,21 +190,59 @@ func (s *P2PServer) chunkHandler(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "invalid chunk index", http.StatusBadRequest)
 		return
 	}
+	s.serveData(w, r, hash, func(filePath string) ([]byte, error) {
+		return ReadChunk(filePath, index)
+	})
+}
+
+// rangeHandler serves a byte range of a file, which is how content-defined
+// chunks are requested.
+func (s *P2PServer) rangeHandler(w http.ResponseWriter, r *http.Request) {
+	parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/range/"), "/")
+	if len(parts) != 3 {
+		http.Error(w, "invalid range request format: /range/{hash}/{offset}/{size}", http.StatusBadRequest)
+		return
+	}
+	offset, err := strconv.ParseInt(parts[1], 10, 64)
+	size, err2 := strconv.ParseInt(parts[2], 10, 64)
+	if err != nil || err2 != nil || offset < 0 || size <= 0 || size > cdcMaxSize {
+		http.Error(w, "invalid range", http.StatusBadRequest)
+		return
+	}
+	s.serveData(w, r, parts[0], func(filePath string) ([]byte, error) {
+		return ReadRange(filePath, offset, size)
+	})
+}
+
+// serveData sends the data read by read from the shared file with the
+// given hash.
+func (s *P2PServer) serveData(w http.ResponseWriter, r *http.Request, hash string, read func(filePath string) ([]byte, error)) {
+	start := time.Now()
+	s.metrics.activeTransfers.Inc()
+	defer s.metrics.activeTransfers.Dec()
 
+	if !s.fileManager.Check(hash) {
+		http.Error(w, "file not found", http.StatusNotFound)
+		return
+	}
 	filePath, ok := s.fileManager.GetFilePath(hash)
 	if !ok {
 		http.Error(w, "file not found", http.StatusNotFound)
 		return
 	}
 
-	chunk, err := ReadChunk(filePath, index)
+	chunk, err := read(filePath)
 	if err != nil {
 		http.Error(w, "failed to read chunk", http.StatusInternalServerError)
 		return
 	}
 
 	w.Header().Set("Content-Type", "application/octet-stream")
-	w.Write(chunk)
+	n, _ := w.Write(chunk)
+	counter, _ := s.uploaded.LoadOrStore(hash, new(atomic.Int64))
+	counter.(*atomic.Int64).Add(int64(n))
+	s.metrics.bytesServed.WithLabelValues(hash, remoteHost(r)).Add(float64(n))
+	s.metrics.chunkDuration.Observe(time.Since(start).Seconds())
 }
 
 func (s *P2PServer) speedTestHandler(w http.ResponseWriter, r *http.Request) {
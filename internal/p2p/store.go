@@ -0,0 +1,248 @@
+package p2p
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// Store is a directory of files kept under their hashes, at
+// objects/<hash[:2]>/<hash>, so that they are seeded no matter what happens
+// to the copies handed out to the user. A catalog next to the objects records
+// their names and when they were last used.
+type Store struct {
+	dir    string
+	files  *FileManager
+	logger common.Logger
+
+	mu      sync.Mutex
+	catalog map[string]*StoreEntry // fileHash -> entry
+}
+
+// StoreEntry describes a file in a Store.
+type StoreEntry struct {
+	Name     string    `json:"name"`
+	Size     int64     `json:"size"`
+	Added    time.Time `json:"added"`
+	LastUsed time.Time `json:"last_used"`
+}
+
+// OpenStore opens the store in dir, creating it if needed. Its files are
+// shared through files once Load is called.
+func OpenStore(dir string, files *FileManager, logger common.Logger) (*Store, error) {
+	if err := os.MkdirAll(filepath.Join(dir, "objects"), 0o755); err != nil {
+		return nil, err
+	}
+	s := &Store{dir: dir, files: files, logger: logger, catalog: make(map[string]*StoreEntry)}
+	data, err := os.ReadFile(s.catalogPath())
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+	if len(data) > 0 {
+		if err := json.Unmarshal(data, &s.catalog); err != nil {
+			return nil, fmt.Errorf("could not read store catalog: %w", err)
+		}
+	}
+	for hash, e := range s.catalog {
+		if !common.ValidHash(hash) || e == nil {
+			logger.Printf("Ignoring invalid store catalog entry %q", hash)
+			delete(s.catalog, hash)
+		}
+	}
+	return s, nil
+}
+
+func (s *Store) catalogPath() string {
+	return filepath.Join(s.dir, "catalog.json")
+}
+
+// Path returns where the file with the given hash is kept.
+func (s *Store) Path(hash string) string {
+	return filepath.Join(s.dir, "objects", hash[:2], hash)
+}
+
+// Has reports whether the store holds the file with the given hash.
+func (s *Store) Has(hash string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	_, ok := s.catalog[hash]
+	s.mu.Unlock()
+	if !ok {
+		return false
+	}
+	_, err := os.Stat(s.Path(hash))
+	return err == nil
+}
+
+// shares reports whether the file shared under hash is the stored object,
+// rather than a copy of it elsewhere that is shared on its own.
+func (s *Store) shares(hash string) bool {
+	path, ok := s.files.GetFilePath(hash)
+	return ok && path == s.Path(hash)
+}
+
+// Hashes returns the hashes of the files in the store.
+func (s *Store) Hashes() []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([]string, 0, len(s.catalog))
+	for hash := range s.catalog {
+		hashes = append(hashes, hash)
+	}
+	sort.Strings(hashes)
+	return hashes
+}
+
+// Load shares every file in the store under the name it was stored with.
+// Files that are missing or no longer match their hash are dropped from the
+// catalog.
+func (s *Store) Load() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for hash, e := range s.catalog {
+		if _, shared := s.files.GetFilePath(hash); shared {
+			// Already shared from elsewhere.
+			continue
+		}
+		got, err := s.files.AddFile(s.Path(hash))
+		if err == nil && got != hash {
+			if s.shares(got) {
+				s.files.RemoveFile(got)
+			}
+			err = &HashMismatchError{Expected: hash, Got: got}
+		}
+		if err != nil {
+			s.logger.Printf("Dropping %s from the store: %v", hash[:10], err)
+			delete(s.catalog, hash)
+			continue
+		}
+		s.files.setName(hash, e.Name)
+	}
+	if err := s.save(); err != nil {
+		s.logger.Printf("Could not save store catalog: %v", err)
+	}
+}
+
+// Add records the file downloaded to Path(hash) under name. It must already
+// be shared, as DownloadFile does.
+func (s *Store) Add(hash, name string) error {
+	stat, err := os.Stat(s.Path(hash))
+	if err != nil {
+		return err
+	}
+	s.files.setName(hash, name)
+	now := time.Now()
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.catalog[hash] = &StoreEntry{Name: name, Size: stat.Size(), Added: now, LastUsed: now}
+	return s.save()
+}
+
+// Export places a copy of the file with the given hash at dst: a hard link
+// if link is set, otherwise a reflink or plain copy. A hard link is the
+// stored object itself, so editing it corrupts the store: the object stops
+// being seeded once the change is noticed and is dropped on the next Load.
+func (s *Store) Export(hash, dst string, link bool) error {
+	tmp := TempPath(dst)
+	if err := copyLocal(s.Path(hash), tmp, link); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp, dst); err != nil {
+		os.Remove(tmp)
+		return err
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if e, ok := s.catalog[hash]; ok {
+		e.LastUsed = time.Now()
+	}
+	return s.save()
+}
+
+// GC removes files not used for longer than retention, then the least
+// recently used files until the store fits in quota bytes. Zero disables
+// either limit. It returns the hashes of the removed files, which are no
+// longer shared.
+func (s *Store) GC(quota int64, retention time.Duration) []string {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	hashes := make([]string, 0, len(s.catalog))
+	var total int64
+	for hash, e := range s.catalog {
+		hashes = append(hashes, hash)
+		total += e.Size
+	}
+	sort.Slice(hashes, func(i, j int) bool {
+		return s.catalog[hashes[i]].LastUsed.Before(s.catalog[hashes[j]].LastUsed)
+	})
+
+	var removed []string
+	for _, hash := range hashes {
+		e := s.catalog[hash]
+		expired := retention > 0 && time.Since(e.LastUsed) > retention
+		if !expired && (quota <= 0 || total <= quota) {
+			continue
+		}
+		if s.shares(hash) {
+			s.files.RemoveFile(hash)
+		}
+		if err := os.Remove(s.Path(hash)); err != nil && !os.IsNotExist(err) {
+			s.logger.Printf("Could not remove %s from the store: %v", hash[:10], err)
+			continue
+		}
+		delete(s.catalog, hash)
+		total -= e.Size
+		removed = append(removed, hash)
+	}
+	if len(removed) > 0 {
+		if err := s.save(); err != nil {
+			s.logger.Printf("Could not save store catalog: %v", err)
+		}
+	}
+	return removed
+}
+
+// Release moves the file downloaded to Path(hash) to dst instead of
+// keeping it in the store, and shares it from there.
+func (s *Store) Release(hash, dst string) error {
+	src := s.Path(hash)
+	meta, shared := s.files.GetMetadata(hash)
+	if err := os.Rename(src, dst); err != nil {
+		// Most likely dst is on another file system.
+		tmp := TempPath(dst)
+		if err := copyLocal(src, tmp, false); err != nil {
+			return err
+		}
+		if err := os.Rename(tmp, dst); err != nil {
+			os.Remove(tmp)
+			return err
+		}
+		os.Remove(src)
+	}
+	if shared && s.shares(hash) {
+		s.files.RemoveFile(hash)
+		return s.files.addHashed(dst, meta)
+	}
+	return nil
+}
+
+// save writes the catalog to disk. The caller must hold s.mu.
+func (s *Store) save() error {
+	data, err := json.Marshal(s.catalog)
+	if err != nil {
+		return err
+	}
+	tmp := s.catalogPath() + ".tmp"
+	if err := os.WriteFile(tmp, data, 0o644); err != nil {
+		return err
+	}
+	return os.Rename(tmp, s.catalogPath())
+}
@@ -0,0 +1,176 @@
+package p2p
+
+import (
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+)
+
+// addToStore stores data as DownloadFile and Node.Get would, last used age
+// ago, and returns its hash.
+func addToStore(t *testing.T, s *Store, data []byte, age time.Duration) string {
+	t.Helper()
+	src := filepath.Join(t.TempDir(), "src")
+	writeFile(t, src, data)
+	hash, err := HashFile(src)
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := s.Path(hash)
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Rename(src, path); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := s.files.AddFile(path); err != nil {
+		t.Fatal(err)
+	}
+	if err := s.Add(hash, "name"); err != nil {
+		t.Fatal(err)
+	}
+	s.catalog[hash].LastUsed = time.Now().Add(-age)
+	return hash
+}
+
+func newTestStore(t *testing.T) *Store {
+	t.Helper()
+	logger := log.New(io.Discard, "", 0)
+	s, err := OpenStore(t.TempDir(), NewFileManager(nil, logger), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestStoreGC(t *testing.T) {
+	type file struct {
+		size int
+		age  time.Duration
+	}
+	tests := []struct {
+		name      string
+		files     []file
+		quota     int64
+		retention time.Duration
+		removed   []int // indexes into files
+	}{
+		{
+			name:  "no limits",
+			files: []file{{100, time.Hour}, {100, 48 * time.Hour}},
+		},
+		{
+			name:      "retention",
+			files:     []file{{100, time.Hour}, {100, 48 * time.Hour}, {100, 25 * time.Hour}},
+			retention: 24 * time.Hour,
+			removed:   []int{1, 2},
+		},
+		{
+			name:    "quota removes least recently used first",
+			files:   []file{{100, time.Hour}, {100, 3 * time.Hour}, {100, 2 * time.Hour}},
+			quota:   150,
+			removed: []int{1, 2},
+		},
+		{
+			name:  "within quota",
+			files: []file{{100, time.Hour}, {100, 2 * time.Hour}},
+			quota: 200,
+		},
+		{
+			name:      "retention then quota",
+			files:     []file{{100, time.Hour}, {100, 48 * time.Hour}, {300, 2 * time.Hour}},
+			quota:     200,
+			retention: 24 * time.Hour,
+			removed:   []int{1, 2},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			s := newTestStore(t)
+			var hashes []string
+			for i, f := range tt.files {
+				data := randomData(byte(i), f.size)
+				hashes = append(hashes, addToStore(t, s, data, f.age))
+			}
+
+			removed := s.GC(tt.quota, tt.retention)
+			var want []string
+			for _, i := range tt.removed {
+				want = append(want, hashes[i])
+			}
+			slices.Sort(removed)
+			slices.Sort(want)
+			if !slices.Equal(removed, want) {
+				t.Fatalf("GC removed %v, want %v", removed, want)
+			}
+			for _, hash := range hashes {
+				gone := slices.Contains(want, hash)
+				if s.Has(hash) == gone {
+					t.Errorf("Has(%s) = %v after GC", hash[:10], !gone)
+				}
+				if _, shared := s.files.GetFilePath(hash); shared == gone {
+					t.Errorf("%s shared = %v after GC", hash[:10], shared)
+				}
+				if _, err := os.Stat(s.Path(hash)); os.IsNotExist(err) != gone {
+					t.Errorf("%s object exists = %v after GC", hash[:10], !gone)
+				}
+			}
+		})
+	}
+}
+
+func TestStoreGCKeepsOtherShares(t *testing.T) {
+	s := newTestStore(t)
+	data := randomData(1, 100)
+	hash := addToStore(t, s, data, 48*time.Hour)
+
+	// The same content shared from elsewhere stays shared.
+	other := filepath.Join(t.TempDir(), "other")
+	writeFile(t, other, data)
+	if _, err := s.files.AddFile(other); err != nil {
+		t.Fatal(err)
+	}
+	if removed := s.GC(0, time.Hour); len(removed) != 1 {
+		t.Fatalf("GC removed %v, want %s", removed, hash[:10])
+	}
+	if path, ok := s.files.GetFilePath(hash); !ok || path != other {
+		t.Errorf("file shared from %q (%v), want %q", path, ok, other)
+	}
+}
+
+func TestStoreCatalog(t *testing.T) {
+	s := newTestStore(t)
+	hash := addToStore(t, s, randomData(1, 100), 0)
+	missing := addToStore(t, s, randomData(2, 100), 0)
+	if err := os.Remove(s.Path(missing)); err != nil {
+		t.Fatal(err)
+	}
+	if s.Has(missing) {
+		t.Error("Has reports a file whose object is gone")
+	}
+
+	// Corrupt entries in the catalog are ignored rather than crashing.
+	data, err := os.ReadFile(s.catalogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	data = append(data[:len(data)-1], `,"ab":{},"`+hash[:63]+`z":{},"`+hash[:10]+`":null}`...)
+	writeFile(t, s.catalogPath(), data)
+
+	logger := log.New(io.Discard, "", 0)
+	reopened, err := OpenStore(s.dir, NewFileManager(nil, logger), logger)
+	if err != nil {
+		t.Fatal(err)
+	}
+	reopened.Load()
+	if got := reopened.Hashes(); !slices.Equal(got, []string{hash}) {
+		t.Errorf("reopened store holds %v, want [%s]", got, hash)
+	}
+	if path, ok := reopened.files.GetFilePath(hash); !ok || path != reopened.Path(hash) {
+		t.Errorf("stored file shared from %q (%v), want %q", path, ok, reopened.Path(hash))
+	}
+}
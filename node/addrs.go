@@ -0,0 +1,120 @@
+package node
+
+import (
+	"fmt"
+	"net"
+	"net/netip"
+	"net/url"
+)
+
+// localAddrs returns the unicast addresses of the up, non-loopback
+// interfaces, IPv4 and IPv6 alike, or only those of the interface named
+// iface if it is not empty. Link-local IPv6 addresses carry the interface
+// name as their zone.
+func localAddrs(iface string) ([]string, error) {
+	var ifaces []net.Interface
+	if iface != "" {
+		i, err := net.InterfaceByName(iface)
+		if err != nil {
+			return nil, fmt.Errorf("interface %q: %w", iface, err)
+		}
+		ifaces = []net.Interface{*i}
+	} else {
+		var err error
+		if ifaces, err = net.Interfaces(); err != nil {
+			return nil, err
+		}
+	}
+	var addrs []string
+	for _, iface := range ifaces {
+		if iface.Flags&net.FlagUp == 0 || iface.Flags&net.FlagLoopback != 0 {
+			continue
+		}
+		ifaceAddrs, err := iface.Addrs()
+		if err != nil {
+			continue
+		}
+		for _, a := range ifaceAddrs {
+			ipNet, ok := a.(*net.IPNet)
+			if !ok {
+				continue
+			}
+			addr, ok := netip.AddrFromSlice(ipNet.IP)
+			if !ok {
+				continue
+			}
+			addr = addr.Unmap()
+			switch {
+			case addr.IsGlobalUnicast():
+			case addr.Is6() && addr.IsLinkLocalUnicast():
+				addr = addr.WithZone(iface.Name)
+			default:
+				continue
+			}
+			addrs = append(addrs, addr.String())
+		}
+	}
+	return addrs, nil
+}
+
+// routeAddr returns the local address the system would use to reach the
+// host of trackerURL. Connecting a UDP socket sends nothing, so this works
+// without a default route as long as the tracker itself is reachable.
+func routeAddr(trackerURL string) (netip.Addr, bool) {
+	u, err := url.Parse(trackerURL)
+	if err != nil || u.Hostname() == "" {
+		return netip.Addr{}, false
+	}
+	port := u.Port()
+	if port == "" {
+		port = "443"
+	}
+	conn, err := net.Dial("udp", net.JoinHostPort(u.Hostname(), port))
+	if err != nil {
+		return netip.Addr{}, false
+	}
+	defer conn.Close()
+	addr, ok := conn.LocalAddr().(*net.UDPAddr)
+	if !ok {
+		return netip.Addr{}, false
+	}
+	return addr.AddrPort().Addr().Unmap(), true
+}
+
+// chooseAddrs returns the addresses to announce and the primary one among
+// them. Advertised addresses, if any, are used as given with the first as
+// primary. Otherwise the addresses of iface, or of all interfaces, are used,
+// preferring the one that routes to the tracker, then any IPv4 address. The
+// primary address is empty if none is found; the tracker then records the
+// address the node connects from.
+func chooseAddrs(trackerURL, iface string, advertise []string) (primary string, addrs []string, err error) {
+	if len(advertise) > 0 {
+		for _, a := range advertise {
+			if _, err := netip.ParseAddr(a); err != nil {
+				return "", nil, fmt.Errorf("invalid advertised address %q", a)
+			}
+		}
+		return advertise[0], advertise, nil
+	}
+
+	addrs, err = localAddrs(iface)
+	if err != nil {
+		return "", nil, err
+	}
+	if route, ok := routeAddr(trackerURL); ok {
+		for _, a := range addrs {
+			if addr, _ := netip.ParseAddr(a); addr.WithZone("") == route.WithZone("") {
+				return a, addrs, nil
+			}
+		}
+	}
+	for _, a := range addrs {
+		if addr, _ := netip.ParseAddr(a); addr.Is4() {
+			return a, addrs, nil
+		}
+	}
+	if len(addrs) > 0 {
+		return addrs[0], addrs, nil
+	}
+	return "", nil, nil
+}
@@ -0,0 +1,110 @@
+package node
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+)
+
+// progressAnnounceInterval is how often a running download reports its
+// progress to the tracker.
+const progressAnnounceInterval = 30 * time.Second
+
+// transfers returns the bytes of a file this node has uploaded and
+// downloaded, for announces.
+func (n *Node) transfers(fileHash string) (uploaded, downloaded int64) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	return n.server.Uploaded(fileHash), n.downloaded[fileHash]
+}
+
+// announcer reports the state of a download to the tracker as its progress
+// events arrive.
+type announcer struct {
+	node     *Node
+	ctx      context.Context
+	fileHash string
+
+	mu        sync.Mutex
+	bytesDone int64 // as of the last event
+	last      time.Time
+	pending   sync.WaitGroup
+}
+
+// update handles a progress event. Announces are sent in the background so
+// they do not hold up the download.
+func (a *announcer) update(ev ProgressEvent) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+
+	if ev.Kind != EventStarted {
+		a.node.mu.Lock()
+		a.node.downloaded[a.fileHash] += ev.BytesDone - a.bytesDone
+		a.node.mu.Unlock()
+	}
+	a.bytesDone = ev.BytesDone
+
+	var event string
+	switch {
+	case ev.Kind == EventStarted:
+		event = common.AnnounceStarted
+	case ev.Kind == EventChunkDone && time.Since(a.last) >= progressAnnounceInterval:
+		event = common.AnnounceProgress
+	default:
+		return
+	}
+	a.last = time.Now()
+	left := max(ev.BytesTotal-ev.BytesDone, 1) // a download is never a seeder
+	a.pending.Add(1)
+	go func() {
+		defer a.pending.Done()
+		if err := a.node.tracker.announce(a.ctx, a.fileHash, event, left); err != nil {
+			a.node.logger.Printf("Could not announce download progress: %v", err)
+		}
+	}()
+}
+
+// announced reports whether the download was announced to the tracker.
+func (a *announcer) announced() bool {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	return !a.last.IsZero()
+}
+
+// finish waits for pending announces and then sends the final one, so the
+// tracker does not see progress after the download has ended.
+func (a *announcer) finish(event string) error {
+	a.pending.Wait()
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(a.ctx), 5*time.Second)
+	defer cancel()
+	return a.node.tracker.announce(ctx, a.fileHash, event, 0)
+}
+
+// stopAnnounces tells the tracker this node is leaving the swarms of all its
+// shared files.
+func (n *Node) stopAnnounces() {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	for _, hash := range n.fileManager.Hashes() {
+		if err := n.tracker.announce(ctx, hash, common.AnnounceStopped, 0); err != nil {
+			n.logger.Printf("Could not announce leaving the swarm of %s: %v", hash[:10], err)
+		}
+	}
+}
+
+// seeders returns the peers that have the whole file, or all peers if none
+// do. Peers still downloading cannot serve chunks yet.
+func seeders(peers []PeerInfo) []PeerInfo {
+	var complete []PeerInfo
+	for _, p := range peers {
+		if p.Left == 0 {
+			complete = append(complete, p)
+		}
+	}
+	if len(complete) == 0 {
+		return peers
+	}
+	return complete
+}
@@ -0,0 +1,51 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+
+	"dropeer/internal/discovery"
+	"dropeer/internal/p2p"
+)
+
+var (
+	// ErrNoPeers is returned when the tracker lists no peers for a file.
+	ErrNoPeers = p2p.ErrNoPeers
+	// ErrNoReachablePeers is returned when none of a file's peers can be reached.
+	ErrNoReachablePeers = p2p.ErrNoReachablePeers
+	// ErrTrackerNotFound is returned when no tracker is discovered on the LAN.
+	ErrTrackerNotFound = discovery.ErrTrackerNotFound
+	// ErrUnknownFile is returned when the tracker has no record of a file.
+	ErrUnknownFile = errors.New("file not known to tracker")
+	// ErrUnauthorized is returned when the tracker rejects the node's token.
+	ErrUnauthorized = errors.New("tracker rejected token")
+	// ErrNotShared is returned when unsharing a file that is not shared.
+	ErrNotShared = errors.New("file is not shared")
+)
+
+type (
+	// PeerError reports a failed request to a peer.
+	PeerError = p2p.PeerError
+	// ChunksFailedError is returned when some chunks could not be downloaded.
+	ChunksFailedError = p2p.ChunksFailedError
+	// HashMismatchError is returned when a downloaded file does not match its hash.
+	HashMismatchError = p2p.HashMismatchError
+	// InsufficientSpaceError is returned when the disk has no room for a download.
+	InsufficientSpaceError = p2p.InsufficientSpaceError
+)
+
+// TrackerError reports a failed request to the tracker.
+type TrackerError struct {
+	Op         string // "announce", "withdraw" or "want"
+	StatusCode int    // HTTP status, 0 if no response was received
+	Err        error
+}
+
+func (e *TrackerError) Error() string {
+	if e.StatusCode != 0 {
+		return fmt.Sprintf("tracker %s failed with status %d: %v", e.Op, e.StatusCode, e.Err)
+	}
+	return fmt.Sprintf("tracker %s failed: %v", e.Op, e.Err)
+}
+
+func (e *TrackerError) Unwrap() error { return e.Err }
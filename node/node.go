@@ -0,0 +1,707 @@
+// Package node is the embeddable API of a dropeer peer. A Node shares local
+// files with the swarm and downloads files from it.
+package node
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"dropeer/internal/common"
+	"dropeer/internal/discovery"
+	"dropeer/internal/p2p"
+)
+
+type (
+	// Logger receives the node's log output. *log.Logger satisfies it.
+	Logger = common.Logger
+	// PeerInfo holds information about a peer.
+	PeerInfo = common.PeerInfo
+	// FileMetadata describes a shared file.
+	FileMetadata = common.FileMetadata
+	// Link is a shareable reference to a file in the swarm.
+	Link = common.Link
+	// DownloadOptions configures a download.
+	DownloadOptions = p2p.DownloadOptions
+	// ProgressEvent describes the progress of a download.
+	ProgressEvent = p2p.ProgressEvent
+	// EventKind identifies the kind of a ProgressEvent.
+	EventKind = p2p.EventKind
+	// TempPolicy decides what happens to the temp file of a failed download.
+	TempPolicy = p2p.TempPolicy
+)
+
+// Temp file policies.
+const (
+	TempResume = p2p.TempResume
+	TempKeep   = p2p.TempKeep
+	TempRemove = p2p.TempRemove
+)
+
+// Kinds of progress events.
+const (
+	EventStarted   = p2p.EventStarted
+	EventChunkDone = p2p.EventChunkDone
+	EventRetry     = p2p.EventRetry
+	EventVerified  = p2p.EventVerified
+)
+
+// storeGCInterval is how often the store's quota and retention are enforced
+// besides after each download.
+const storeGCInterval = 10 * time.Minute
+
+// ParseLink parses a share link or a bare file hash.
+func ParseLink(s string) (Link, error) {
+	return common.ParseLink(s)
+}
+
+// ValidHash reports whether s is a hex-encoded SHA256 file hash.
+func ValidHash(s string) bool {
+	return common.ValidHash(s)
+}
+
+// TempPath returns the path a download to outputPath is written to until it
+// completes. A cancelled download leaves its partial data there.
+func TempPath(outputPath string) string {
+	return p2p.TempPath(outputPath)
+}
+
+// Config configures a Node. Zero values select the defaults.
+type Config struct {
+	// TrackerURL is the tracker's base URL. If empty the tracker is
+	// discovered on the LAN with mDNS.
+	TrackerURL string
+	// TrackerFingerprint, if set, is the hex SHA-256 of the tracker's TLS
+	// certificate, and no other certificate is accepted. Otherwise the
+	// certificate is verified against the system roots. A discovered tracker
+	// advertises its fingerprint.
+	TrackerFingerprint string
+	// TrackerHTTP3 makes the node talk to the tracker over HTTP/3.
+	TrackerHTTP3 bool
+	// Rendezvous is the UDP address of the tracker's rendezvous service,
+	// through which peers behind NATs are connected by hole punching. A
+	// discovered tracker advertises it. If empty, peers are only reached at
+	// their own addresses.
+	Rendezvous string
+	// Relay is the base URL of a relay for peers that cannot be reached
+	// directly, normally the tracker itself, and is reached with the
+	// tracker's TLS settings and token. A discovered tracker that relays is
+	// used. If empty, no relay is used.
+	Relay string
+	// Token is the bearer token sent to the tracker, if it requires one.
+	// The token's scope decides which swarms the node can join.
+	Token string
+	// Port is the UDP port the node serves files on. Defaults to 4040.
+	Port int
+	// Interface, if set, restricts the addresses announced to the tracker
+	// to those of the named network interface.
+	Interface string
+	// AdvertiseAddrs, if set, are announced to the tracker instead of the
+	// detected addresses, the first as the primary one. Use it when peers
+	// reach this node at an address it cannot see, such as behind NAT.
+	AdvertiseAddrs []string
+	// IndexPath is where file hashes are cached between runs. Defaults to
+	// p2p.DefaultIndexPath; if the index cannot be opened hashes are kept
+	// in memory.
+	IndexPath string
+	// MetricsAddr, if set, is the address Prometheus metrics are served on
+	// over plain HTTP, such as "127.0.0.1:9100".
+	MetricsAddr string
+	// Logger receives log output. Defaults to the standard logger.
+	Logger Logger
+	// HeartbeatInterval is how often shared files are re-announced. Defaults to 2 minutes.
+	HeartbeatInterval time.Duration
+	// FileWatchInterval is how often shared files are checked for
+	// modification. Defaults to 10 seconds.
+	FileWatchInterval time.Duration
+	// IdentityPath is where the node's identity key is kept. The peer ID is
+	// derived from it and the tracker checks announces are signed with it.
+	// Defaults to common.DefaultIdentityPath; if the key cannot be loaded a
+	// new one is used for this run only.
+	IdentityPath string
+	// ScoresPath, if set, is where peer scores are kept between runs, so
+	// downloads start out preferring the peers that served well before.
+	ScoresPath string
+	// LocalDirs are directories searched for files and chunks that a
+	// download can reuse instead of fetching them from peers, besides the
+	// shared files. Their files are hashed once and kept in the index.
+	LocalDirs []string
+	// ContentDefinedChunking splits files into chunks cut by their content
+	// rather than every 1 MiB, so versions of a file share most chunks and
+	// a download only fetches those not found in local files or in the old
+	// version at the output path. Peers need not agree on it.
+	ContentDefinedChunking bool
+	// StoreDir, if set, is a store that downloads are kept in by hash and
+	// seeded from, and only copied or linked to the requested output path,
+	// so moving or deleting the output does not stop seeding.
+	StoreDir string
+	// StoreQuota, if positive, is how many bytes the store may hold before
+	// the least recently used files are removed.
+	StoreQuota int64
+	// StoreRetention, if positive, is how long a file may go unused before
+	// it is removed from the store.
+	StoreRetention time.Duration
+	// EncryptedDir is where the ciphertext of encrypted files is kept and
+	// seeded from. Ciphertext that is no longer shared is removed, including
+	// at startup. Defaults to a directory per port in p2p.DefaultEncryptedDir.
+	EncryptedDir string
+}
+
+// Share is a file shared by a Node.
+type Share struct {
+	FileHash string
+	Path     string
+}
+
+// Node is a peer in the swarm. Create one with New and call Run to serve
+// shared files.
+type Node struct {
+	cfg         Config
+	logger      Logger
+	fileManager *p2p.FileManager
+	local       *p2p.LocalStore
+	store       *p2p.Store // nil if not used
+	tracker     *TrackerClient
+	server      *p2p.P2PServer
+	rendezvous  *p2p.Rendezvous  // nil if not used
+	relay       *p2p.RelayClient // nil if not used
+	scores      *p2p.PeerScores
+
+	mu         sync.Mutex
+	downloaded map[string]int64 // fileHash -> bytes received from peers
+}
+
+// New creates a node, discovering the tracker if cfg.TrackerURL is empty.
+func New(ctx context.Context, cfg Config) (*Node, error) {
+	if cfg.Port == 0 {
+		cfg.Port = 4040
+	}
+	if cfg.Logger == nil {
+		cfg.Logger = log.Default()
+	}
+	if cfg.HeartbeatInterval == 0 {
+		cfg.HeartbeatInterval = 2 * time.Minute
+	}
+	if cfg.FileWatchInterval == 0 {
+		cfg.FileWatchInterval = 10 * time.Second
+	}
+	logger := cfg.Logger
+
+	if cfg.TrackerURL == "" {
+		logger.Printf("Discovering tracker on the network...")
+		info, err := discovery.DiscoverTracker(ctx)
+		if err != nil {
+			return nil, err
+		}
+		logger.Printf("Tracker found at: %s", info.URL)
+		cfg.TrackerURL = info.URL
+		cfg.TrackerFingerprint = info.Fingerprint
+		cfg.TrackerHTTP3 = info.HTTP3
+		cfg.Rendezvous = info.Rendezvous
+		if info.Relay {
+			cfg.Relay = info.URL
+		}
+	}
+
+	tracker, err := newTrackerClient(cfg.TrackerURL, cfg.Port, cfg.Interface, cfg.AdvertiseAddrs, logger)
+	if err != nil {
+		return nil, err
+	}
+	tracker.SetToken(cfg.Token)
+	tracker.setTransport(cfg.TrackerFingerprint, cfg.TrackerHTTP3)
+	if identity := loadIdentity(cfg.IdentityPath, cfg.Port, logger); identity != nil {
+		tracker.setIdentity(identity)
+	}
+
+	fileManager := p2p.NewFileManager(openIndex(cfg.IndexPath, logger), logger)
+	n := &Node{
+		cfg:         cfg,
+		logger:      logger,
+		fileManager: fileManager,
+		local:       p2p.NewLocalStore(fileManager, cfg.LocalDirs),
+		tracker:     tracker,
+		server:      p2p.NewP2PServer(fileManager, fmt.Sprintf(":%d", cfg.Port), logger),
+		downloaded:  make(map[string]int64),
+	}
+	fileManager.OnChange(n.fileChanged)
+	if cfg.ContentDefinedChunking {
+		fileManager.SetChunking(common.ChunkingCDC)
+	}
+	if cfg.StoreDir != "" {
+		n.store, err = p2p.OpenStore(cfg.StoreDir, fileManager, logger)
+		if err != nil {
+			return nil, fmt.Errorf("could not open store: %w", err)
+		}
+		n.store.Load()
+	}
+	n.cleanEncrypted()
+	tracker.describe = fileManager.GetMetadata
+	tracker.transfers = n.transfers
+	if cfg.Rendezvous != "" {
+		if err := n.startRendezvous(cfg.Rendezvous); err != nil {
+			return nil, err
+		}
+	}
+	n.scores = loadScores(cfg.ScoresPath, logger)
+	if cfg.Relay != "" {
+		n.relay, err = p2p.NewRelayClient(cfg.Relay, tracker.client.Transport, cfg.Token, tracker.identity, logger)
+		if err != nil {
+			return nil, err
+		}
+	}
+	return n, nil
+}
+
+// startRendezvous registers the node's QUIC socket with the rendezvous
+// service at addr. The socket is opened now rather than when Run starts
+// serving, so downloads started before Run can use it too.
+func (n *Node) startRendezvous(addr string) error {
+	rv, err := p2p.NewRendezvous(addr, n.tracker.identity, n.logger)
+	if err != nil {
+		return err
+	}
+	transport, err := n.server.Transport()
+	if err != nil {
+		return err
+	}
+	rv.Start(transport)
+	n.rendezvous = rv
+	return nil
+}
+
+// openIndex opens the hash index at path, or at the default location if path
+// is empty. It returns nil, meaning an in-memory index, if that fails.
+func openIndex(path string, logger Logger) *p2p.HashIndex {
+	var err error
+	if path == "" {
+		path, err = p2p.DefaultIndexPath()
+	}
+	var index *p2p.HashIndex
+	if err == nil {
+		index, err = p2p.OpenHashIndex(path, logger)
+	}
+	if err != nil {
+		logger.Printf("Could not open hash index, hashes will not be cached: %v", err)
+	}
+	return index
+}
+
+// loadScores loads the peer scores saved at path, if any. It returns empty
+// scores if path is empty or loading fails.
+func loadScores(path string, logger Logger) *p2p.PeerScores {
+	if path == "" {
+		return p2p.NewPeerScores()
+	}
+	scores, err := p2p.LoadPeerScores(path)
+	if err != nil {
+		logger.Printf("Could not load peer scores, starting afresh: %v", err)
+		return p2p.NewPeerScores()
+	}
+	return scores
+}
+
+// loadIdentity loads the identity key at path, or at the default location
+// for port if path is empty. It returns nil, meaning a temporary identity, if
+// that fails.
+func loadIdentity(path string, port int, logger Logger) *common.Identity {
+	var err error
+	if path == "" {
+		path, err = common.DefaultIdentityPath(port)
+	}
+	var identity *common.Identity
+	if err == nil {
+		identity, err = common.LoadIdentity(path)
+	}
+	if err != nil {
+		logger.Printf("Could not load identity key, using a temporary one: %v", err)
+	}
+	return identity
+}
+
+// Run serves shared files to other peers and keeps the tracker up to date
+// until ctx is done. It then tells the tracker the node has left its swarms.
+func (n *Node) Run(ctx context.Context) error {
+	go n.tracker.heartbeat(ctx, n.cfg.HeartbeatInterval, n.fileManager.Hashes)
+	go n.fileManager.Watch(ctx, n.cfg.FileWatchInterval)
+	if n.cfg.MetricsAddr != "" {
+		go func() {
+			if err := n.server.ServeMetrics(ctx, n.cfg.MetricsAddr); err != nil {
+				n.logger.Printf("Metrics server failed: %v", err)
+			}
+		}()
+	}
+	if n.relay != nil {
+		go n.relay.Serve(ctx, n.server.Handler())
+	}
+	if n.store != nil {
+		go n.maintainStore(ctx)
+	}
+	err := n.server.Start(ctx)
+	n.stopAnnounces()
+	if ferr := n.fileManager.FlushIndex(); ferr != nil {
+		n.logger.Printf("Could not save hash index: %v", ferr)
+	}
+	return err
+}
+
+// Tracker returns the node's tracker client.
+func (n *Node) Tracker() *TrackerClient {
+	return n.tracker
+}
+
+// Share starts sharing the file at path and announces it to the tracker.
+func (n *Node) Share(ctx context.Context, path string) (Link, error) {
+	hash, err := n.fileManager.AddFile(path)
+	if err != nil {
+		return Link{}, fmt.Errorf("could not process file: %w", err)
+	}
+	if err := n.tracker.Announce(ctx, hash); err != nil {
+		n.fileManager.RemoveFile(hash)
+		return Link{}, err
+	}
+	meta, _ := n.fileManager.GetMetadata(hash)
+	return Link{FileHash: hash, FileName: meta.FileName, FileSize: meta.FileSize}, nil
+}
+
+// ShareEncrypted encrypts the file at path with a new key and shares the
+// ciphertext. Peers only ever see the ciphertext; the key is carried by the
+// returned link alone.
+func (n *Node) ShareEncrypted(ctx context.Context, path string) (Link, error) {
+	stat, err := os.Stat(path)
+	if err != nil {
+		return Link{}, fmt.Errorf("could not process file: %w", err)
+	}
+	dir, err := n.encryptedDir()
+	if err != nil {
+		return Link{}, err
+	}
+	key, err := p2p.NewKey()
+	if err != nil {
+		return Link{}, err
+	}
+	encPath, _, err := p2p.EncryptFile(path, dir, key)
+	if err != nil {
+		return Link{}, fmt.Errorf("could not encrypt file: %w", err)
+	}
+	link, err := n.Share(ctx, encPath)
+	if err != nil {
+		os.Remove(encPath)
+		return Link{}, err
+	}
+	link.FileName = filepath.Base(path)
+	link.FileSize = stat.Size()
+	link.Key = key
+	return link, nil
+}
+
+// encryptedDir returns the node's directory for ciphertext. Nodes on
+// different ports get different directories, so none removes another's.
+func (n *Node) encryptedDir() (string, error) {
+	if n.cfg.EncryptedDir != "" {
+		return n.cfg.EncryptedDir, nil
+	}
+	dir, err := p2p.DefaultEncryptedDir()
+	if err != nil {
+		return "", fmt.Errorf("no directory for encrypted files: %w", err)
+	}
+	return filepath.Join(dir, strconv.Itoa(n.cfg.Port)), nil
+}
+
+// removeEncrypted deletes the file at path if it is a ciphertext copy in
+// the node's encrypted directory.
+func (n *Node) removeEncrypted(path string) {
+	dir, err := n.encryptedDir()
+	if err != nil || filepath.Dir(path) != filepath.Clean(dir) {
+		return
+	}
+	if err := os.Remove(path); err != nil && !os.IsNotExist(err) {
+		n.logger.Printf("Could not remove encrypted copy %s: %v", path, err)
+	}
+}
+
+// cleanEncrypted removes the ciphertext left in the encrypted directory by
+// earlier runs, which is no longer shared since links are not kept. Partial
+// downloads are kept so they can resume.
+func (n *Node) cleanEncrypted() {
+	dir, err := n.encryptedDir()
+	if err != nil {
+		return
+	}
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return
+	}
+	for _, e := range entries {
+		name := e.Name()
+		if !e.Type().IsRegular() || !ValidHash(name) && !strings.HasPrefix(name, "encrypt-") {
+			continue
+		}
+		if err := os.Remove(filepath.Join(dir, name)); err != nil {
+			n.logger.Printf("Could not remove encrypted copy %s: %v", name, err)
+		}
+	}
+}
+
+// Unshare stops sharing a file and withdraws it from the tracker. The
+// ciphertext of a file shared encrypted is deleted.
+func (n *Node) Unshare(ctx context.Context, fileHash string) error {
+	path, ok := n.fileManager.GetFilePath(fileHash)
+	if !ok {
+		return ErrNotShared
+	}
+	n.fileManager.RemoveFile(fileHash)
+	n.removeEncrypted(path)
+	return n.tracker.Withdraw(ctx, fileHash)
+}
+
+// Shares returns the files the node is sharing, sorted by path.
+func (n *Node) Shares() []Share {
+	var shares []Share
+	for path, hash := range n.fileManager.SharedPaths() {
+		shares = append(shares, Share{FileHash: hash, Path: path})
+	}
+	sort.Slice(shares, func(i, j int) bool { return shares[i].Path < shares[j].Path })
+	return shares
+}
+
+// Metadata returns the metadata of a shared file.
+func (n *Node) Metadata(fileHash string) (*FileMetadata, bool) {
+	return n.fileManager.GetMetadata(fileHash)
+}
+
+// Get downloads a file from the swarm to outputPath. The node is announced
+// as a leecher while downloading; once the file is verified it is shared and
+// announced as completed. A file already on this machine is copied without
+// asking the tracker, unless the copy turns out to be unusable, and chunks
+// found in local files are not downloaded. If the node has a store the file
+// is downloaded into it and exported to outputPath.
+func (n *Node) Get(ctx context.Context, fileHash, outputPath string, opts DownloadOptions) error {
+	target := outputPath
+	if n.store != nil {
+		if !ValidHash(fileHash) {
+			return fmt.Errorf("invalid file hash %q", fileHash)
+		}
+		if n.store.Has(fileHash) {
+			n.logger.Printf("File is in the store.")
+			return n.export(ctx, fileHash, outputPath, opts.HardLink)
+		}
+		target = n.store.Path(fileHash)
+		if err := os.MkdirAll(filepath.Dir(target), 0o755); err != nil {
+			return err
+		}
+	}
+	if opts.Local == nil {
+		opts.Local = n.local
+	}
+	var peers []PeerInfo
+	local := opts.Local.Has(fileHash)
+	if local {
+		n.logger.Printf("File is available locally.")
+	} else {
+		var err error
+		if peers, err = n.findPeers(ctx, fileHash); err != nil {
+			return err
+		}
+	}
+
+	if opts.Logger == nil {
+		opts.Logger = n.logger
+	}
+	if opts.Rendezvous == nil {
+		opts.Rendezvous = n.rendezvous
+	}
+	if opts.Relay == nil {
+		opts.Relay = n.relay
+	}
+	if opts.Scores == nil {
+		opts.Scores = n.scores
+		defer n.saveScores()
+	}
+	a := &announcer{node: n, ctx: ctx, fileHash: fileHash}
+	progress := opts.Progress
+	opts.Progress = func(ev ProgressEvent) {
+		a.update(ev)
+		if progress != nil {
+			progress(ev)
+		}
+	}
+	err := p2p.DownloadFile(ctx, fileHash, target, peers, n.fileManager, opts)
+	if local && errors.Is(err, ErrNoPeers) {
+		// The local copy could not be reused after all.
+		if peers, err = n.findPeers(ctx, fileHash); err == nil {
+			err = p2p.DownloadFile(ctx, fileHash, target, peers, n.fileManager, opts)
+		}
+	}
+	if err != nil {
+		if _, shared := n.fileManager.GetFilePath(fileHash); shared || !a.announced() {
+			return err
+		}
+		if err := a.finish(common.AnnounceStopped); err != nil {
+			n.logger.Printf("Could not announce stopped download: %v", err)
+		}
+		return err
+	}
+	keep := n.store != nil
+	if keep && n.cfg.StoreQuota > 0 {
+		if stat, err := os.Stat(target); err == nil && stat.Size() > n.cfg.StoreQuota {
+			n.logger.Printf("File is larger than the store quota, not keeping it in the store")
+			if err := n.store.Release(fileHash, outputPath); err != nil {
+				return fmt.Errorf("could not move file out of store: %w", err)
+			}
+			keep = false
+		}
+	}
+	if keep {
+		if err := n.store.Add(fileHash, filepath.Base(outputPath)); err != nil {
+			return fmt.Errorf("could not add file to store: %w", err)
+		}
+	}
+	if err := a.finish(common.AnnounceCompleted); err != nil {
+		n.logger.Printf("Could not announce newly downloaded file: %v", err)
+	}
+	if keep {
+		return n.export(ctx, fileHash, outputPath, opts.HardLink)
+	}
+	return nil
+}
+
+// findPeers asks the tracker for the seeders of a file.
+func (n *Node) findPeers(ctx context.Context, fileHash string) ([]PeerInfo, error) {
+	peers, err := n.tracker.Want(ctx, fileHash)
+	if err != nil {
+		return nil, err
+	}
+	peers = seeders(peers)
+	n.logger.Printf("Found %d peers for the file.", len(peers))
+	return peers, nil
+}
+
+// export places the stored file with the given hash at outputPath, then
+// makes room in the store.
+func (n *Node) export(ctx context.Context, fileHash, outputPath string, link bool) error {
+	if err := n.store.Export(fileHash, outputPath, link); err != nil {
+		return fmt.Errorf("could not export file from store: %w", err)
+	}
+	n.collectGarbage(ctx)
+	return nil
+}
+
+// maintainStore announces the stored files, then collects the store's
+// garbage every storeGCInterval until ctx is done.
+func (n *Node) maintainStore(ctx context.Context) {
+	for _, hash := range n.store.Hashes() {
+		if err := n.tracker.Announce(ctx, hash); err != nil {
+			n.logger.Printf("Could not announce stored file %s: %v", hash[:10], err)
+		}
+	}
+	ticker := time.NewTicker(storeGCInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			n.collectGarbage(ctx)
+		}
+	}
+}
+
+// collectGarbage removes files from the store according to its quota and
+// retention, and withdraws them from the tracker.
+func (n *Node) collectGarbage(ctx context.Context) {
+	for _, hash := range n.store.GC(n.cfg.StoreQuota, n.cfg.StoreRetention) {
+		n.logger.Printf("Removed %s from the store", hash[:10])
+		if err := n.tracker.Withdraw(ctx, hash); err != nil {
+			n.logger.Printf("Could not withdraw removed file: %v", err)
+		}
+	}
+}
+
+// GetLink downloads the file of a link to outputPath. Files shared encrypted
+// are downloaded and seeded as ciphertext, which is decrypted to outputPath
+// with the link's key.
+func (n *Node) GetLink(ctx context.Context, link Link, outputPath string, opts DownloadOptions) error {
+	if len(link.Key) == 0 {
+		return n.Get(ctx, link.FileHash, outputPath, opts)
+	}
+	encPath, err := n.encryptedPath(link, outputPath)
+	if err != nil {
+		return err
+	}
+	if err := n.Get(ctx, link.FileHash, encPath, opts); err != nil {
+		return err
+	}
+	if err := p2p.DecryptFile(encPath, outputPath, link.Key); err != nil {
+		return fmt.Errorf("could not decrypt file: %w", err)
+	}
+	return nil
+}
+
+// DownloadPath returns the path GetLink downloads link to, which is in the
+// store if the node has one, and otherwise outputPath unless the file is
+// encrypted. Partial data is kept at its TempPath.
+func (n *Node) DownloadPath(link Link, outputPath string) (string, error) {
+	if n.store == nil {
+		return n.encryptedPath(link, outputPath)
+	}
+	if !ValidHash(link.FileHash) {
+		return "", fmt.Errorf("invalid file hash %q", link.FileHash)
+	}
+	return n.store.Path(link.FileHash), nil
+}
+
+// encryptedPath returns the path the ciphertext of an encrypted link is
+// kept at, or outputPath if link is not encrypted.
+func (n *Node) encryptedPath(link Link, outputPath string) (string, error) {
+	if len(link.Key) == 0 {
+		return outputPath, nil
+	}
+	if !ValidHash(link.FileHash) {
+		return "", fmt.Errorf("invalid file hash %q", link.FileHash)
+	}
+	dir, err := n.encryptedDir()
+	if err != nil {
+		return "", err
+	}
+	if err := os.MkdirAll(dir, 0o700); err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, link.FileHash), nil
+}
+
+// fileChangedTimeout bounds the tracker requests made for a changed file.
+const fileChangedTimeout = 30 * time.Second
+
+// fileChanged withdraws a shared file that changed on disk and announces it
+// under its new hash.
+func (n *Node) fileChanged(oldHash string, meta *FileMetadata) {
+	ctx, cancel := context.WithTimeout(context.Background(), fileChangedTimeout)
+	defer cancel()
+	if err := n.tracker.Withdraw(ctx, oldHash); err != nil {
+		n.logger.Printf("Could not withdraw changed file: %v", err)
+	}
+	if meta == nil {
+		return
+	}
+	if err := n.tracker.Announce(ctx, meta.FileHash); err != nil {
+		n.logger.Printf("Could not announce changed file: %v", err)
+	}
+}
+
+// saveScores saves the peer scores if the node keeps them between runs.
+func (n *Node) saveScores() {
+	if n.cfg.ScoresPath == "" {
+		return
+	}
+	if err := n.scores.Save(n.cfg.ScoresPath); err != nil {
+		n.logger.Printf("Could not save peer scores: %v", err)
+	}
+}
@@ -0,0 +1,255 @@
+package node
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"dropeer/internal/common"
+	"dropeer/internal/p2p"
+)
+
+// fakeTracker records announces and withdrawals and answers wants with the
+// peers announced.
+type fakeTracker struct {
+	status atomic.Int32 // if set, every request fails with it
+
+	mu        sync.Mutex
+	peers     map[string][]PeerInfo // file hash -> announced peers
+	withdrawn []string
+	wants     int
+}
+
+func newFakeTracker(t *testing.T) (*fakeTracker, string) {
+	f := &fakeTracker{peers: make(map[string][]PeerInfo)}
+	server := httptest.NewServer(f)
+	t.Cleanup(server.Close)
+	return f, server.URL
+}
+
+func (f *fakeTracker) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if status := int(f.status.Load()); status != 0 {
+		http.Error(w, "failed", status)
+		return
+	}
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.URL.Path {
+	case "/announce":
+		var req common.AnnounceRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.peers[req.FileHash] = append(f.peers[req.FileHash], req.PeerInfo)
+	case "/withdraw":
+		var req common.WithdrawRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.withdrawn = append(f.withdrawn, req.FileHash)
+	case "/want":
+		var req common.WantRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		f.wants++
+		json.NewEncoder(w).Encode(common.WantResponse{Peers: f.peers[req.FileHash]})
+	}
+}
+
+// freePort returns a UDP port that is free at the time of the call.
+func freePort(t *testing.T) int {
+	t.Helper()
+	conn, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).Port
+}
+
+// newTestNode creates a node that keeps its state under a temp dir and uses
+// the tracker at trackerURL.
+func newTestNode(t *testing.T, trackerURL string, cfg Config) *Node {
+	t.Helper()
+	dir := t.TempDir()
+	cfg.TrackerURL = trackerURL
+	cfg.IndexPath = filepath.Join(dir, "index.json")
+	cfg.IdentityPath = filepath.Join(dir, "identity.key")
+	cfg.EncryptedDir = filepath.Join(dir, "encrypted")
+	cfg.Logger = log.New(io.Discard, "", 0)
+	n, err := New(context.Background(), cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
+
+func writeTestFile(t *testing.T, data string) string {
+	t.Helper()
+	path := filepath.Join(t.TempDir(), "file.txt")
+	if err := os.WriteFile(path, []byte(data), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestShareAndUnshare(t *testing.T) {
+	tracker, url := newFakeTracker(t)
+	n := newTestNode(t, url, Config{})
+	path := writeTestFile(t, "shared data")
+	ctx := context.Background()
+
+	link, err := n.Share(ctx, path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.FileName != "file.txt" || link.FileSize != 11 || !ValidHash(link.FileHash) {
+		t.Errorf("Share() = %+v", link)
+	}
+	if got := tracker.peers[link.FileHash]; len(got) != 1 || got[0].ID != n.Tracker().PeerInfo().ID {
+		t.Errorf("tracker got announces %+v", got)
+	}
+	if shares := n.Shares(); !slices.Equal(shares, []Share{{FileHash: link.FileHash, Path: path}}) {
+		t.Errorf("Shares() = %+v", shares)
+	}
+	if meta, ok := n.Metadata(link.FileHash); !ok || meta.FileSize != 11 {
+		t.Errorf("Metadata() = %+v, %v", meta, ok)
+	}
+
+	if err := n.Unshare(ctx, link.FileHash); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(tracker.withdrawn, []string{link.FileHash}) {
+		t.Errorf("tracker got withdrawals %v", tracker.withdrawn)
+	}
+	if shares := n.Shares(); len(shares) != 0 {
+		t.Errorf("Shares() after Unshare = %+v", shares)
+	}
+	if err := n.Unshare(ctx, link.FileHash); !errors.Is(err, ErrNotShared) {
+		t.Errorf("second Unshare() error = %v, want %v", err, ErrNotShared)
+	}
+}
+
+func TestShareTrackerErrors(t *testing.T) {
+	tests := []struct {
+		status  int
+		wantErr error
+	}{
+		{http.StatusUnauthorized, ErrUnauthorized},
+		{http.StatusForbidden, ErrUnauthorized},
+	}
+	for _, tt := range tests {
+		t.Run(http.StatusText(tt.status), func(t *testing.T) {
+			tracker, url := newFakeTracker(t)
+			tracker.status.Store(int32(tt.status))
+			n := newTestNode(t, url, Config{})
+			_, err := n.Share(context.Background(), writeTestFile(t, "data"))
+			var trackerErr *TrackerError
+			if !errors.Is(err, tt.wantErr) || !errors.As(err, &trackerErr) || trackerErr.StatusCode != tt.status {
+				t.Errorf("Share() error = %v, want %v with status %d", err, tt.wantErr, tt.status)
+			}
+			// A file the tracker did not accept is not shared.
+			if shares := n.Shares(); len(shares) != 0 {
+				t.Errorf("Shares() = %+v", shares)
+			}
+		})
+	}
+}
+
+func TestGetErrors(t *testing.T) {
+	hash := strings.Repeat("ab", 32)
+	tracker, url := newFakeTracker(t)
+	n := newTestNode(t, url, Config{})
+	output := filepath.Join(t.TempDir(), "out")
+
+	if err := n.Get(context.Background(), hash, output, DownloadOptions{}); !errors.Is(err, ErrNoPeers) {
+		t.Errorf("Get() without peers error = %v, want %v", err, ErrNoPeers)
+	}
+
+	tracker.status.Store(http.StatusNotFound)
+	if err := n.Get(context.Background(), hash, output, DownloadOptions{}); !errors.Is(err, ErrUnknownFile) {
+		t.Errorf("Get() of an unknown file error = %v, want %v", err, ErrUnknownFile)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := n.Get(ctx, hash, output, DownloadOptions{}); !errors.Is(err, context.Canceled) {
+		t.Errorf("Get() with a cancelled context error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func TestGetFromPeer(t *testing.T) {
+	_, url := newFakeTracker(t)
+	seeder := newTestNode(t, url, Config{Port: freePort(t)})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go seeder.Run(ctx)
+
+	link, err := seeder.Share(ctx, writeTestFile(t, "data from a peer"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	leecher := newTestNode(t, url, Config{Port: freePort(t)})
+	output := filepath.Join(t.TempDir(), "out.txt")
+	var mu sync.Mutex
+	var events []ProgressEvent
+	opts := DownloadOptions{Progress: func(ev ProgressEvent) {
+		mu.Lock()
+		events = append(events, ev)
+		mu.Unlock()
+	}}
+	getCtx, stop := context.WithTimeout(ctx, 10*time.Second)
+	defer stop()
+	if err := leecher.GetLink(getCtx, link, output, opts); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(output)
+	if err != nil || string(data) != "data from a peer" {
+		t.Errorf("downloaded %q, %v", data, err)
+	}
+	if len(events) == 0 || events[len(events)-1].Kind != EventVerified || events[len(events)-1].Err != nil {
+		t.Errorf("progress events %+v, want the last to report verification", events)
+	}
+	// The downloaded file is shared from its new path.
+	if shares := leecher.Shares(); !slices.Equal(shares, []Share{{FileHash: link.FileHash, Path: output}}) {
+		t.Errorf("Shares() = %+v", shares)
+	}
+}
+
+func TestGetAsksTrackerWhenLocalCopyIsGone(t *testing.T) {
+	tracker, url := newFakeTracker(t)
+	local := t.TempDir()
+	path := filepath.Join(local, "file")
+	if err := os.WriteFile(path, []byte("local copy"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	n := newTestNode(t, url, Config{LocalDirs: []string{local}})
+	hash, err := p2p.HashFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !n.local.Has(hash) {
+		t.Fatal("local copy not found")
+	}
+
+	// The copy goes away after the scan found it.
+	if err := os.Remove(path); err != nil {
+		t.Fatal(err)
+	}
+	err = n.Get(context.Background(), hash, filepath.Join(t.TempDir(), "out"), DownloadOptions{})
+	if !errors.Is(err, ErrNoPeers) {
+		t.Errorf("Get() error = %v, want %v", err, ErrNoPeers)
+	}
+	if tracker.wants != 1 {
+		t.Errorf("tracker asked for peers %d times, want 1", tracker.wants)
+	}
+}
@@ -0,0 +1,226 @@
+package node
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"time"
+
+	"dropeer/internal/common"
+
+	"github.com/quic-go/quic-go/http3"
+)
+
+// maxAnnouncedAddrs is the number of addresses the tracker accepts per peer.
+const maxAnnouncedAddrs = 16
+
+// TrackerClient communicates with the tracker server.
+type TrackerClient struct {
+	baseURL  string
+	client   *http.Client
+	peerInfo common.PeerInfo
+	logger   Logger
+	token    string
+	identity *common.Identity // signs announces and withdrawals
+	// describe, if set, looks up the metadata of files being announced so
+	// their name and size can be shown on the tracker.
+	describe func(fileHash string) (*common.FileMetadata, bool)
+	// transfers, if set, returns the bytes of a file uploaded to and
+	// downloaded from other peers, which are reported in announces.
+	transfers func(fileHash string) (uploaded, downloaded int64)
+}
+
+// NewTrackerClient creates a client for the tracker at trackerURL that
+// announces this peer as listening on peerPort. The peer gets a new identity;
+// Node uses a persistent one instead.
+func NewTrackerClient(trackerURL string, peerPort int, logger Logger) (*TrackerClient, error) {
+	return newTrackerClient(trackerURL, peerPort, "", nil, logger)
+}
+
+// newTrackerClient is NewTrackerClient announcing the addresses of iface, or
+// the advertise addresses if given; see chooseAddrs.
+func newTrackerClient(trackerURL string, peerPort int, iface string, advertise []string, logger Logger) (*TrackerClient, error) {
+	localIP, addrs, err := chooseAddrs(trackerURL, iface, advertise)
+	if err != nil {
+		return nil, fmt.Errorf("could not determine local addresses: %w", err)
+	}
+	if localIP == "" {
+		logger.Printf("No local address found; the tracker will record the address it sees")
+	} else {
+		logger.Printf("Using local IP address: %s", localIP)
+	}
+	if len(addrs) > maxAnnouncedAddrs {
+		addrs = addrs[:maxAnnouncedAddrs]
+	}
+
+	identity, err := common.NewIdentity()
+	if err != nil {
+		return nil, err
+	}
+	c := &TrackerClient{
+		baseURL: trackerURL,
+		client:  &http.Client{Timeout: 10 * time.Second},
+		peerInfo: common.PeerInfo{
+			IP:    localIP,
+			Addrs: addrs,
+			Port:  peerPort,
+		},
+		logger: logger,
+	}
+	c.setIdentity(identity)
+	return c, nil
+}
+
+// setTransport pins the tracker's certificate to fingerprint, if not empty,
+// and switches to HTTP/3 if useHTTP3 is set.
+func (c *TrackerClient) setTransport(fingerprint string, useHTTP3 bool) {
+	tlsConfig := common.PinnedTLSConfig(fingerprint)
+	if useHTTP3 {
+		c.client.Transport = &http3.Transport{TLSClientConfig: tlsConfig}
+		return
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.TLSClientConfig = tlsConfig
+	c.client.Transport = transport
+}
+
+func (c *TrackerClient) setIdentity(identity *common.Identity) {
+	c.identity = identity
+	c.peerInfo.ID = identity.PeerID()
+	c.peerInfo.PublicKey = identity.PublicKey()
+}
+
+// PeerInfo returns the peer information announced to the tracker.
+func (c *TrackerClient) PeerInfo() PeerInfo {
+	return c.peerInfo
+}
+
+// SetToken sets the bearer token sent with every tracker request.
+func (c *TrackerClient) SetToken(token string) {
+	c.token = token
+}
+
+// Announce tells the tracker this peer has a file.
+func (c *TrackerClient) Announce(ctx context.Context, fileHash string) error {
+	if err := c.announce(ctx, fileHash, "", 0); err != nil {
+		return err
+	}
+	c.logger.Printf("Announced file %s to tracker", fileHash[:10])
+	return nil
+}
+
+// announce sends an announce with an event, one of the common.Announce*
+// constants or empty for a periodic update, and the bytes of the file this
+// peer is still missing.
+func (c *TrackerClient) announce(ctx context.Context, fileHash, event string, left int64) error {
+	reqBody := common.AnnounceRequest{
+		FileHash: fileHash,
+		PeerInfo: c.peerInfo,
+		Event:    event,
+	}
+	reqBody.PeerInfo.Left = left
+	if c.describe != nil {
+		if meta, ok := c.describe(fileHash); ok {
+			reqBody.FileName = meta.FileName
+			reqBody.FileSize = meta.FileSize
+		}
+	}
+	if c.transfers != nil {
+		reqBody.Uploaded, reqBody.Downloaded = c.transfers(fileHash)
+	}
+	c.identity.SignAnnounce(&reqBody)
+	return c.post(ctx, "announce", reqBody, nil)
+}
+
+// Withdraw tells the tracker this peer no longer has a file.
+func (c *TrackerClient) Withdraw(ctx context.Context, fileHash string) error {
+	reqBody := common.WithdrawRequest{
+		FileHash: fileHash,
+		PeerID:   c.peerInfo.ID,
+	}
+	c.identity.SignWithdraw(&reqBody)
+	if err := c.post(ctx, "withdraw", reqBody, nil); err != nil {
+		return err
+	}
+	c.logger.Printf("Withdrew file %s from tracker", fileHash[:10])
+	return nil
+}
+
+// Want asks the tracker for peers that have a file, other than this one.
+// The tracker returns a random subset of the swarm, seeders first.
+func (c *TrackerClient) Want(ctx context.Context, fileHash string) ([]PeerInfo, error) {
+	reqBody := common.WantRequest{FileHash: fileHash, PeerID: c.peerInfo.ID}
+	var wantResp common.WantResponse
+	if err := c.post(ctx, "want", reqBody, &wantResp); err != nil {
+		return nil, err
+	}
+	c.logger.Printf("Swarm of %s has %d seeders and %d leechers, %d downloads completed",
+		fileHash[:10], wantResp.Seeders, wantResp.Leechers, wantResp.Completed)
+	return wantResp.Peers, nil
+}
+
+// post sends a JSON request to the tracker endpoint named op and decodes the
+// response into out, if out is not nil.
+func (c *TrackerClient) post(ctx context.Context, op string, body, out any) error {
+	jsonData, err := json.Marshal(body)
+	if err != nil {
+		return &TrackerError{Op: op, Err: err}
+	}
+	req, err := http.NewRequestWithContext(ctx, "POST", c.baseURL+"/"+op, bytes.NewBuffer(jsonData))
+	if err != nil {
+		return &TrackerError{Op: op, Err: err}
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
+
+	resp, err := c.client.Do(req)
+	if err != nil {
+		return &TrackerError{Op: op, Err: err}
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode != http.StatusOK {
+		msg, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		err := errors.New(strings.TrimSpace(string(msg)))
+		switch {
+		case resp.StatusCode == http.StatusNotFound && op == "want":
+			err = ErrUnknownFile
+		case resp.StatusCode == http.StatusUnauthorized || resp.StatusCode == http.StatusForbidden:
+			err = fmt.Errorf("%w: %v", ErrUnauthorized, err)
+		}
+		return &TrackerError{Op: op, StatusCode: resp.StatusCode, Err: err}
+	}
+	if out == nil {
+		return nil
+	}
+	if err := json.NewDecoder(resp.Body).Decode(out); err != nil {
+		return &TrackerError{Op: op, Err: fmt.Errorf("invalid response: %w", err)}
+	}
+	return nil
+}
+
+// heartbeat re-announces the files returned by fileHashes every interval
+// until ctx is done. Re-announcing keeps the tracker from expiring this peer.
+func (c *TrackerClient) heartbeat(ctx context.Context, interval time.Duration, fileHashes func() []string) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			for _, hash := range fileHashes() {
+				if err := c.Announce(ctx, hash); err != nil {
+					c.logger.Printf("Heartbeat for %s failed: %v", hash[:10], err)
+				}
+			}
+		}
+	}
+}